@@ -0,0 +1,106 @@
+package spacedb
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/emin/spacedb/internal/wal"
+)
+
+const (
+	batchPut = iota
+	batchDelete
+	batchDeleteRange
+	batchMerge
+)
+
+type batchOp struct {
+	kind  int
+	key   []byte
+	value []byte
+	// exclusive end of a DeleteRange
+	end []byte
+}
+
+// WriteBatch holds updates which are applied atomically by SpaceDB.Write.
+// Updates are applied in the order they are added to the batch
+type WriteBatch struct {
+	ops []batchOp
+	// number of merge operands in ops
+	merges int
+}
+
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{}
+}
+
+// Sets value of key, key and value are copied
+func (b *WriteBatch) Put(key, value []byte) {
+	b.set(key, (&DBValue{Value: value}).Serialize())
+}
+
+// Sets value of key which expires after ttl, key and value are copied.
+// Expiry time is computed when it is added to the batch, value is
+// expired already if ttl isn't positive
+func (b *WriteBatch) PutWithTTL(key, value []byte, ttl time.Duration) {
+	b.set(key, (&DBValue{Value: value, ExpiresAt: time.Now().Add(ttl)}).Serialize())
+}
+
+// Records a merge operand for key, key and operand are copied.
+// See SpaceDB.Merge
+func (b *WriteBatch) Merge(key, operand []byte) {
+	value := append([]byte{flagMergeOperand}, operand...)
+	b.ops = append(b.ops, batchOp{kind: batchMerge, key: cloneBytes(key), value: value})
+	b.merges++
+}
+
+// Deletes key, key is copied
+func (b *WriteBatch) Delete(key []byte) {
+	b.ops = append(b.ops, batchOp{kind: batchDelete, key: cloneBytes(key)})
+}
+
+// Deletes keys in [start, end) with a range tombstone, start and end
+// are copied. Keys put earlier in the batch are deleted too
+func (b *WriteBatch) DeleteRange(start, end []byte) {
+	b.ops = append(b.ops, batchOp{kind: batchDeleteRange, key: cloneBytes(start), end: cloneBytes(end)})
+}
+
+// Returns number of updates in the batch
+func (b *WriteBatch) Count() int {
+	return len(b.ops)
+}
+
+// Removes all updates, so the batch can be reused
+func (b *WriteBatch) Clear() {
+	b.ops = b.ops[:0]
+	b.merges = 0
+}
+
+// Adds a serialized DBValue for key
+func (b *WriteBatch) set(key, value []byte) {
+	b.ops = append(b.ops, batchOp{kind: batchPut, key: cloneBytes(key), value: value})
+}
+
+// Returns WAL logs of the batch, empty ranges are skipped
+func (b *WriteBatch) logs() []*wal.Log {
+	logs := make([]*wal.Log, 0, len(b.ops))
+	for _, op := range b.ops {
+		switch op.kind {
+		case batchPut, batchMerge:
+			logs = append(logs, &wal.Log{Key: op.key, Value: op.value})
+		case batchDelete:
+			logs = append(logs, &wal.Log{Key: op.key, Value: tombstoneValue})
+		case batchDeleteRange:
+			if bytes.Compare(op.key, op.end) >= 0 {
+				continue
+			}
+			value := append([]byte{flagRangeTombstone}, op.end...)
+			logs = append(logs, &wal.Log{Key: op.key, Value: value})
+		}
+	}
+	return logs
+}
+
+func cloneBytes(b []byte) []byte {
+	return append([]byte{}, b...)
+}
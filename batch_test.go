@@ -0,0 +1,48 @@
+package spacedb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpaceDBImpl_Write(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+	db := New(testPath())
+	a := assert.New(t)
+
+	a.Nil(db.Set([]byte("a"), &DBValue{Value: []byte("1")}))
+	a.Nil(db.Set([]byte("b"), &DBValue{Value: []byte("2")}))
+	a.Nil(db.Flush())
+	a.Nil(db.Set([]byte("c"), &DBValue{Value: []byte("3")}))
+
+	batch := NewWriteBatch()
+	batch.Put([]byte("bb"), []byte("4"))
+	batch.DeleteRange([]byte("b"), []byte("c"))
+	batch.Put([]byte("bc"), []byte("5"))
+	batch.Delete([]byte("c"))
+	batch.Put([]byte("d"), []byte("6"))
+	a.Equal(5, batch.Count())
+	a.Nil(db.Write(batch))
+
+	expected := map[string]string{"a": "1", "bc": "5", "d": "6"}
+	it, err := db.NewIterator(nil)
+	a.Nil(err)
+	a.Equal([]string{"a=1", "bc=5", "d=6"}, collectKeys(it))
+	a.Nil(it.Close())
+	for _, k := range []string{"b", "bb", "c"} {
+		_, err = db.Get([]byte(k))
+		a.Equal(ErrNotFound, err)
+	}
+
+	// batch is replayed from WAL
+	a.Nil(db.CloseWithOptions(&CloseOptions{SkipFlush: true}))
+	db = New(testPath())
+	for k, v := range expected {
+		a.Equal([]byte(v), getValue(t, db, []byte(k)))
+	}
+	_, err = db.Get([]byte("bb"))
+	a.Equal(ErrNotFound, err)
+	a.Nil(db.Close())
+}
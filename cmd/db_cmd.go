@@ -2,11 +2,13 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"runtime/pprof"
+	"strconv"
 	"strings"
 	"time"
 
@@ -30,7 +32,10 @@ func main() {
 	}
 
 	dbPath := "test-db/"
-	db := spacedb.New(dbPath)
+	db, err := spacedb.Open(dbPath, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	//now := time.Now()
 	//for i := 0; i < 1000000; i++ {
@@ -69,15 +74,13 @@ func runCmd(db spacedb.SpaceDB, cmd string) bool {
 	parts := strings.Split(cmd, " ")
 
 	if parts[0] == "get" {
-		res := db.Get([]byte(parts[1]))
-		if res == nil {
+		res, err := db.Get([]byte(parts[1]))
+		if errors.Is(err, spacedb.ErrNotFound) {
 			fmt.Printf("%v not found\n", parts[1])
+		} else if err != nil {
+			fmt.Println(err)
 		} else {
-			if res.IsDeleted {
-				fmt.Printf("%v not found\n", parts[1])
-			} else {
-				fmt.Println(string(res.Value))
-			}
+			fmt.Println(string(res.Value))
 		}
 	} else if parts[0] == "set" && len(parts) == 3 {
 		k := []byte(parts[1])
@@ -90,6 +93,29 @@ func runCmd(db spacedb.SpaceDB, cmd string) bool {
 		} else {
 			fmt.Println("success")
 		}
+	} else if parts[0] == "setex" && len(parts) == 4 {
+		secs, err := strconv.Atoi(parts[3])
+		if err != nil {
+			fmt.Println(err)
+			return true
+		}
+		err = db.SetWithTTL([]byte(parts[1]), &spacedb.DBValue{Value: []byte(parts[2])}, time.Duration(secs)*time.Second)
+		if err != nil {
+			fmt.Println(err)
+		} else {
+			fmt.Println("success")
+		}
+	} else if parts[0] == "ttl" && len(parts) == 2 {
+		ttl, err := db.TTL([]byte(parts[1]))
+		if errors.Is(err, spacedb.ErrNotFound) {
+			fmt.Printf("%v not found\n", parts[1])
+		} else if err != nil {
+			fmt.Println(err)
+		} else if ttl == spacedb.NoExpiry {
+			fmt.Println("no expiry")
+		} else {
+			fmt.Println(ttl)
+		}
 	} else if parts[0] == "delete" {
 		res := db.Delete([]byte(parts[1]))
 		if res != nil {
@@ -97,6 +123,33 @@ func runCmd(db spacedb.SpaceDB, cmd string) bool {
 		} else {
 			fmt.Println("deleted")
 		}
+	} else if parts[0] == "deleterange" && len(parts) == 3 {
+		err := db.DeleteRange([]byte(parts[1]), []byte(parts[2]))
+		if err != nil {
+			fmt.Println(err)
+		} else {
+			fmt.Println("deleted")
+		}
+	} else if parts[0] == "scan" {
+		opts := &spacedb.IteratorOptions{}
+		if len(parts) > 1 {
+			opts.LowerBound = []byte(parts[1])
+		}
+		if len(parts) > 2 {
+			opts.UpperBound = []byte(parts[2])
+		}
+		it, err := db.NewIterator(opts)
+		if err != nil {
+			fmt.Println(err)
+			return true
+		}
+		for ok := it.SeekToFirst(); ok; ok = it.Next() {
+			fmt.Printf("%v = %v\n", string(it.Key()), string(it.Value()))
+		}
+		if it.Err() != nil {
+			fmt.Println(it.Err())
+		}
+		it.Close()
 	} else if cmd == "memory" {
 		helpers.PrintMemUsage()
 	} else if cmd == "load" {
@@ -106,7 +159,11 @@ func runCmd(db spacedb.SpaceDB, cmd string) bool {
 			db.Set([]byte(k), &spacedb.DBValue{Value: []byte(v)})
 		}
 	} else if cmd == "count" {
-		fmt.Printf("Estimated Key Count: %v\n", db.KeyCount())
+		fmt.Printf("Estimated Key Count: %v\n", db.ApproximateKeyCount())
+	} else if cmd == "stats" {
+		stats := db.Stats()
+		fmt.Printf("Filter Hits: %v Misses: %v False Positives: %v\n",
+			stats.FilterHits, stats.FilterMisses, stats.FilterFalsePositives)
 	} else if cmd == "test" {
 		for i := 0; i < 10; i++ {
 			k := fmt.Sprintf("key%v", i)
@@ -114,7 +171,10 @@ func runCmd(db spacedb.SpaceDB, cmd string) bool {
 			db.Set([]byte(k), &spacedb.DBValue{Value: []byte(v)})
 		}
 	} else if cmd == "exit" {
-		db.Close()
+		err := db.Close()
+		if err != nil {
+			fmt.Println(err)
+		}
 		fmt.Println("bye..")
 		return false
 	}
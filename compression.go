@@ -0,0 +1,30 @@
+package spacedb
+
+import "github.com/emin/spacedb/internal"
+
+type (
+	CompressionType = internal.CompressionType
+	// Compressor compresses blocks of sstables. Compressors of custom types
+	// must be registered by RegisterCompressor before tables are read
+	Compressor = internal.Compressor
+)
+
+const (
+	CompressionNone = internal.CompressionNone
+	CompressionZlib = internal.CompressionZlib
+)
+
+var (
+	NoCompressor   = internal.NoCompressor
+	ZlibCompressor = internal.ZlibCompressor
+)
+
+// Returns a zlib Compressor of given level, see compress/zlib for levels
+func NewZlibCompressor(level int) Compressor {
+	return internal.NewZlibCompressor(level)
+}
+
+// Registers c to decompress blocks of its type
+func RegisterCompressor(c Compressor) {
+	internal.RegisterCompressor(c)
+}
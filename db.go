@@ -2,46 +2,127 @@ package spacedb
 
 import (
 	"bytes"
+	"container/list"
+	"encoding/binary"
 	"fmt"
 	"log"
 	"os"
-	"sort"
+	"path"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/emin/spacedb/internal"
 	"github.com/emin/spacedb/internal/wal"
 )
 
-const MaxMemTableSize int64 = 4 * 1024 * 1024 // 4MB
+// Writes are stalled while this many memtables are waiting for flush
+const MaxImmutableMemTables = 2
 
 type DBValue struct {
-	IsDeleted bool
-	Value     []byte
+	Value []byte
+	// Time when the value expires, zero means it never expires
+	ExpiresAt time.Time
 }
 
+// Values are stored after a flag byte, the flag of tombstones is 1.
+// Tombstones are never returned by reads. WAL logs of range tombstones
+// have the start key as key and the end key after flag 2 as value.
+// Values which expire have flag 3 and the expiry time in unix
+// nanoseconds (8 bytes) before the value. Merge operands have flag 4
+const (
+	flagValue          byte = 0
+	flagTombstone      byte = 1
+	flagRangeTombstone byte = 2
+	flagExpiringValue  byte = 3
+	flagMergeOperand   byte = 4
+)
+
+// Length of the header of expiring values
+const expiringHeaderLen = 9
+
+// Returned by TTL for keys which never expire
+const NoExpiry time.Duration = -1
+
+// Stored value of deleted keys
+var tombstoneValue = []byte{flagTombstone}
+
 func (d *DBValue) Serialize() []byte {
-	flag := byte(0)
-	if d.IsDeleted {
-		flag = byte(1)
+	if d.ExpiresAt.IsZero() {
+		return append([]byte{flagValue}, d.Value...)
 	}
-	return append([]byte{flag}, d.Value...)
+	b := make([]byte, expiringHeaderLen, expiringHeaderLen+len(d.Value))
+	b[0] = flagExpiringValue
+	binary.LittleEndian.PutUint64(b[1:], uint64(d.ExpiresAt.UnixNano()))
+	return append(b, d.Value...)
 }
 
 func Deserialize(d []byte) *DBValue {
+	if len(d) >= expiringHeaderLen && d[0] == flagExpiringValue {
+		return &DBValue{
+			Value:     d[expiringHeaderLen:],
+			ExpiresAt: time.Unix(0, int64(binary.LittleEndian.Uint64(d[1:]))),
+		}
+	}
 	return &DBValue{
-		IsDeleted: d[0] == 1,
-		Value:     d[1:],
+		Value: d[1:],
+	}
+}
+
+// Reports whether a serialized DBValue is expired at now
+func isExpired(value []byte, now time.Time) bool {
+	if len(value) < expiringHeaderLen || value[0] != flagExpiringValue {
+		return false
 	}
+	return int64(binary.LittleEndian.Uint64(value[1:])) <= now.UnixNano()
 }
 
 type SpaceDB interface {
 	Set(key []byte, value *DBValue) error
-	Get(key []byte) *DBValue
+	// Sets value of key which expires after ttl, ttl must be positive.
+	// Expired keys aren't returned by reads and are dropped by compaction
+	SetWithTTL(key []byte, value *DBValue, ttl time.Duration) error
+	// Returns time left until key expires, NoExpiry if it never expires
+	TTL(key []byte) (time.Duration, error)
+	// Sets value of key if its current value is expected. Returns
+	// ErrNotFound if key doesn't exist and ErrValueMismatch if it has
+	// another value
+	CompareAndSet(key, expected []byte, value *DBValue) error
+	// Sets value of key if it doesn't exist, ErrKeyExists otherwise
+	SetIfAbsent(key []byte, value *DBValue) error
+	// Sets value of key to the value which fn returns for its current
+	// value, old is nil if key doesn't exist. Key is deleted if fn returns
+	// nil, nothing is written if fn returns an error and the error is
+	// returned. fn runs while other writes wait, it must not use the database
+	Update(key []byte, fn func(old *DBValue) (*DBValue, error)) error
+	// Records operand which Options.MergeOperator combines with the
+	// value of key when it is read. Merged values never expire
+	Merge(key, operand []byte) error
+	// Returns value of key, ErrNotFound if it doesn't exist or is deleted
+	Get(key []byte) (*DBValue, error)
+	// Returns value of key as of the snapshot
+	GetAt(key []byte, snapshot *Snapshot) (*DBValue, error)
+	// Returns a snapshot of the current state, it must be released after use
+	GetSnapshot() *Snapshot
+	ReleaseSnapshot(snapshot *Snapshot)
 	Delete(key []byte) error
-	KeyCount() int64
-	Close()
+	// Deletes all keys in [start, end) with a single range tombstone
+	DeleteRange(start, end []byte) error
+	// Applies all updates of the batch atomically
+	Write(batch *WriteBatch) error
+	WriteWithOptions(batch *WriteBatch, opts *WriteOptions) error
+	NewIterator(opts *IteratorOptions) (Iterator, error)
+	// Returns estimated number of live keys, see PropertyEstimateNumKeys
+	ApproximateKeyCount() int64
+	// Returns value of a database property, false if name isn't known
+	GetProperty(name string) (string, bool)
+	Flush() error
+	Close() error
+	CloseWithOptions(opts *CloseOptions) error
+	Stats() *Stats
+	// Returns what Open recovered from WAL files and what it dropped
+	RecoveryReport() *WALRecoveryReport
 }
 
 type SpaceDBImpl struct {
@@ -49,235 +130,1188 @@ type SpaceDBImpl struct {
 	rwLock          *sync.RWMutex
 	walManager      *wal.Manager
 	curMemTable     internal.MemTable
+	immMemTables    []*internal.SwitchRequest
+	bgCond          *sync.Cond
+	flushWorker     *internal.Worker
 	sstableMetadata [][]*internal.MetaBlock
-	curFileNum      int
+	versions        *internal.VersionSet
+	compactor       *internal.Compactor
+	tableCache      *internal.TableCache
+	compacting      bool
+	snapshots       *list.List
+	filterStats     internal.FilterStats
+	opts            *Options
+	logger          Logger
+	fileLock        *internal.FileLock
+	recoveryReport  *WALRecoveryReport
+	// Write calls waiting in order, the first one writes
+	writers    []*writer
+	syncingWAL bool
+	// closed to stop periodic WAL syncs, syncDone is closed when they stop
+	stopSync        chan struct{}
+	syncDone        chan struct{}
+	verifyChecksums bool
+	closed          bool
+	// first error of a background flush or compaction, writes and
+	// flushes fail with it and compactions aren't scheduled once it is set
+	bgErr error
 }
 
+// Opens the database at dbPath with default options.
+//
+// Deprecated: New exits the process if the database can't be opened, use Open
 func New(dbPath string) SpaceDB {
-	walManager := wal.NewManager(dbPath)
+	db, err := Open(dbPath, nil)
+	if err != nil {
+		log.Fatalf("error while opening database: %v", err)
+	}
+	return db
+}
+
+// Opens the database at dbPath, nil opts means DefaultOptions.
+// Records left in WAL files are written into level 0 tables, damaged
+// ones are handled by WALRecoveryMode and listed in RecoveryReport
+func Open(dbPath string, opts *Options) (SpaceDB, error) {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	exists, err := dbExists(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	if exists && opts.ErrorIfExists {
+		return nil, ErrDBExists
+	}
+	if !exists {
+		if !opts.CreateIfMissing {
+			return nil, ErrDBNotExist
+		}
+		err = os.MkdirAll(dbPath, 0774)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// held until Close, so no other process uses the files
+	lock, err := internal.LockFile(path.Join(dbPath, internal.LockFileName))
+	if err != nil {
+		return nil, err
+	}
+	db, err := openLocked(dbPath, opts)
+	if err != nil {
+		_ = lock.Release()
+		return nil, err
+	}
+	db.fileLock = lock
+	return db, nil
+}
+
+// Opens the database while its LOCK file is held
+func openLocked(dbPath string, opts *Options) (*SpaceDBImpl, error) {
+	walManager := wal.NewManager(dbPath, &wal.WalOptions{
+		Sync:        opts.WALSyncMode,
+		MaxFileSize: opts.MaxWALFileSize,
+	})
+	versions := internal.NewVersionSet(dbPath, opts.NumLevels)
+	versions.Logger = opts.Logger
 	db := &SpaceDBImpl{dbPath: dbPath,
 		rwLock:          &sync.RWMutex{},
 		walManager:      walManager,
 		curMemTable:     internal.NewMemTable(),
-		sstableMetadata: [][]*internal.MetaBlock{},
+		sstableMetadata: versions.Levels(),
+		versions:        versions,
+		snapshots:       list.New(),
+		opts:            opts,
+		logger:          opts.Logger,
+		verifyChecksums: !opts.SkipChecksumVerification,
+	}
+	// signalled when a flush or compaction finishes
+	db.bgCond = sync.NewCond(db.rwLock)
+	db.flushWorker = internal.NewWorker(dbPath, MaxImmutableMemTables, db.installFlush)
+	db.flushWorker.Compressor = internal.CompressorForLevel(opts.Compressors, 0)
+	db.flushWorker.BitsPerKey = opts.FilterBitsPerKey
+	db.flushWorker.Logger = opts.Logger
+	db.flushWorker.OnError = db.setBackgroundError
+	db.tableCache = internal.NewTableCache(dbPath, opts.MaxOpenFiles)
+	db.tableCache.VerifyChecksums = db.verifyChecksums
+	db.tableCache.BlockCache = internal.NewBlockCache(opts.CacheSize)
+	db.tableCache.CacheIndexAndFilter = opts.CacheIndexAndFilterBlocks
+	db.tableCache.PinIndexAndFilter = opts.PinIndexAndFilterBlocks
+	db.compactor = internal.NewCompactor(dbPath, db.newFileNum)
+	db.compactor.Compressors = opts.Compressors
+	db.compactor.BitsPerKey = opts.FilterBitsPerKey
+	db.compactor.IsExpired = func(value []byte) bool {
+		return isExpired(value, time.Now())
+	}
+	db.compactor.TombstoneValue = tombstoneValue
+	if opts.MergeOperator != nil {
+		db.compactor.Merger = storedMerger{op: opts.MergeOperator}
+	}
+
+	// read sstable metadata
+	err := db.recoverVersions()
+	if err != nil {
+		db.versions.Close()
+		return nil, fmt.Errorf("error while loading metadata: %w", err)
+	}
+	if len(db.sstableMetadata) > opts.NumLevels {
+		db.versions.Close()
+		return nil, fmt.Errorf("%w: database has %v levels", ErrInvalidOptions, len(db.sstableMetadata))
 	}
 
-	it, err := db.walManager.GetRecoverIterator()
+	db.recoveryReport = &WALRecoveryReport{Mode: opts.WALRecoveryMode}
+	err = db.recoverWAL()
+	if err != nil {
+		db.versions.Close()
+		return nil, fmt.Errorf("error while recovering from wal: %w", err)
+	}
+	db.removeObsoleteTables()
+	// new WAL files are numbered after the recovered ones
+	db.walManager.SetNextFileNum(int(db.versions.LogNumber))
+	err = db.walManager.Init()
 	if err != nil {
-		log.Fatalf("error while recovering from wal: %v", err)
+		db.versions.Close()
+		return nil, err
 	}
+	db.flushWorker.Start()
+
+	db.stopSync = make(chan struct{})
+	db.syncDone = make(chan struct{})
+	if opts.WALSyncMode == WALSyncInterval {
+		go db.syncWALPeriodically(opts.WALSyncInterval)
+	} else {
+		close(db.syncDone)
+	}
+
+	db.rwLock.Lock()
+	db.maybeScheduleCompaction()
+	db.rwLock.Unlock()
+
+	return db, nil
+}
 
-	db.walManager.Init()
+// Reports whether dbPath has a database, databases
+// created before MANIFEST existed only have tables
+func dbExists(dbPath string) (bool, error) {
+	entries, err := os.ReadDir(dbPath)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, e := range entries {
+		if e.Name() == "CURRENT" || e.Name() == "wal" || strings.HasSuffix(e.Name(), ".db") {
+			return true, nil
+		}
+	}
+	return false, nil
+}
 
-	// recover from wal
-	if it != nil {
-		for it.Next() {
-			logs := it.RecoverCurrentFile()
-			for _, l := range logs {
-				db.Set(l.Key, Deserialize(l.Value))
+// Rebuilds memtables from WAL files left by the previous run and writes
+// them into level 0 tables. WAL files are removed only after the tables
+// are recorded in MANIFEST with a log number past them, so recovery
+// can be repeated after a crash at any point. Files below the log number
+// of MANIFEST are already flushed and they are only removed
+func (g *SpaceDBImpl) recoverWAL() error {
+	it, err := g.walManager.GetRecoverIterator()
+	if err != nil || it == nil {
+		return err
+	}
+	it.Mode = g.opts.WALRecoveryMode
+	edit := &internal.VersionEdit{}
+	recovered := make([]string, 0)
+	flush := func() error {
+		if g.curMemTable.Empty() {
+			return nil
+		}
+		meta, err := g.flushWorker.WriteTable(g.curMemTable, g.versions.NewFileNum())
+		if err != nil {
+			return err
+		}
+		edit.AddFile(0, meta)
+		g.curMemTable = internal.NewMemTable()
+		return nil
+	}
+	for it.Next() {
+		recovered = append(recovered, it.CurrentFilePath())
+		if it.CurrentFileNum() < int(g.versions.LogNumber) {
+			continue
+		}
+		batches := it.RecoverCurrentFile()
+		if it.Err() != nil {
+			return it.Err()
+		}
+		for _, b := range batches {
+			if b.Seq == 0 {
+				// written before batches had sequence numbers
+				b.Seq = g.versions.LastSequence + 1
 			}
-			err := it.RemoveCurrentFile()
-			if err != nil {
-				log.Printf("error while removing wal file: %v\n", err)
+			g.applyBatch(b)
+			if g.curMemTable.RawSize() > g.opts.MemTableSize {
+				err = flush()
+				if err != nil {
+					return err
+				}
 			}
 		}
+		edit.LogNumber = uint64(it.CurrentFileNum() + 1)
+	}
+	err = flush()
+	if err == nil && (len(edit.NewFiles) > 0 || edit.LogNumber > g.versions.LogNumber) {
+		err = g.versions.LogAndApply(edit)
 	}
-
-	// read sstable metadata
-	err = db.loadSSTableMetaData()
 	if err != nil {
-		log.Printf("error while loading metadata: %v\n", err)
+		for _, f := range edit.NewFiles {
+			_ = os.Remove(path.Join(g.dbPath, f.Meta.FileName))
+		}
+		return err
 	}
+	g.sstableMetadata = g.versions.Levels()
 
-	return db
+	for _, p := range recovered {
+		err = os.Remove(p)
+		if err != nil {
+			g.logger.Printf("error while removing wal file: %v\n", err)
+		}
+	}
+	g.recoveryReport = it.Report()
+	for _, s := range g.recoveryReport.Skipped {
+		g.logger.Printf("wal records are dropped in %v at offset %v, %v bytes: %v\n", s.File, s.Offset, s.Length, s.Reason)
+	}
+	return nil
 }
 
-func (g *SpaceDBImpl) loadSSTableMetaData() error {
-	if _, err := os.Stat(g.dbPath); err != nil {
-		return err
+// Removes tables which aren't in MANIFEST, they are left by flushes,
+// compactions or recoveries which crashed before recording them
+func (g *SpaceDBImpl) removeObsoleteTables() {
+	live := make(map[string]bool)
+	for _, files := range g.sstableMetadata {
+		for _, f := range files {
+			live[f.FileName] = true
+		}
 	}
-	files, err := os.ReadDir(g.dbPath)
+	entries, err := os.ReadDir(g.dbPath)
+	if err != nil {
+		g.logger.Printf("%v\n", err)
+		return
+	}
+	for _, e := range entries {
+		var level int
+		var num uint64
+		_, err := fmt.Sscanf(e.Name(), "%d_%d.db", &level, &num)
+		if err != nil || e.Name() != internal.TableFileName(level, num) || live[e.Name()] {
+			continue
+		}
+		g.removeFile(path.Join(g.dbPath, e.Name()))
+	}
+}
+
+// Rebuilds sstable metadata from MANIFEST and starts a new MANIFEST.
+// Databases without a MANIFEST are imported from their sstable file names
+func (g *SpaceDBImpl) recoverVersions() error {
+	found, err := g.versions.Recover()
 	if err != nil {
 		return err
 	}
 
-	for i := 0; i < 10; i++ {
-		levelPrefix := fmt.Sprintf("%v_", i)
-		levelFiles := []os.DirEntry{}
-		for _, f := range files {
-			if strings.HasSuffix(f.Name(), ".db") && strings.HasPrefix(f.Name(), levelPrefix) {
-				levelFiles = append(levelFiles, f)
+	edit := &internal.VersionEdit{}
+	legacyFiles := make([]string, 0)
+	if !found {
+		err = g.loadSSTableMetaData()
+		if err != nil {
+			return err
+		}
+		edit, err = g.upgradeLegacyTables()
+		if err != nil {
+			return err
+		}
+		for _, files := range g.sstableMetadata {
+			for _, f := range files {
+				legacyFiles = append(legacyFiles, f.FileName)
 			}
 		}
+	}
 
-		sort.Slice(levelFiles, func(a, b int) bool {
-			fA := levelFiles[a].Name()
-			fB := levelFiles[b].Name()
-			if !strings.HasSuffix(fA, ".db") || !strings.HasSuffix(fB, ".db") {
-				return false
-			}
+	err = g.versions.LogAndApply(edit)
+	if err != nil {
+		return err
+	}
+	g.sstableMetadata = g.versions.Levels()
+	for _, name := range legacyFiles {
+		g.removeFile(path.Join(g.dbPath, name))
+	}
+	return nil
+}
 
-			fA = strings.TrimSuffix(fA, ".db")
-			fA = strings.TrimPrefix(fA, levelPrefix)
-			fB = strings.TrimSuffix(fB, ".db")
-			fB = strings.TrimPrefix(fB, levelPrefix)
+// Rewrites tables which are created before sequence numbers existed.
+// Keys are stored as internal keys and older tables get smaller sequence
+// numbers, so newer versions still shadow older ones.
+// Returns the edit which records rewritten tables
+func (g *SpaceDBImpl) upgradeLegacyTables() (*internal.VersionEdit, error) {
+	for _, files := range g.sstableMetadata {
+		for _, f := range files {
+			g.versions.MarkFileNumUsed(f.FileNum)
+		}
+	}
 
-			f1, err := strconv.ParseInt(fA, 10, 64)
-			if err != nil {
-				log.Println(err)
-				return false
+	edit := &internal.VersionEdit{}
+	seq := g.versions.LastSequence
+	for level := len(g.sstableMetadata) - 1; level >= 0; level-- {
+		for _, f := range g.sstableMetadata[level] {
+			seq++
+			meta, err := g.rewriteLegacyTable(level, f, seq)
+			if err == internal.ErrEmptyTable {
+				continue
 			}
-			f2, err := strconv.ParseInt(fB, 10, 64)
 			if err != nil {
-				log.Println(err)
-				return false
+				return nil, err
 			}
-			return f1 < f2
-		})
+			edit.AddFile(level, meta)
+		}
+	}
+	edit.LastSequence = seq
+	return edit, nil
+}
 
-		g.sstableMetadata = append(g.sstableMetadata, []*internal.MetaBlock{})
+func (g *SpaceDBImpl) rewriteLegacyTable(level int, f *internal.MetaBlock, seq uint64) (*internal.MetaBlock, error) {
+	table := internal.NewSSTable(g.dbPath, f.FileName)
+	defer table.CloseFile()
+	it, err := table.Iterator()
+	if err != nil {
+		return nil, err
+	}
 
-		for _, f := range levelFiles {
-			if !f.IsDir() && strings.HasSuffix(f.Name(), ".db") {
-				table := internal.NewSSTable(g.dbPath, f.Name())
-				err := table.ReadMeta()
-				if err != nil {
-					return err
-				}
-				g.sstableMetadata[i] = append(g.sstableMetadata[i], &internal.MetaBlock{
-					FileName: f.Name(),
-					MinKey:   table.MinKey,
-					MaxKey:   table.MaxKey,
-					KeyCount: table.KeyCount,
-				})
-			}
+	fileNum := g.versions.NewFileNum()
+	w, err := internal.NewSSTableWriter(g.dbPath, internal.TableFileName(level, fileNum))
+	if err != nil {
+		return nil, err
+	}
+	w.Compressor = internal.CompressorForLevel(g.opts.Compressors, level)
+	w.BitsPerKey = g.opts.FilterBitsPerKey
+	for it.Next() {
+		err = w.Add(internal.MakeInternalKey(it.Key(), seq, valueKind(it.Value())), it.Value())
+		if err != nil {
+			w.Abandon()
+			return nil, err
+		}
+	}
+	if it.Err() != nil {
+		w.Abandon()
+		return nil, it.Err()
+	}
+	meta, err := w.Finish()
+	if err != nil {
+		w.Abandon()
+		return nil, err
+	}
+	meta.FileNum = fileNum
+	return meta, nil
+}
+
+// Builds sstable metadata from "level_number.db" file names.
+// It is only used for databases created before MANIFEST existed
+func (g *SpaceDBImpl) loadSSTableMetaData() error {
+	if _, err := os.Stat(g.dbPath); err != nil {
+		return err
+	}
+	files, err := os.ReadDir(g.dbPath)
+	if err != nil {
+		return err
+	}
+
+	edit := &internal.VersionEdit{}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".db") {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimSuffix(f.Name(), ".db"), "_", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		level, err := strconv.Atoi(parts[0])
+		if err != nil {
+			g.logger.Printf("%v\n", err)
+			continue
+		}
+		fileNum, err := strconv.ParseUint(parts[1], 10, 64)
+		if err != nil {
+			g.logger.Printf("%v\n", err)
+			continue
+		}
+
+		info, err := f.Info()
+		if err != nil {
+			return err
+		}
+		table := internal.NewSSTable(g.dbPath, f.Name())
+		err = table.ReadMeta()
+		table.CloseFile()
+		if err != nil {
+			return err
 		}
+		edit.AddFile(level, &internal.MetaBlock{
+			FileName:      f.Name(),
+			FileNum:       fileNum,
+			MinKey:        table.MinKey,
+			MaxKey:        table.MaxKey,
+			KeyCount:      table.KeyCount,
+			DeletionCount: table.DeletionCount,
+			FileSize:      info.Size(),
+		})
+	}
 
+	levels := make([][]*internal.MetaBlock, g.opts.NumLevels)
+	for i := range levels {
+		levels[i] = []*internal.MetaBlock{}
 	}
+	g.sstableMetadata = edit.Apply(levels)
 
 	return nil
 }
 
 func (g *SpaceDBImpl) Set(key []byte, value *DBValue) error {
+	batch := NewWriteBatch()
+	batch.set(key, value.Serialize())
+	return g.Write(batch)
+}
+
+func (g *SpaceDBImpl) SetWithTTL(key []byte, value *DBValue, ttl time.Duration) error {
+	if ttl <= 0 {
+		return ErrInvalidTTL
+	}
+	batch := NewWriteBatch()
+	batch.PutWithTTL(key, value.Value, ttl)
+	return g.Write(batch)
+}
+
+func (g *SpaceDBImpl) TTL(key []byte) (time.Duration, error) {
+	v, err := g.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	if v.ExpiresAt.IsZero() {
+		return NoExpiry, nil
+	}
+	// value may expire after the lookup
+	ttl := time.Until(v.ExpiresAt)
+	if ttl <= 0 {
+		return 0, ErrNotFound
+	}
+	return ttl, nil
+}
+
+func (g *SpaceDBImpl) Write(batch *WriteBatch) error {
+	return g.WriteWithOptions(batch, nil)
+}
+
+// Applies all updates of the batch atomically. Writers wait in a queue,
+// the one at the front writes batches of the writers behind it too,
+// so they share a single WAL sync. nil opts means default options
+func (g *SpaceDBImpl) WriteWithOptions(batch *WriteBatch, opts *WriteOptions) error {
 	g.rwLock.Lock()
 	defer g.rwLock.Unlock()
+	if g.closed {
+		return ErrClosed
+	}
+	if batch.Count() == 0 {
+		return nil
+	}
+	if batch.merges > 0 && g.opts.MergeOperator == nil {
+		return ErrNoMergeOperator
+	}
+	return g.write(&writer{batch: batch, sync: opts != nil && opts.Sync})
+}
 
-	err := g.walManager.Add(&wal.Log{
-		Key:   key,
-		Value: value.Serialize(),
+// Reads the current value of key and writes the new one in a
+// single batch, no other write can run in between
+func (g *SpaceDBImpl) Update(key []byte, fn func(old *DBValue) (*DBValue, error)) error {
+	g.rwLock.Lock()
+	defer g.rwLock.Unlock()
+	if g.closed {
+		return ErrClosed
+	}
+	prepare := func() (*WriteBatch, error) {
+		old, err := g.get(key, g.versions.LastSequence)
+		if err == ErrNotFound {
+			old = nil
+		} else if err != nil {
+			return nil, err
+		}
+		value, err := fn(old)
+		if err != nil {
+			return nil, err
+		}
+		batch := NewWriteBatch()
+		if value == nil {
+			batch.Delete(key)
+		} else {
+			batch.set(key, value.Serialize())
+		}
+		return batch, nil
+	}
+	return g.write(&writer{prepare: prepare})
+}
+
+func (g *SpaceDBImpl) CompareAndSet(key, expected []byte, value *DBValue) error {
+	return g.Update(key, func(old *DBValue) (*DBValue, error) {
+		if old == nil {
+			return nil, ErrNotFound
+		}
+		if !bytes.Equal(old.Value, expected) {
+			return nil, ErrValueMismatch
+		}
+		return value, nil
+	})
+}
+
+func (g *SpaceDBImpl) Merge(key, operand []byte) error {
+	batch := NewWriteBatch()
+	batch.Merge(key, operand)
+	return g.Write(batch)
+}
+
+func (g *SpaceDBImpl) SetIfAbsent(key []byte, value *DBValue) error {
+	return g.Update(key, func(old *DBValue) (*DBValue, error) {
+		if old != nil {
+			return nil, ErrKeyExists
+		}
+		return value, nil
 	})
+}
+
+// Queues the writer and waits until its batch is written by itself
+// or by another leader. rwLock must be held
+func (g *SpaceDBImpl) write(w *writer) error {
+	w.cond = sync.NewCond(g.rwLock)
+	g.writers = append(g.writers, w)
+	for !w.done && g.writers[0] != w {
+		w.cond.Wait()
+	}
+	if w.done {
+		return w.err
+	}
+
+	group, err := g.writeGroup()
+	for _, f := range group {
+		f.err = err
+		f.done = true
+		f.cond.Signal()
+	}
+	g.writers = g.writers[len(group):]
+	if len(g.writers) > 0 {
+		g.writers[0].cond.Signal()
+	}
+	return err
+}
+
+// Writes the batch of the writer at the front of the queue and batches
+// of the writers which can join it. Returns writers whose batches are
+// handled. rwLock must be held, it is released while waiting
+func (g *SpaceDBImpl) writeGroup() ([]*writer, error) {
+	leader := g.writers[0]
+	group := g.writers[:1]
+	if g.closed {
+		return group, ErrClosed
+	}
+	err := g.makeRoomForWrite()
 	if err != nil {
-		log.Println(err)
-		return err
+		return group, err
+	}
+	// database may be closed while waiting for room
+	if g.closed {
+		return group, ErrClosed
+	}
+	if leader.prepare != nil {
+		leader.batch, err = leader.prepare()
+		if err != nil {
+			return group, err
+		}
 	}
 
-	g.curMemTable.Set(key, value.Serialize())
+	logs := leader.batch.logs()
+	batches := []*wal.Batch{{Logs: logs}}
+	size := logsSize(logs)
+	sync := leader.sync || g.opts.WALSyncMode == WALSyncGroupCommit
+	for _, w := range g.writers[1:] {
+		// batches of conditional writers depend on
+		// the batches before them, they lead their own group
+		if w.prepare != nil || size >= maxGroupSize || (w.sync && !sync) {
+			break
+		}
+		logs := w.batch.logs()
+		batches = append(batches, &wal.Batch{Logs: logs})
+		group = g.writers[:len(group)+1]
+		size += logsSize(logs)
+	}
+	return group, g.writeBatches(batches, sync)
+}
 
-	if g.curMemTable.RawSize() > MaxMemTableSize {
-		g.switchMemTable()
+// Writes each batch into WAL as a single record, syncs WAL if sync
+// is set and applies batches to the memtable. Batches which are
+// written are applied even if a later step fails, so their sequence
+// numbers aren't reused. rwLock must be held
+func (g *SpaceDBImpl) writeBatches(batches []*wal.Batch, sync bool) error {
+	g.waitForWALSync()
+	seq := g.versions.LastSequence + 1
+	written := 0
+	var err error
+	for _, b := range batches {
+		b.Seq = seq
+		if len(b.Logs) > 0 {
+			err = g.walManager.AddBatch(b)
+			if err != nil {
+				break
+			}
+		}
+		seq += uint64(len(b.Logs))
+		written++
+	}
+	if err == nil && sync {
+		err = g.syncWAL()
 	}
+	for _, b := range batches[:written] {
+		g.applyBatch(b)
+	}
+	return err
+}
 
+// Writes the batch into WAL as a single record and applies it to the
+// memtable. Sequence numbers are assigned if the batch doesn't have them.
+// rwLock must be held
+func (g *SpaceDBImpl) writeBatch(b *wal.Batch) error {
+	if len(b.Logs) == 0 {
+		return nil
+	}
+	if b.Seq == 0 {
+		b.Seq = g.versions.LastSequence + 1
+	}
+	g.waitForWALSync()
+	err := g.walManager.AddBatch(b)
+	if err != nil {
+		return err
+	}
+	g.applyBatch(b)
 	return nil
 }
 
-func (g *SpaceDBImpl) Get(key []byte) *DBValue {
+// Sets logs of the batch into the memtable. rwLock must be held
+func (g *SpaceDBImpl) applyBatch(b *wal.Batch) {
+	if len(b.Logs) == 0 {
+		return
+	}
+	for i, l := range b.Logs {
+		seq := b.Seq + uint64(i)
+		if len(l.Value) > 0 && l.Value[0] == flagRangeTombstone {
+			g.curMemTable.AddRangeTombstone(internal.RangeTombstone{Start: l.Key, End: l.Value[1:], Seq: seq})
+			continue
+		}
+		g.curMemTable.Set(internal.MakeInternalKey(l.Key, seq, valueKind(l.Value)), l.Value)
+	}
+	if last := b.Seq + uint64(len(b.Logs)) - 1; last > g.versions.LastSequence {
+		g.versions.LastSequence = last
+	}
+}
+
+// Syncs the current WAL file. rwLock is released during the sync,
+// so writers can queue up and reads aren't blocked. rwLock must be held
+func (g *SpaceDBImpl) syncWAL() error {
+	g.waitForWALSync()
+	g.syncingWAL = true
+	g.rwLock.Unlock()
+	err := g.walManager.Sync()
+	g.rwLock.Lock()
+	g.syncingWAL = false
+	g.bgCond.Broadcast()
+	return err
+}
+
+// Waits until the WAL sync in progress is done, WAL must not be
+// changed during a sync. rwLock must be held
+func (g *SpaceDBImpl) waitForWALSync() {
+	for g.syncingWAL {
+		g.bgCond.Wait()
+	}
+}
+
+// Syncs WAL every interval until the database is closed
+func (g *SpaceDBImpl) syncWALPeriodically(interval time.Duration) {
+	defer close(g.syncDone)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-g.stopSync:
+			return
+		case <-ticker.C:
+			g.rwLock.Lock()
+			if !g.closed {
+				err := g.syncWAL()
+				if err != nil {
+					g.logger.Printf("error while syncing wal: %v\n", err)
+				}
+			}
+			g.rwLock.Unlock()
+		}
+	}
+}
+
+// writer is a Write call waiting in the write queue
+type writer struct {
+	batch *WriteBatch
+	// returns the batch of a conditional write, it is called by the
+	// writer once it leads, so it sees all writes before it
+	prepare func() (*WriteBatch, error)
+	sync    bool
+	done    bool
+	err     error
+	cond    *sync.Cond
+}
+
+// Writers behind the leader join its group until logs of the group reach this size
+const maxGroupSize = 1024 * 1024
+
+func logsSize(logs []*wal.Log) int {
+	size := 0
+	for _, l := range logs {
+		size += len(l.Key) + len(l.Value)
+	}
+	return size
+}
+
+// Returns kind of a serialized DBValue
+func valueKind(value []byte) internal.ValueKind {
+	if len(value) > 0 && value[0] == flagTombstone {
+		return internal.KindDelete
+	}
+	if len(value) > 0 && value[0] == flagMergeOperand {
+		return internal.KindMerge
+	}
+	return internal.KindSet
+}
+
+// Returns the value which is found by a lookup,
+// ErrNotFound if it is a tombstone or expired at now
+func foundValue(value []byte, now time.Time) (*DBValue, error) {
+	if valueKind(value) == internal.KindDelete || isExpired(value, now) {
+		return nil, ErrNotFound
+	}
+	return Deserialize(value), nil
+}
+
+func (g *SpaceDBImpl) Get(key []byte) (*DBValue, error) {
+	return g.GetAt(key, nil)
+}
+
+func (g *SpaceDBImpl) GetAt(key []byte, snapshot *Snapshot) (*DBValue, error) {
 	g.rwLock.RLock()
 	defer g.rwLock.RUnlock()
-	val := g.curMemTable.Get(key)
-	if val != nil {
-		return Deserialize(val)
+	if g.closed {
+		return nil, ErrClosed
+	}
+	seq := g.versions.LastSequence
+	if snapshot != nil {
+		seq = snapshot.seq
+	}
+	return g.get(key, seq)
+}
+
+// Returns the newest version of key which is visible at seq.
+// rwLock must be held
+func (g *SpaceDBImpl) get(key []byte, seq uint64) (*DBValue, error) {
+	lookup := internal.SeekKey(key, seq)
+
+	// largest sequence number of range tombstones which cover key in
+	// the sources searched so far, older versions of key are deleted
+	var coverSeq uint64
+	cover := func(tombstones *internal.RangeTombstones) {
+		if s := tombstones.MaxCoveringSeq(key, seq); s > coverSeq {
+			coverSeq = s
+		}
+	}
+	found := func(val []byte, valSeq uint64) (*DBValue, error) {
+		if valSeq < coverSeq {
+			return nil, ErrNotFound
+		}
+		if valueKind(val) == internal.KindMerge {
+			return g.getMerged(key, seq)
+		}
+		return foundValue(val, time.Now())
+	}
+
+	// current memtable and memtables waiting for flush, newest first
+	mems := []internal.MemTable{g.curMemTable}
+	for i := len(g.immMemTables) - 1; i >= 0; i-- {
+		mems = append(mems, g.immMemTables[i].MemTable)
+	}
+	for _, mem := range mems {
+		cover(mem.RangeTombstones())
+		val, valSeq, ok, err := internal.Lookup(mem.SeekIterator(), lookup)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return found(val, valSeq)
+		}
 	}
 
 	// can't find in memtable, find in sstables
 	for _, meta := range g.sstableMetadata {
 		for i := len(meta) - 1; i >= 0; i-- {
 			m := meta[i]
-
-			// log.Printf("searching in %v min: %v max: %v\n", m.FileName, string(*m.MinKey), string(*m.MaxKey))
-			if bytes.Compare(key, *m.MinKey) >= 0 && bytes.Compare(key, *m.MaxKey) <= 0 {
-				table := internal.NewSSTable(g.dbPath, m.FileName)
-				defer table.CloseFile()
-				pos, err := table.FindKeyInIndex(key)
-				if err == internal.ErrIndexNotFound {
-					continue
-				}
-				val, err := table.ReadValueAt(pos)
-				if err != nil {
-					log.Println(err)
-					return nil
-				}
-				return Deserialize(val)
+			if internal.CompareUserKeys(lookup, *m.MinKey) < 0 || internal.CompareUserKeys(lookup, *m.MaxKey) > 0 {
+				continue
+			}
+			table, err := g.openTable(m)
+			if err != nil {
+				return nil, err
+			}
+			tombstones, err := table.RangeTombstones()
+			if err != nil {
+				table.CloseFile()
+				return nil, err
+			}
+			cover(tombstones)
+			val, valSeq, ok, err := table.Get(lookup, &g.filterStats)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				return found(val, valSeq)
 			}
 		}
+	}
+
+	return nil, ErrNotFound
+}
 
+// Returns the value of key which is made by merging its newest merge
+// operands with older versions. Versions are read through an iterator
+// over the key. rwLock must be held
+func (g *SpaceDBImpl) getMerged(key []byte, seq uint64) (*DBValue, error) {
+	it, err := g.newIterator(&IteratorOptions{
+		LowerBound: key,
+		UpperBound: append(cloneBytes(key), 0),
+		Snapshot:   &Snapshot{seq: seq},
+	})
+	if err != nil {
+		return nil, err
 	}
+	defer it.Close()
+	if !it.SeekToFirst() {
+		if it.Err() != nil {
+			return nil, it.Err()
+		}
+		return nil, ErrNotFound
+	}
+	return &DBValue{Value: it.Value()}, nil
+}
 
-	return nil
+// Returns a table of m from the table cache, it must be closed after use
+func (g *SpaceDBImpl) openTable(m *internal.MetaBlock) (*internal.SSTable, error) {
+	return g.tableCache.Get(m)
 }
 
 func (g *SpaceDBImpl) Delete(key []byte) error {
+	batch := NewWriteBatch()
+	batch.Delete(key)
+	return g.Write(batch)
+}
+
+func (g *SpaceDBImpl) DeleteRange(start, end []byte) error {
+	batch := NewWriteBatch()
+	batch.DeleteRange(start, end)
+	return g.Write(batch)
+}
+
+func (g *SpaceDBImpl) RecoveryReport() *WALRecoveryReport {
+	return g.recoveryReport
+}
+
+// Estimates the number of live keys from the entry and tombstone counts
+// of memtables and sstables. Each tombstone is assumed to hide one older
+// entry, overwritten keys which aren't compacted yet are counted twice
+func (g *SpaceDBImpl) ApproximateKeyCount() int64 {
+	g.rwLock.RLock()
+	defer g.rwLock.RUnlock()
+	if g.closed {
+		return 0
+	}
+	count := g.curMemTable.KeyCount() - 2*g.curMemTable.DeletionCount()
+	for _, imm := range g.immMemTables {
+		count += imm.MemTable.KeyCount() - 2*imm.MemTable.DeletionCount()
+	}
+	for _, meta := range g.sstableMetadata {
+		for _, m := range meta {
+			count += m.KeyCount - 2*m.DeletionCount
+		}
+	}
+	if count < 0 {
+		return 0
+	}
+	return count
+}
+
+// Writes current memtable into a level 0 table
+// and waits until it is recorded in MANIFEST
+func (g *SpaceDBImpl) Flush() error {
 	g.rwLock.Lock()
 	defer g.rwLock.Unlock()
+	if g.closed {
+		return ErrClosed
+	}
+	return g.flushMemTable()
+}
 
-	delVal := &DBValue{IsDeleted: true}
-
-	err := g.walManager.Add(&wal.Log{
-		Key:   key,
-		Value: delVal.Serialize(),
-	})
+// rwLock must be held
+func (g *SpaceDBImpl) flushMemTable() error {
+	err := g.waitForFlushes()
+	if err != nil {
+		return err
+	}
+	err = g.switchMemTable()
 	if err != nil {
-		log.Println(err)
 		return err
 	}
+	return g.waitForFlushes()
+}
 
-	g.curMemTable.Set(key, delVal.Serialize())
+func (g *SpaceDBImpl) Close() error {
+	return g.CloseWithOptions(nil)
+}
 
-	return nil
+// Closes the database gracefully. Memtable is flushed unless opts.SkipFlush
+// is set, running compaction is waited, WAL and MANIFEST files are synced
+// and closed. Returns the first error of these steps or of background work,
+// the database isn't closed durably if it is set. The flush worker is stopped
+// without waiting for failed flushes. After Close, calls on the database return ErrClosed
+func (g *SpaceDBImpl) CloseWithOptions(opts *CloseOptions) error {
+	flush := opts == nil || !opts.SkipFlush
+	g.rwLock.Lock()
+	if g.closed {
+		g.rwLock.Unlock()
+		return ErrClosed
+	}
+	g.closed = true
+
+	// first error of the shutdown, it isn't durable if it is set
+	var err error
+	if flush {
+		// memtable is kept in its WAL file if the flush fails
+		err = g.flushMemTable()
+	}
+	for g.compacting {
+		g.bgCond.Wait()
+	}
+	close(g.stopSync)
+	g.rwLock.Unlock()
+
+	// queued memtables which are not flushed are kept in their WAL files
+	g.flushWorker.Stop()
+	<-g.syncDone
+
+	g.rwLock.Lock()
+	defer g.rwLock.Unlock()
+	g.waitForWALSync()
+	walPath := g.walManager.CurrentFilePath()
+	// WAL is synced whatever the sync mode is
+	walErr := g.walManager.Close()
+	if walErr == nil && flush && g.curMemTable.Empty() && len(g.immMemTables) == 0 {
+		// everything is in sstables, nothing to replay on next open
+		g.removeFile(walPath)
+	}
+	if err == nil {
+		err = walErr
+	}
+	if vErr := g.versions.Close(); err == nil {
+		err = vErr
+	}
+	g.tableCache.Close()
+	if lockErr := g.fileLock.Release(); err == nil {
+		err = lockErr
+	}
+	return err
 }
 
-func (g *SpaceDBImpl) KeyCount() int64 {
-	count := g.curMemTable.KeyCount()
-	for _, meta := range g.sstableMetadata {
-		for _, m := range meta {
-			count += m.KeyCount
+// Switches the memtable if it is full or WAL files are too large.
+// If too many memtables are waiting for flush, waits until one of
+// them is flushed. Returns the background error if it is set. rwLock must be held
+func (g *SpaceDBImpl) makeRoomForWrite() error {
+	for g.bgErr == nil && (g.curMemTable.RawSize() > g.opts.MemTableSize || g.walFull()) {
+		if len(g.immMemTables) < MaxImmutableMemTables {
+			return g.switchMemTable()
 		}
+		g.bgCond.Wait()
 	}
-	return count
+	return g.bgErr
 }
 
-func (g *SpaceDBImpl) Close() {
-	panic("implement me")
+// Reports whether WAL files which are not deleted yet are larger than
+// MaxTotalWALSize. Switching the memtable lets its logs be deleted once
+// it is flushed, writes stall if too many memtables are waiting.
+// rwLock must be held
+func (g *SpaceDBImpl) walFull() bool {
+	if g.curMemTable.Empty() {
+		return false
+	}
+	size := g.walManager.SizeSinceSwitch()
+	for _, imm := range g.immMemTables {
+		size += imm.WalSize
+	}
+	return size > g.opts.MaxTotalWALSize
 }
 
-func (g *SpaceDBImpl) switchMemTable() {
-	fileName := fmt.Sprintf("0_%v.db", g.curFileNum)
-	table := internal.NewSSTable(g.dbPath, fileName)
-	err := table.Save(g.curMemTable)
+// Makes current memtable immutable and queues it for flush.
+// A new WAL file is started for the new memtable. rwLock must be held
+func (g *SpaceDBImpl) switchMemTable() error {
+	if g.curMemTable.Empty() {
+		return nil
+	}
+	g.waitForWALSync()
+	walSize := g.walManager.SizeSinceSwitch()
+	walPaths, err := g.walManager.SwitchFile()
 	if err != nil {
-		log.Println(err)
+		return err
+	}
+	req := &internal.SwitchRequest{
+		MemTable:  g.curMemTable,
+		WalPaths:  walPaths,
+		WalSize:   walSize,
+		LogNumber: g.walManager.CurrentFileNum(),
+		FileNum:   g.versions.NewFileNum(),
+	}
+	g.immMemTables = append(g.immMemTables, req)
+	g.curMemTable = internal.NewMemTable()
+	g.flushWorker.Add(req)
+	return nil
+}
+
+// Called by flush worker after the level 0 table of the oldest
+// immutable memtable is written. Records the table in MANIFEST
+// and drops the memtable
+func (g *SpaceDBImpl) installFlush(req *internal.SwitchRequest, meta *internal.MetaBlock) error {
+	g.rwLock.Lock()
+	defer g.rwLock.Unlock()
+
+	edit := &internal.VersionEdit{LogNumber: uint64(req.LogNumber)}
+	edit.AddFile(0, meta)
+	err := g.versions.LogAndApply(edit)
+	if err != nil {
+		return err
+	}
+	g.sstableMetadata = g.versions.Levels()
+	if len(g.immMemTables) > 0 && g.immMemTables[0] == req {
+		g.immMemTables = g.immMemTables[1:]
+	}
+	g.bgCond.Broadcast()
+	g.maybeScheduleCompaction()
+	return nil
+}
+
+// Waits until all immutable memtables are flushed. Returns the
+// background error if it is set before that. rwLock must be held
+func (g *SpaceDBImpl) waitForFlushes() error {
+	for len(g.immMemTables) > 0 && g.bgErr == nil {
+		g.bgCond.Wait()
+	}
+	return g.bgErr
+}
+
+// Records the first error of background work and wakes up waiters
+func (g *SpaceDBImpl) setBackgroundError(err error) {
+	g.rwLock.Lock()
+	defer g.rwLock.Unlock()
+	if g.bgErr == nil {
+		g.bgErr = err
+	}
+	g.bgCond.Broadcast()
+}
+
+// Allocates a new file number.
+// It must be called without holding rwLock
+func (g *SpaceDBImpl) newFileNum() uint64 {
+	g.rwLock.Lock()
+	defer g.rwLock.Unlock()
+	return g.versions.NewFileNum()
+}
+
+// Starts a background compaction if any level needs it
+// and no compaction is running. rwLock must be held
+func (g *SpaceDBImpl) maybeScheduleCompaction() {
+	if g.compacting || g.closed || g.compactor == nil || g.bgErr != nil {
 		return
 	}
+	c := g.compactor.PickCompaction(g.sstableMetadata)
+	if c == nil {
+		return
+	}
+	c.SmallestSnapshot = g.smallestSnapshot()
+	g.compacting = true
+	go g.backgroundCompaction(c)
+}
 
-	g.sstableMetadata[0] = append(g.sstableMetadata[0], &internal.MetaBlock{
-		FileName: fileName,
-		MinKey:   table.MinKey,
-		MaxKey:   table.MaxKey,
-		KeyCount: table.KeyCount,
-	})
-	oldWalName := g.walManager.SwitchFile()
-	g.clearWAL(oldWalName)
-	nMemTable := internal.NewMemTable()
-	g.curMemTable = nMemTable
-	g.curFileNum++
+// Runs given compaction and keeps compacting until no level needs it.
+// Outputs are logged into MANIFEST and installed under rwLock in one step,
+// input files are removed afterwards. A failed compaction sets the
+// background error, so it isn't scheduled again
+func (g *SpaceDBImpl) backgroundCompaction(c *internal.Compaction) {
+	defer func() {
+		g.rwLock.Lock()
+		g.compacting = false
+		g.bgCond.Broadcast()
+		g.maybeScheduleCompaction()
+		g.rwLock.Unlock()
+	}()
+
+	for c != nil {
+		outputs, err := g.compactor.Run(c)
+		if err != nil {
+			g.logger.Printf("error while compacting level %v: %v\n", c.Level, err)
+			g.setBackgroundError(err)
+			return
+		}
+
+		g.rwLock.Lock()
+		err = g.versions.LogAndApply(c.Edit(outputs))
+		if err != nil {
+			if g.bgErr == nil {
+				g.bgErr = err
+			}
+			g.rwLock.Unlock()
+			g.logger.Printf("error while installing compaction of level %v: %v\n", c.Level, err)
+			for _, o := range outputs {
+				g.removeFile(path.Join(g.dbPath, o.FileName))
+			}
+			return
+		}
+		g.sstableMetadata = g.versions.Levels()
+		done := c
+		c = nil
+		if !g.closed {
+			c = g.compactor.PickCompaction(g.sstableMetadata)
+		}
+		if c != nil {
+			c.SmallestSnapshot = g.smallestSnapshot()
+		}
+		g.rwLock.Unlock()
+
+		for _, files := range done.Inputs {
+			for _, f := range files {
+				g.tableCache.Evict(f.FileNum)
+				g.removeFile(path.Join(g.dbPath, f.FileName))
+			}
+		}
+	}
 }
 
-func (g *SpaceDBImpl) clearWAL(path string) {
+func (g *SpaceDBImpl) removeFile(path string) {
 	_, err := os.Stat(path)
 	if os.IsNotExist(err) {
 		return
 	}
 	err = os.Remove(path)
 	if err != nil {
-		log.Println(err)
+		g.logger.Printf("%v\n", err)
 	}
 }
@@ -1,12 +1,18 @@
 package spacedb
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/emin/spacedb/internal"
 	"github.com/emin/spacedb/internal/wal"
@@ -17,6 +23,19 @@ func testPath() string {
 	return path.Join(os.TempDir(), "db-path")
 }
 
+// Returns value of key, the key must exist
+func getValue(t *testing.T, db SpaceDB, key []byte) []byte {
+	return getValueAt(t, db, key, nil)
+}
+
+func getValueAt(t *testing.T, db SpaceDB, key []byte, snapshot *Snapshot) []byte {
+	v, err := db.GetAt(key, snapshot)
+	if !assert.Nil(t, err) {
+		return nil
+	}
+	return v.Value
+}
+
 func beforeTest() {
 	if info, err := os.Stat(testPath()); err == nil && info.IsDir() {
 		os.RemoveAll(testPath())
@@ -38,12 +57,13 @@ func Test_loadSSTableMetaData(t *testing.T) {
 	beforeTest()
 	defer afterTest()
 	dbPath := testPath()
-	walManager := wal.NewManager(dbPath)
+	walManager := wal.NewManager(dbPath, nil)
 	db := &SpaceDBImpl{dbPath: dbPath,
 		rwLock:          &sync.RWMutex{},
 		walManager:      walManager,
 		curMemTable:     internal.NewMemTable(),
 		sstableMetadata: [][]*internal.MetaBlock{},
+		opts:            DefaultOptions(),
 	}
 
 	db.curMemTable.Set([]byte("1"), []byte("value1"))
@@ -68,14 +88,691 @@ func BenchmarkSet(b *testing.B) {
 	beforeTest()
 	defer afterTest()
 	db := New(testPath())
+	defer db.Close()
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		k := fmt.Sprintf("k%v", i)
 		v := fmt.Sprintf("value = %v", i)
 		db.Set([]byte(k), &DBValue{
-			IsDeleted: false,
-			Value:     []byte(v),
+			Value: []byte(v),
 		})
 	}
 }
+
+func TestNew_FileNumbersSurviveRestart(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	db := New(testPath()).(*SpaceDBImpl)
+	db.Set([]byte("k1"), &DBValue{Value: []byte("v1")})
+	db.rwLock.Lock()
+	db.switchMemTable()
+	assert.Nil(t, db.waitForFlushes())
+	db.rwLock.Unlock()
+	assert.Nil(t, db.CloseWithOptions(&CloseOptions{SkipFlush: true}))
+
+	db = New(testPath()).(*SpaceDBImpl)
+	assert.Equal(t, 1, len(db.sstableMetadata[0]))
+	db.Set([]byte("k2"), &DBValue{Value: []byte("v2")})
+	db.rwLock.Lock()
+	db.switchMemTable()
+	assert.Nil(t, db.waitForFlushes())
+	db.rwLock.Unlock()
+
+	assert.Equal(t, 2, len(db.sstableMetadata[0]))
+	assert.NotEqual(t, db.sstableMetadata[0][0].FileName, db.sstableMetadata[0][1].FileName)
+	assert.Equal(t, []byte("v1"), getValue(t, db, []byte("k1")))
+	assert.Equal(t, []byte("v2"), getValue(t, db, []byte("k2")))
+	assert.Nil(t, db.Close())
+}
+
+func TestSpaceDBImpl_BackgroundFlush(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	db := New(testPath()).(*SpaceDBImpl)
+	for i := 0; i < 100; i++ {
+		db.Set([]byte(fmt.Sprintf("k%v", i)), &DBValue{Value: []byte(fmt.Sprintf("v%v", i))})
+	}
+
+	db.rwLock.Lock()
+	walPath := path.Join(testPath(), "wal", fmt.Sprintf("%v.log", db.walManager.CurrentFileNum()))
+	db.switchMemTable()
+	assert.Equal(t, 0, int(db.curMemTable.KeyCount()))
+	db.rwLock.Unlock()
+
+	// keys are readable while the memtable is waiting for flush
+	for i := 0; i < 100; i++ {
+		assert.Equal(t, []byte(fmt.Sprintf("v%v", i)), getValue(t, db, []byte(fmt.Sprintf("k%v", i))))
+	}
+
+	db.rwLock.Lock()
+	assert.Nil(t, db.waitForFlushes())
+	db.rwLock.Unlock()
+
+	assert.Equal(t, 1, len(db.sstableMetadata[0]))
+	assert.Equal(t, int64(100), db.ApproximateKeyCount())
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(walPath)
+		return os.IsNotExist(err)
+	}, time.Second, 10*time.Millisecond)
+	for i := 0; i < 100; i++ {
+		assert.Equal(t, []byte(fmt.Sprintf("v%v", i)), getValue(t, db, []byte(fmt.Sprintf("k%v", i))))
+	}
+	assert.Nil(t, db.Close())
+}
+
+func TestSpaceDBImpl_Close(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	db := New(testPath())
+	assert.Nil(t, db.Set([]byte("k1"), &DBValue{Value: []byte("v1")}))
+	assert.Nil(t, db.Close())
+
+	assert.Equal(t, ErrClosed, db.Close())
+	assert.Equal(t, ErrClosed, db.Set([]byte("k2"), &DBValue{Value: []byte("v2")}))
+	assert.Equal(t, ErrClosed, db.Delete([]byte("k1")))
+	assert.Equal(t, ErrClosed, db.Flush())
+	_, err := db.Get([]byte("k1"))
+	assert.Equal(t, ErrClosed, err)
+
+	// memtable is flushed on close, there is no WAL left to replay
+	logs, err := os.ReadDir(path.Join(testPath(), "wal"))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(logs))
+
+	db = New(testPath())
+	assert.Equal(t, []byte("v1"), getValue(t, db, []byte("k1")))
+	assert.Nil(t, db.Close())
+}
+
+func TestSpaceDBImpl_CloseWithoutFlush(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	db := New(testPath())
+	assert.Nil(t, db.Set([]byte("k1"), &DBValue{Value: []byte("v1")}))
+	assert.Nil(t, db.CloseWithOptions(&CloseOptions{SkipFlush: true}))
+
+	// record is recovered from WAL
+	db = New(testPath())
+	assert.Equal(t, []byte("v1"), getValue(t, db, []byte("k1")))
+	assert.Nil(t, db.Close())
+}
+
+func TestSpaceDBImpl_BackgroundError(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+	db, err := Open(testPath(), &Options{Logger: log.New(io.Discard, "", 0), CreateIfMissing: true})
+	assert.Nil(t, err)
+
+	// level 0 tables can't be written over directories
+	for i := 0; i < 50; i++ {
+		assert.Nil(t, os.Mkdir(path.Join(testPath(), internal.TableFileName(0, uint64(i))), 0774))
+	}
+	assert.Nil(t, db.Set([]byte("k1"), &DBValue{Value: []byte("v1")}))
+	err = db.Flush()
+	assert.NotNil(t, err)
+	// the error is sticky
+	assert.Equal(t, err, db.Set([]byte("k2"), &DBValue{Value: []byte("v2")}))
+	assert.Equal(t, err, db.Flush())
+	assert.Equal(t, err, db.Close())
+
+	for i := 0; i < 50; i++ {
+		assert.Nil(t, os.Remove(path.Join(testPath(), internal.TableFileName(0, uint64(i)))))
+	}
+	// record is recovered from WAL
+	db, err = Open(testPath(), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1"), getValue(t, db, []byte("k1")))
+	assert.Nil(t, db.Close())
+}
+
+func TestSpaceDBImpl_CompactionError(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+	var logs bytes.Buffer
+	opened, err := Open(testPath(), &Options{Logger: log.New(&logs, "", 0), CreateIfMissing: true})
+	assert.Nil(t, err)
+	db := opened.(*SpaceDBImpl)
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, db.Set([]byte(fmt.Sprintf("k%v", i)), &DBValue{Value: []byte("v")}))
+		assert.Nil(t, db.Flush())
+	}
+	// flip a bit in the data block of the first table
+	fPath := path.Join(testPath(), db.sstableMetadata[0][0].FileName)
+	data, err := os.ReadFile(fPath)
+	assert.Nil(t, err)
+	data[2] ^= 0x01
+	assert.Nil(t, os.WriteFile(fPath, data, 0644))
+
+	// fourth table starts a compaction which fails and isn't scheduled again
+	assert.Nil(t, db.Set([]byte("k3"), &DBValue{Value: []byte("v")}))
+	// the compaction may fail before the flush returns
+	err = db.Flush()
+	assert.True(t, err == nil || errors.Is(err, ErrCorruption))
+	db.rwLock.Lock()
+	for db.compacting {
+		db.bgCond.Wait()
+	}
+	db.rwLock.Unlock()
+	assert.ErrorIs(t, db.Flush(), ErrCorruption)
+	assert.ErrorIs(t, db.Set([]byte("k4"), &DBValue{Value: []byte("v")}), ErrCorruption)
+	assert.ErrorIs(t, db.Close(), ErrCorruption)
+	assert.Equal(t, 1, strings.Count(logs.String(), "error while compacting"))
+}
+
+func TestNew_UpgradesLegacyTables(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+	old := (&DBValue{Value: []byte("old")}).Serialize()
+	mid := (&DBValue{Value: []byte("mid")}).Serialize()
+	save := func(name string, values ...[]byte) {
+		m := internal.NewMemTable()
+		for i, v := range values {
+			m.Set([]byte(fmt.Sprintf("k%v", i)), v)
+		}
+		assert.Nil(t, internal.NewSSTable(testPath(), name).Save(m))
+	}
+	save("1_0.db", old, old, old)
+	save("0_1.db", mid, mid)
+	save("0_2.db", (&DBValue{Value: []byte("new")}).Serialize(), tombstoneValue)
+
+	db := New(testPath())
+	assert.Equal(t, []byte("new"), getValue(t, db, []byte("k0")))
+	_, err := db.Get([]byte("k1"))
+	assert.Equal(t, ErrNotFound, err)
+	assert.Equal(t, []byte("old"), getValue(t, db, []byte("k2")))
+	assert.Nil(t, db.Close())
+
+	for _, name := range []string{"1_0.db", "0_1.db", "0_2.db"} {
+		_, err := os.Stat(path.Join(testPath(), name))
+		assert.True(t, os.IsNotExist(err))
+	}
+	db = New(testPath())
+	assert.Equal(t, []byte("new"), getValue(t, db, []byte("k0")))
+	assert.Nil(t, db.Close())
+}
+
+func TestSpaceDBImpl_DeletedKeys(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+	db := New(testPath())
+	defer db.Close()
+
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Set([]byte(fmt.Sprintf("k%03d", i)), &DBValue{Value: []byte("v")}))
+	}
+	assert.Nil(t, db.Flush())
+	for i := 0; i < 100; i += 2 {
+		assert.Nil(t, db.Delete([]byte(fmt.Sprintf("k%03d", i))))
+	}
+	// tombstones in the memtable hide keys of the table
+	assert.Equal(t, int64(50), db.ApproximateKeyCount())
+	assert.Nil(t, db.Flush())
+	assert.Equal(t, int64(50), db.ApproximateKeyCount())
+	count, ok := db.GetProperty(PropertyEstimateNumKeys)
+	assert.True(t, ok)
+	assert.Equal(t, "50", count)
+	_, ok = db.GetProperty("spacedb.unknown")
+	assert.False(t, ok)
+
+	for i := 0; i < 100; i++ {
+		v, err := db.Get([]byte(fmt.Sprintf("k%03d", i)))
+		if i%2 == 0 {
+			assert.Nil(t, v)
+			assert.Equal(t, ErrNotFound, err)
+		} else {
+			assert.Nil(t, err)
+			assert.Equal(t, []byte("v"), v.Value)
+		}
+	}
+	_, err := db.Get([]byte("missing"))
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestSpaceDBImpl_DeleteRange(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+	db := New(testPath()).(*SpaceDBImpl)
+	a := assert.New(t)
+
+	for i := 0; i < 10; i++ {
+		a.Nil(db.Set([]byte(fmt.Sprintf("k%v", i)), &DBValue{Value: []byte("v")}))
+	}
+	a.Nil(db.Flush())
+	snap := db.GetSnapshot()
+	a.Nil(db.DeleteRange([]byte("k2"), []byte("k8")))
+	// keys written after the tombstone are visible
+	a.Nil(db.Set([]byte("k5"), &DBValue{Value: []byte("new")}))
+
+	check := func() {
+		for i := 0; i < 10; i++ {
+			key := []byte(fmt.Sprintf("k%v", i))
+			v, err := db.Get(key)
+			switch {
+			case i == 5:
+				a.Nil(err)
+				a.Equal([]byte("new"), v.Value)
+			case i >= 2 && i < 8:
+				a.Equal(ErrNotFound, err)
+			default:
+				a.Nil(err)
+			}
+			if snap != nil {
+				a.Equal([]byte("v"), getValueAt(t, db, key, snap))
+			}
+		}
+		it, err := db.NewIterator(&IteratorOptions{UpperBound: []byte("x")})
+		a.Nil(err)
+		a.Equal([]string{"k0=v", "k1=v", "k5=new", "k8=v", "k9=v"}, collectKeys(it))
+		a.Equal([]string{"k9=v", "k8=v", "k5=new", "k1=v", "k0=v"}, collectKeysBackward(it))
+		a.Nil(it.Close())
+		if snap != nil {
+			it, err = db.NewIterator(&IteratorOptions{Snapshot: snap, UpperBound: []byte("x")})
+			a.Nil(err)
+			a.Equal(10, len(collectKeys(it)))
+			a.Nil(it.Close())
+		}
+	}
+	check()
+	// tombstone is flushed into a table and compacted with the keys
+	a.Nil(db.Flush())
+	check()
+	for i := 0; i < 4; i++ {
+		a.Nil(db.Set([]byte(fmt.Sprintf("x%v", i)), &DBValue{Value: []byte("v")}))
+		a.Nil(db.Flush())
+	}
+	db.rwLock.Lock()
+	for db.compacting {
+		db.bgCond.Wait()
+	}
+	a.True(len(db.sstableMetadata[1]) > 0)
+	db.rwLock.Unlock()
+	check()
+	db.ReleaseSnapshot(snap)
+	snap = nil
+
+	// tombstone is replayed from WAL
+	a.Nil(db.DeleteRange([]byte("k0"), []byte("k1")))
+	a.Nil(db.CloseWithOptions(&CloseOptions{SkipFlush: true}))
+	db = New(testPath()).(*SpaceDBImpl)
+	defer db.Close()
+	_, err := db.Get([]byte("k0"))
+	a.Equal(ErrNotFound, err)
+	a.Equal([]byte("v"), getValue(t, db, []byte("k1")))
+	a.Equal([]byte("new"), getValue(t, db, []byte("k5")))
+	_, err = db.Get([]byte("k3"))
+	a.Equal(ErrNotFound, err)
+}
+
+func TestDBValue_Serialize(t *testing.T) {
+	v := &DBValue{Value: []byte("v")}
+	assert.Equal(t, v, Deserialize(v.Serialize()))
+	v.ExpiresAt = time.Unix(100, 5)
+	d := v.Serialize()
+	assert.Equal(t, flagExpiringValue, d[0])
+	assert.Equal(t, []byte("v"), Deserialize(d).Value)
+	assert.True(t, v.ExpiresAt.Equal(Deserialize(d).ExpiresAt))
+	assert.False(t, isExpired(d, time.Unix(100, 4)))
+	assert.True(t, isExpired(d, time.Unix(100, 5)))
+}
+
+func TestSpaceDBImpl_TTL(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+	db := New(testPath()).(*SpaceDBImpl)
+	a := assert.New(t)
+
+	a.Equal(ErrInvalidTTL, db.SetWithTTL([]byte("k"), &DBValue{Value: []byte("v")}, 0))
+	a.Nil(db.Set([]byte("a"), &DBValue{Value: []byte("v")}))
+	a.Nil(db.SetWithTTL([]byte("b"), &DBValue{Value: []byte("v")}, time.Hour))
+	a.Nil(db.Set([]byte("c"), &DBValue{Value: []byte("old")}))
+	a.Nil(db.Flush())
+	// expired value hides the older one
+	a.Nil(db.Set([]byte("c"), &DBValue{Value: []byte("v"), ExpiresAt: time.Now().Add(-time.Second)}))
+	a.Nil(db.SetWithTTL([]byte("d"), &DBValue{Value: []byte("v")}, 50*time.Millisecond))
+
+	ttl, err := db.TTL([]byte("a"))
+	a.Nil(err)
+	a.Equal(NoExpiry, ttl)
+	ttl, err = db.TTL([]byte("b"))
+	a.Nil(err)
+	a.True(ttl > 59*time.Minute && ttl <= time.Hour)
+	_, err = db.TTL([]byte("c"))
+	a.Equal(ErrNotFound, err)
+	_, err = db.TTL([]byte("missing"))
+	a.Equal(ErrNotFound, err)
+	v, err := db.Get([]byte("d"))
+	a.Nil(err)
+	a.False(v.ExpiresAt.IsZero())
+
+	time.Sleep(60 * time.Millisecond)
+	check := func() {
+		for _, k := range []string{"c", "d"} {
+			_, err := db.Get([]byte(k))
+			a.Equal(ErrNotFound, err)
+		}
+		a.Equal([]byte("v"), getValue(t, db, []byte("b")))
+		it, err := db.NewIterator(nil)
+		a.Nil(err)
+		a.Equal([]string{"a=v", "b=v"}, collectKeys(it))
+		a.Equal([]string{"b=v", "a=v"}, collectKeysBackward(it))
+		a.Nil(it.Close())
+	}
+	check()
+
+	// expired values are dropped by compaction
+	a.Nil(db.Flush())
+	for i := 0; i < 2; i++ {
+		a.Nil(db.SetWithTTL([]byte("b"), &DBValue{Value: []byte("v")}, time.Hour))
+		a.Nil(db.Flush())
+	}
+	db.rwLock.Lock()
+	for db.compacting {
+		db.bgCond.Wait()
+	}
+	a.Equal(0, len(db.sstableMetadata[0]))
+	var keys, deletions int64
+	for _, m := range db.sstableMetadata[1] {
+		keys += m.KeyCount
+		deletions += m.DeletionCount
+	}
+	db.rwLock.Unlock()
+	a.Equal(int64(2), keys)
+	a.Equal(int64(0), deletions)
+	check()
+	a.Nil(db.Close())
+}
+
+func TestSpaceDBImpl_CompareAndSet(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+	db := New(testPath()).(*SpaceDBImpl)
+	defer db.Close()
+	a := assert.New(t)
+
+	a.Equal(ErrNotFound, db.CompareAndSet([]byte("k"), []byte("v1"), &DBValue{Value: []byte("v2")}))
+	a.Nil(db.SetIfAbsent([]byte("k"), &DBValue{Value: []byte("v1")}))
+	a.Equal(ErrKeyExists, db.SetIfAbsent([]byte("k"), &DBValue{Value: []byte("v3")}))
+	a.Nil(db.Flush())
+
+	seq := db.versions.LastSequence
+	a.Equal(ErrValueMismatch, db.CompareAndSet([]byte("k"), []byte("v2"), &DBValue{Value: []byte("v3")}))
+	a.Nil(db.CompareAndSet([]byte("k"), []byte("v1"), &DBValue{Value: []byte("v2")}))
+	// failed updates don't write anything
+	a.Equal(seq+1, db.versions.LastSequence)
+	a.Equal([]byte("v2"), getValue(t, db, []byte("k")))
+
+	errStop := errors.New("stop")
+	a.Equal(errStop, db.Update([]byte("k"), func(old *DBValue) (*DBValue, error) {
+		return nil, errStop
+	}))
+	a.Nil(db.Update([]byte("k"), func(old *DBValue) (*DBValue, error) {
+		a.Equal([]byte("v2"), old.Value)
+		return nil, nil
+	}))
+	_, err := db.Get([]byte("k"))
+	a.Equal(ErrNotFound, err)
+	a.Nil(db.SetIfAbsent([]byte("k"), &DBValue{Value: []byte("v4")}))
+	a.Equal([]byte("v4"), getValue(t, db, []byte("k")))
+}
+
+func TestSpaceDBImpl_UpdateConcurrent(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+	db := New(testPath())
+	defer db.Close()
+
+	increment := func(old *DBValue) (*DBValue, error) {
+		n := 0
+		if old != nil {
+			n, _ = strconv.Atoi(string(old.Value))
+		}
+		return &DBValue{Value: []byte(strconv.Itoa(n + 1))}, nil
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				assert.Nil(t, db.Update([]byte("counter"), increment))
+				assert.Nil(t, db.Set([]byte(fmt.Sprintf("k%v", j)), &DBValue{Value: []byte("v")}))
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, []byte("800"), getValue(t, db, []byte("counter")))
+}
+
+func TestSpaceDBImpl_FilterStats(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+	db := New(testPath())
+	defer db.Close()
+
+	for i := 0; i < 100; i += 2 {
+		assert.Nil(t, db.Set([]byte(fmt.Sprintf("k%03d", i)), &DBValue{Value: []byte("v")}))
+	}
+	assert.Nil(t, db.Flush())
+
+	// keys within the range of the table
+	for i := 0; i < 99; i++ {
+		_, err := db.Get([]byte(fmt.Sprintf("k%03d", i)))
+		assert.Equal(t, i%2 == 0, err == nil)
+	}
+	stats := db.Stats()
+	assert.Equal(t, int64(99), stats.FilterHits+stats.FilterMisses)
+	assert.Equal(t, stats.FilterHits-50, stats.FilterFalsePositives)
+	assert.True(t, stats.FilterMisses > 40)
+}
+
+func TestOpen_Locked(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+	db, err := Open(testPath(), nil)
+	assert.Nil(t, err)
+
+	_, err = Open(testPath(), nil)
+	assert.Equal(t, ErrLocked, err)
+
+	// lock is released on close
+	assert.Nil(t, db.Close())
+	db, err = Open(testPath(), nil)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Close())
+}
+
+func TestOpen_WALSizeLimits(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+	opts := &Options{CreateIfMissing: true, MaxWALFileSize: 4 * 1024, MaxTotalWALSize: 64 * 1024}
+	db, err := Open(testPath(), opts)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Set([]byte(fmt.Sprintf("k%03d", i)), &DBValue{Value: []byte("v")}))
+	}
+
+	// deletes are small and leave the memtable far below its size,
+	// WAL size forces flushes
+	walDir := path.Join(testPath(), "wal")
+	for i := 0; i < 20000; i++ {
+		assert.Nil(t, db.Delete([]byte(fmt.Sprintf("k%03d", i%50))))
+	}
+	impl := db.(*SpaceDBImpl)
+	impl.rwLock.Lock()
+	assert.True(t, impl.curMemTable.RawSize() < impl.opts.MemTableSize)
+	assert.Nil(t, impl.waitForFlushes())
+	assert.True(t, len(impl.sstableMetadata[0])+len(impl.sstableMetadata[1]) > 0)
+	impl.rwLock.Unlock()
+
+	assert.Eventually(t, func() bool {
+		var total int64
+		logs, err := os.ReadDir(walDir)
+		assert.Nil(t, err)
+		for _, l := range logs {
+			info, err := l.Info()
+			if err == nil {
+				total += info.Size()
+			}
+		}
+		return total <= opts.MaxTotalWALSize+opts.MaxWALFileSize
+	}, time.Second, 10*time.Millisecond)
+
+	assert.Nil(t, db.CloseWithOptions(&CloseOptions{SkipFlush: true}))
+	db, err = Open(testPath(), opts)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		if i < 50 {
+			_, err = db.Get([]byte(fmt.Sprintf("k%03d", i)))
+			assert.Equal(t, ErrNotFound, err)
+		} else {
+			assert.Equal(t, []byte("v"), getValue(t, db, []byte(fmt.Sprintf("k%03d", i))))
+		}
+	}
+	assert.Nil(t, db.Close())
+}
+
+func TestOpen_WALRecoveryModes(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+	db, err := Open(testPath(), nil)
+	assert.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, db.Set([]byte(fmt.Sprintf("k%v", i)), &DBValue{Value: []byte("v")}))
+	}
+	walPath := db.(*SpaceDBImpl).walManager.CurrentFilePath()
+	assert.Nil(t, db.CloseWithOptions(&CloseOptions{SkipFlush: true}))
+	info, err := os.Stat(walPath)
+	assert.Nil(t, err)
+	assert.Nil(t, os.Truncate(walPath, info.Size()-2))
+
+	_, err = Open(testPath(), &Options{WALRecoveryMode: WALRecoverAbsoluteConsistency})
+	assert.ErrorIs(t, err, ErrWALCorruption)
+	var recErr *WALRecoveryError
+	assert.ErrorAs(t, err, &recErr)
+	assert.Equal(t, walPath, recErr.File)
+
+	// logs which failed recovery are recovered by the next Open
+	db, err = Open(testPath(), &Options{WALRecoveryMode: WALRecoverTolerateCorruptedTail})
+	assert.Nil(t, err)
+	report := db.RecoveryReport()
+	assert.Equal(t, WALRecoverTolerateCorruptedTail, report.Mode)
+	assert.Equal(t, 9, report.Batches)
+	assert.Equal(t, 1, len(report.Skipped))
+	assert.Equal(t, walPath, report.Skipped[0].File)
+	for i := 0; i < 9; i++ {
+		assert.Equal(t, []byte("v"), getValue(t, db, []byte(fmt.Sprintf("k%v", i))))
+	}
+	_, err = db.Get([]byte("k9"))
+	assert.Equal(t, ErrNotFound, err)
+	assert.Nil(t, db.Close())
+
+	db, err = Open(testPath(), &Options{WALRecoveryMode: WALRecoverAbsoluteConsistency})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(db.RecoveryReport().Skipped))
+	assert.Nil(t, db.Close())
+}
+
+func TestOpen_RecoversWALIntoTables(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+	db, err := Open(testPath(), nil)
+	assert.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, db.Set([]byte(fmt.Sprintf("k%v", i)), &DBValue{Value: []byte("v")}))
+	}
+	walPath := db.(*SpaceDBImpl).walManager.CurrentFilePath()
+	walNum := db.(*SpaceDBImpl).walManager.CurrentFileNum()
+	assert.Nil(t, db.CloseWithOptions(&CloseOptions{SkipFlush: true}))
+	walData, err := os.ReadFile(walPath)
+	assert.Nil(t, err)
+	// table of a recovery which crashed before recording it
+	assert.Nil(t, os.WriteFile(path.Join(testPath(), internal.TableFileName(0, 999)), []byte("x"), 0664))
+
+	db, err = Open(testPath(), nil)
+	assert.Nil(t, err)
+	impl := db.(*SpaceDBImpl)
+	assert.Equal(t, 1, len(impl.sstableMetadata[0]))
+	assert.Equal(t, int64(0), impl.curMemTable.KeyCount())
+	assert.Equal(t, uint64(walNum+1), impl.versions.LogNumber)
+	assert.True(t, impl.walManager.CurrentFileNum() > walNum)
+	_, err = os.Stat(walPath)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(path.Join(testPath(), internal.TableFileName(0, 999)))
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, 10, db.RecoveryReport().Batches)
+	assert.Nil(t, db.CloseWithOptions(&CloseOptions{SkipFlush: true}))
+
+	// crash after the tables are recorded but before the log is removed
+	assert.Nil(t, os.WriteFile(walPath, walData, 0664))
+	db, err = Open(testPath(), nil)
+	assert.Nil(t, err)
+	impl = db.(*SpaceDBImpl)
+	assert.Equal(t, 1, len(impl.sstableMetadata[0]))
+	assert.Equal(t, 0, db.RecoveryReport().Batches)
+	_, err = os.Stat(walPath)
+	assert.True(t, os.IsNotExist(err))
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, []byte("v"), getValue(t, db, []byte(fmt.Sprintf("k%v", i))))
+	}
+	assert.Equal(t, int64(10), db.ApproximateKeyCount())
+	assert.Nil(t, db.Close())
+}
+
+func TestSpaceDBImpl_TableCache(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+	db, err := Open(testPath(), &Options{MaxOpenFiles: 2, CreateIfMissing: true})
+	assert.Nil(t, err)
+	defer db.Close()
+	for j := 0; j < 3; j++ {
+		for i := 0; i < 10; i++ {
+			assert.Nil(t, db.Set([]byte(fmt.Sprintf("k%v_%v", j, i)), &DBValue{Value: []byte("v")}))
+		}
+		assert.Nil(t, db.Flush())
+	}
+
+	for n := 0; n < 2; n++ {
+		for j := 0; j < 3; j++ {
+			for i := 0; i < 10; i++ {
+				assert.Equal(t, []byte("v"), getValue(t, db, []byte(fmt.Sprintf("k%v_%v", j, i))))
+			}
+		}
+	}
+	stats := db.Stats()
+	assert.True(t, stats.TableCacheHits > 0)
+	assert.True(t, stats.TableCacheMisses > 0)
+	assert.True(t, db.(*SpaceDBImpl).tableCache.Len() <= 2)
+}
+
+func TestSpaceDBImpl_BlockCache(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+	db, err := Open(testPath(), &Options{PinIndexAndFilterBlocks: true, CreateIfMissing: true})
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Set([]byte(fmt.Sprintf("k%03d", i)), &DBValue{Value: []byte("v")}))
+	}
+	assert.Nil(t, db.Flush())
+
+	for n := 0; n < 2; n++ {
+		for i := 0; i < 100; i++ {
+			assert.Equal(t, []byte("v"), getValue(t, db, []byte(fmt.Sprintf("k%03d", i))))
+		}
+	}
+	stats := db.Stats()
+	assert.True(t, stats.BlockCacheHits > 0)
+	assert.True(t, stats.BlockCacheMisses > 0)
+	assert.True(t, stats.BlockCachePinnedUsage > 0)
+	assert.True(t, stats.BlockCacheUsage >= stats.BlockCachePinnedUsage)
+
+	// pinned blocks are released once their tables are closed
+	impl := db.(*SpaceDBImpl)
+	impl.tableCache.Close()
+	assert.Equal(t, int64(0), db.Stats().BlockCachePinnedUsage)
+	assert.Nil(t, db.Close())
+}
@@ -0,0 +1,39 @@
+package spacedb
+
+import (
+	"errors"
+
+	"github.com/emin/spacedb/internal"
+	"github.com/emin/spacedb/internal/wal"
+)
+
+var (
+	ErrClosed     = errors.New("database is closed")
+	ErrDBNotExist = errors.New("database does not exist")
+	ErrDBExists   = errors.New("database already exists")
+	// Returned by Get when the key doesn't exist or is deleted
+	ErrNotFound = errors.New("key not found")
+	// Returned by SetWithTTL when ttl isn't positive
+	ErrInvalidTTL = errors.New("ttl must be positive")
+	// Returned by CompareAndSet when the key has another value
+	ErrValueMismatch = errors.New("value doesn't match expected value")
+	// Returned by SetIfAbsent when the key exists
+	ErrKeyExists = errors.New("key already exists")
+	// Returned by writes of merge operands and reads of them
+	// when Options.MergeOperator isn't set
+	ErrNoMergeOperator = errors.New("merge operator isn't set")
+	// Returned by built-in merge operators for operands they can't merge
+	ErrInvalidMergeOperand = errors.New("invalid merge operand")
+	// Returned by Open when another process has the database open
+	ErrLocked = internal.ErrLocked
+	// Returned when a checksum or a block of an sstable doesn't match,
+	// the error is a *CorruptionError which has the file and offset
+	ErrCorruption = internal.ErrCorruption
+	// Returned by Open when WALRecoveryMode doesn't allow dropping
+	// a damaged WAL record, the error is a *WALRecoveryError
+	ErrWALCorruption = wal.ErrCorruptRecord
+)
+
+type CorruptionError = internal.CorruptionError
+
+type WALRecoveryError = wal.RecoveryError
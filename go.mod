@@ -1,11 +1,10 @@
 module github.com/emin/spacedb
 
-go 1.18
+// 1.19 is needed for the typed atomics of sync/atomic
+// and the Append functions of encoding/binary
+go 1.19
 
-require (
-	github.com/emin/skiplist v1.1.1
-	github.com/stretchr/testify v1.7.0
-)
+require github.com/stretchr/testify v1.7.0
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
@@ -26,6 +26,16 @@ func WriteUint64(w io.Writer, v uint64) error {
 	return nil
 }
 
+// Writes length of the slice (4-bytes) followed by the slice itself
+func WriteSlice(w io.Writer, b []byte) error {
+	err := WriteUint32(w, uint32(len(b)))
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
 func ReadUint32(r io.Reader) (uint32, error) {
 	b := make([]byte, 4)
 	n, err := io.ReadFull(r, b)
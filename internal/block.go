@@ -0,0 +1,267 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"sort"
+)
+
+//
+//	Data Block of block based tables
+//
+//   -----------------------------------------------------------------------------------
+//  | Entry | Entry | .... | Restart Point (4-bytes) | .... | Restart Count (4-bytes) |
+//   -----------------------------------------------------------------------------------
+//
+//     Entry
+//   ----------------------------------------------------------------------------------------
+//  | Shared (varint) | Unshared (varint) | Value Len (varint) | Unshared Key Bytes | Value |
+//   ----------------------------------------------------------------------------------------
+//
+//	Keys are stored as the length of the prefix they share with the previous key
+//	and the rest of the key. Every blockRestartInterval entries a key is stored
+//	in full, offsets of these restart points let readers binary search a block.
+//
+
+const (
+	// Data blocks are cut once they reach this size
+	BlockSize            = 4 * 1024
+	blockRestartInterval = 16
+)
+
+var ErrInvalidBlock = errors.New("invalid data block")
+
+type blockBuilder struct {
+	buf      []byte
+	restarts []uint32
+	counter  int
+	lastKey  []byte
+}
+
+func newBlockBuilder() *blockBuilder {
+	return &blockBuilder{restarts: []uint32{0}}
+}
+
+func sharedPrefixLen(a, b []byte) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
+
+// Adds an entry, keys must be added in ascending order
+func (b *blockBuilder) add(key, value []byte) {
+	shared := 0
+	if b.counter < blockRestartInterval {
+		shared = sharedPrefixLen(b.lastKey, key)
+	} else {
+		b.restarts = append(b.restarts, uint32(len(b.buf)))
+		b.counter = 0
+	}
+	b.buf = binary.AppendUvarint(b.buf, uint64(shared))
+	b.buf = binary.AppendUvarint(b.buf, uint64(len(key)-shared))
+	b.buf = binary.AppendUvarint(b.buf, uint64(len(value)))
+	b.buf = append(b.buf, key[shared:]...)
+	b.buf = append(b.buf, value...)
+	b.lastKey = append(b.lastKey[:0], key...)
+	b.counter++
+}
+
+func (b *blockBuilder) empty() bool {
+	return len(b.buf) == 0
+}
+
+// Returns size of the block if it is finished now
+func (b *blockBuilder) estimatedSize() int {
+	return len(b.buf) + 4*len(b.restarts) + 4
+}
+
+// Appends restart points and returns the block.
+// Returned slice is valid until reset is called
+func (b *blockBuilder) finish() []byte {
+	for _, r := range b.restarts {
+		b.buf = binary.LittleEndian.AppendUint32(b.buf, r)
+	}
+	return binary.LittleEndian.AppendUint32(b.buf, uint32(len(b.restarts)))
+}
+
+func (b *blockBuilder) reset() {
+	b.buf = b.buf[:0]
+	b.restarts = b.restarts[:1]
+	b.counter = 0
+	b.lastKey = b.lastKey[:0]
+}
+
+// blockIter implements SeekIterator over entries of a data block
+type blockIter struct {
+	data          []byte
+	restartOffset int
+	numRestarts   int
+	// offset of the current entry, restartOffset when not positioned
+	current int
+	next    int
+	key     []byte
+	value   []byte
+	err     error
+}
+
+func newBlockIter(data []byte) (*blockIter, error) {
+	if len(data) < 4 {
+		return nil, ErrInvalidBlock
+	}
+	numRestarts := int(binary.LittleEndian.Uint32(data[len(data)-4:]))
+	restartOffset := len(data) - 4 - 4*numRestarts
+	if numRestarts == 0 || restartOffset < 0 {
+		return nil, ErrInvalidBlock
+	}
+	return &blockIter{
+		data:          data,
+		restartOffset: restartOffset,
+		numRestarts:   numRestarts,
+		current:       restartOffset,
+		next:          restartOffset,
+	}, nil
+}
+
+func (b *blockIter) restartPoint(i int) int {
+	return int(binary.LittleEndian.Uint32(b.data[b.restartOffset+4*i:]))
+}
+
+func (b *blockIter) seekToRestart(i int) {
+	b.key = nil
+	b.next = b.restartPoint(i)
+}
+
+// Decodes header of the entry at offset.
+// Returns shared and unshared key lengths, value length and offset of the key bytes
+func (b *blockIter) decodeEntry(offset int) (int, int, int, int, bool) {
+	if offset >= b.restartOffset {
+		return 0, 0, 0, 0, false
+	}
+	p := offset
+	var fields [3]int
+	for i := range fields {
+		v, n := binary.Uvarint(b.data[p:b.restartOffset])
+		if n <= 0 {
+			return 0, 0, 0, 0, false
+		}
+		fields[i] = int(v)
+		p += n
+	}
+	shared, unshared, valLen := fields[0], fields[1], fields[2]
+	if unshared < 0 || valLen < 0 || p+unshared+valLen > b.restartOffset || p+unshared+valLen < p {
+		return 0, 0, 0, 0, false
+	}
+	return shared, unshared, valLen, p, true
+}
+
+// Moves to the entry at b.next
+func (b *blockIter) parseNext() bool {
+	b.current = b.next
+	if b.current >= b.restartOffset {
+		b.current = b.restartOffset
+		return false
+	}
+	shared, unshared, valLen, p, ok := b.decodeEntry(b.current)
+	if !ok || shared > len(b.key) {
+		b.err = ErrInvalidBlock
+		b.current = b.restartOffset
+		return false
+	}
+	// a new slice is used for each key, so returned keys stay valid
+	key := make([]byte, shared+unshared)
+	copy(key, b.key[:shared])
+	copy(key[shared:], b.data[p:p+unshared])
+	b.key = key
+	b.value = b.data[p+unshared : p+unshared+valLen]
+	b.next = p + unshared + valLen
+	return true
+}
+
+// Returns value of the entry at offset, the entry doesn't need its previous keys
+func (b *blockIter) valueAt(offset int) ([]byte, error) {
+	_, unshared, valLen, p, ok := b.decodeEntry(offset)
+	if !ok {
+		return nil, ErrInvalidBlock
+	}
+	return b.data[p+unshared : p+unshared+valLen], nil
+}
+
+func (b *blockIter) Valid() bool {
+	return b.err == nil && b.current < b.restartOffset
+}
+
+func (b *blockIter) SeekToFirst() {
+	b.seekToRestart(0)
+	b.parseNext()
+}
+
+func (b *blockIter) SeekToLast() {
+	b.seekToRestart(b.numRestarts - 1)
+	for b.parseNext() && b.next < b.restartOffset {
+	}
+}
+
+func (b *blockIter) Seek(key []byte) {
+	// find the last restart point whose key is < key
+	r := sort.Search(b.numRestarts, func(i int) bool {
+		shared, unshared, _, p, ok := b.decodeEntry(b.restartPoint(i))
+		if !ok || shared != 0 {
+			b.err = ErrInvalidBlock
+			return true
+		}
+		return bytes.Compare(b.data[p:p+unshared], key) >= 0
+	})
+	if b.err != nil {
+		b.current = b.restartOffset
+		return
+	}
+	if r > 0 {
+		r--
+	}
+	b.seekToRestart(r)
+	for b.parseNext() {
+		if bytes.Compare(b.key, key) >= 0 {
+			return
+		}
+	}
+}
+
+func (b *blockIter) Next() {
+	b.parseNext()
+}
+
+func (b *blockIter) Prev() {
+	original := b.current
+	// find the last restart point before the current entry
+	r := b.numRestarts - 1
+	for r >= 0 && b.restartPoint(r) >= original {
+		r--
+	}
+	if r < 0 {
+		b.current = b.restartOffset
+		b.next = b.restartOffset
+		return
+	}
+	b.seekToRestart(r)
+	for b.parseNext() && b.next < original {
+	}
+}
+
+func (b *blockIter) Key() []byte {
+	return b.key
+}
+
+func (b *blockIter) Value() []byte {
+	return b.value
+}
+
+func (b *blockIter) Err() error {
+	return b.err
+}
+
+func (b *blockIter) Close() error {
+	return nil
+}
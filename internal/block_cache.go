@@ -0,0 +1,181 @@
+package internal
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// Number of shards of BlockCache, each has its own lock and LRU list
+const blockCacheShards = 16
+
+// BlockCacheKey identifies a block by the file number of its table
+// and its offset in the file. File numbers are never reused
+type BlockCacheKey struct {
+	FileNum uint64
+	Offset  int64
+}
+
+// BlockCache keeps blocks read from sstables in memory, it is shared by
+// all tables. Data blocks are kept decompressed and verified. Index and
+// filter blocks are kept parsed, they can be pinned so they are not
+// evicted while their table is open. Capacity is split among shards,
+// each shard evicts its least recently used blocks when it is full.
+// It is safe for concurrent use
+type BlockCache struct {
+	shards    [blockCacheShards]blockCacheShard
+	hits      atomic.Int64
+	misses    atomic.Int64
+	evictions atomic.Int64
+}
+
+type blockCacheShard struct {
+	mu       sync.Mutex
+	capacity int64
+	usage    int64
+	pinned   int64
+	// evictable entries, front is the most recently used
+	lru     list.List
+	entries map[BlockCacheKey]*blockCacheEntry
+}
+
+type blockCacheEntry struct {
+	key    BlockCacheKey
+	value  any
+	charge int64
+	// number of pins, entries are in lru only if they aren't pinned
+	pins int
+	elem *list.Element
+}
+
+// BlockCacheStats holds counters of a BlockCache
+type BlockCacheStats struct {
+	Hits      int64
+	Misses    int64
+	Evictions int64
+	// bytes of all cached blocks and of pinned ones
+	Usage       int64
+	PinnedUsage int64
+}
+
+// Returns a new BlockCache which keeps about capacity bytes of blocks
+func NewBlockCache(capacity int64) *BlockCache {
+	c := &BlockCache{}
+	for i := range c.shards {
+		c.shards[i].capacity = capacity / blockCacheShards
+		c.shards[i].entries = make(map[BlockCacheKey]*blockCacheEntry)
+	}
+	return c
+}
+
+func (c *BlockCache) shard(key BlockCacheKey) *blockCacheShard {
+	h := key.FileNum*0x9e3779b97f4a7c15 ^ uint64(key.Offset)*0xbf58476d1ce4e5b9
+	return &c.shards[(h>>32)%blockCacheShards]
+}
+
+// Returns the cached value of key. Values must not be modified
+func (c *BlockCache) Get(key BlockCacheKey) (any, bool) {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[key]
+	if !ok {
+		c.misses.Add(1)
+		return nil, false
+	}
+	c.hits.Add(1)
+	if e.elem != nil {
+		s.lru.MoveToFront(e.elem)
+	}
+	return e.value, true
+}
+
+// Caches value of key, charge is its size in bytes. Least recently used
+// values are evicted if the shard is full. A value larger than the shard
+// isn't cached
+func (c *BlockCache) Insert(key BlockCacheKey, value any, charge int64) {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.entries[key]; ok {
+		if e.elem != nil {
+			s.lru.MoveToFront(e.elem)
+		}
+		return
+	}
+	if charge > s.capacity {
+		return
+	}
+	e := &blockCacheEntry{key: key, value: value, charge: charge}
+	e.elem = s.lru.PushFront(e)
+	s.entries[key] = e
+	s.usage += charge
+	c.evict(s)
+}
+
+// Caches value of key and pins it, pinned values are never evicted.
+// Each Pin must be followed by an Unpin. Pinned values are kept
+// even if they don't fit in the capacity
+func (c *BlockCache) Pin(key BlockCacheKey, value any, charge int64) {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[key]
+	if !ok {
+		e = &blockCacheEntry{key: key, value: value, charge: charge}
+		s.entries[key] = e
+		s.usage += charge
+	}
+	if e.pins == 0 {
+		s.pinned += e.charge
+		if e.elem != nil {
+			s.lru.Remove(e.elem)
+			e.elem = nil
+		}
+	}
+	e.pins++
+	c.evict(s)
+}
+
+// Releases a pin of key, the value is evictable once all pins are released
+func (c *BlockCache) Unpin(key BlockCacheKey) {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[key]
+	if !ok || e.pins == 0 {
+		return
+	}
+	e.pins--
+	if e.pins == 0 {
+		s.pinned -= e.charge
+		e.elem = s.lru.PushFront(e)
+		c.evict(s)
+	}
+}
+
+// Evicts least recently used values until the shard fits. s.mu must be held
+func (c *BlockCache) evict(s *blockCacheShard) {
+	for s.usage > s.capacity && s.lru.Len() > 0 {
+		e := s.lru.Remove(s.lru.Back()).(*blockCacheEntry)
+		delete(s.entries, e.key)
+		s.usage -= e.charge
+		c.evictions.Add(1)
+	}
+}
+
+func (c *BlockCache) Stats() BlockCacheStats {
+	stats := BlockCacheStats{
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Evictions: c.evictions.Load(),
+	}
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		stats.Usage += s.usage
+		stats.PinnedUsage += s.pinned
+		s.mu.Unlock()
+	}
+	return stats
+}
@@ -0,0 +1,94 @@
+package internal
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBlockCache_Evict(t *testing.T) {
+	c := NewBlockCache(blockCacheShards * 100)
+	// keys of a file are spread across shards, so some shard overflows
+	for i := 0; i < 100; i++ {
+		c.Insert(BlockCacheKey{FileNum: 1, Offset: int64(i)}, i, 40)
+	}
+	stats := c.Stats()
+	assert.True(t, stats.Evictions > 0)
+	assert.True(t, stats.Usage <= blockCacheShards*100)
+	assert.Equal(t, int64(100*40), stats.Usage+stats.Evictions*40)
+
+	// the most recently inserted block is kept
+	v, ok := c.Get(BlockCacheKey{FileNum: 1, Offset: 99})
+	assert.True(t, ok)
+	assert.Equal(t, 99, v)
+	_, ok = c.Get(BlockCacheKey{FileNum: 2, Offset: 99})
+	assert.False(t, ok)
+	stats = c.Stats()
+	assert.Equal(t, int64(1), stats.Hits)
+	assert.Equal(t, int64(1), stats.Misses)
+
+	// blocks larger than a shard aren't cached
+	c.Insert(BlockCacheKey{FileNum: 3}, "big", 1000)
+	_, ok = c.Get(BlockCacheKey{FileNum: 3})
+	assert.False(t, ok)
+}
+
+func TestBlockCache_Pin(t *testing.T) {
+	c := NewBlockCache(blockCacheShards * 100)
+	key := BlockCacheKey{FileNum: 1}
+	c.Pin(key, "index", 60)
+	c.Pin(key, "index", 60)
+	assert.Equal(t, int64(60), c.Stats().PinnedUsage)
+
+	// pinned blocks aren't evicted by other blocks of the shard
+	var others []BlockCacheKey
+	for i := int64(1); len(others) < 2; i++ {
+		k := BlockCacheKey{FileNum: 2, Offset: i}
+		if c.shard(k) == c.shard(key) {
+			others = append(others, k)
+		}
+	}
+	c.Insert(others[0], 0, 50)
+	v, ok := c.Get(key)
+	assert.True(t, ok)
+	assert.Equal(t, "index", v)
+
+	c.Unpin(key)
+	assert.Equal(t, int64(60), c.Stats().PinnedUsage)
+	c.Unpin(key)
+	stats := c.Stats()
+	assert.Equal(t, int64(0), stats.PinnedUsage)
+	// unpinned block is the least recently used one now
+	c.Insert(others[1], 1, 50)
+	_, ok = c.Get(key)
+	assert.False(t, ok)
+}
+
+func TestBlockCache_Concurrent(t *testing.T) {
+	c := NewBlockCache(blockCacheShards * 1000)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				key := BlockCacheKey{FileNum: uint64(i % 10), Offset: int64(i)}
+				if v, ok := c.Get(key); ok {
+					assert.Equal(t, i, v)
+				} else {
+					c.Insert(key, i, 100)
+				}
+				if i%100 == 0 {
+					c.Pin(key, i, 100)
+					c.Unpin(key)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	stats := c.Stats()
+	assert.Equal(t, int64(8*1000), stats.Hits+stats.Misses)
+	assert.Equal(t, int64(0), stats.PinnedUsage)
+	assert.True(t, stats.Usage <= blockCacheShards*1000)
+}
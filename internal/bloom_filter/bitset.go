@@ -122,3 +122,19 @@ func setBit(num uint64, idx int) uint64 {
 func resetBit(num uint64, idx int) uint64 {
 	return num & ^(1 << idx)
 }
+
+// Returns a BitSet which holds at least size bits, all of them unset
+func NewBitSetWithSize(size int) *BitSet {
+	words := (size + 63) / 64
+	return &BitSet{bits: make([]uint64, words), index: int64(words * 64)}
+}
+
+// Returns a BitSet backed by words, bit i is stored in words[i/64]
+func NewBitSetFromWords(words []uint64) *BitSet {
+	return &BitSet{bits: words, index: int64(len(words) * 64)}
+}
+
+// Returns the words backing the set, see NewBitSetFromWords
+func (b *BitSet) Words() []uint64 {
+	return b.bits
+}
@@ -0,0 +1,100 @@
+package bloomfilter
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+)
+
+var ErrInvalidFilter = errors.New("invalid bloom filter")
+
+// BloomFilter is a probabilistic set of keys built on BitSet.
+// MayContain never returns false for an added key, but it can
+// return true for a key which isn't added
+type BloomFilter struct {
+	bits *BitSet
+	// number of hash functions
+	k int
+}
+
+// Returns hash of key which is used to build and query filters
+func Hash(key []byte) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write(key)
+	return h.Sum32()
+}
+
+// Returns a filter of keys with given hashes which uses bitsPerKey bits for each key.
+// Around 1% of absent keys pass the filter with 10 bits per key
+func NewBloomFilter(bitsPerKey int, hashes []uint32) *BloomFilter {
+	// k = bitsPerKey * ln(2) minimizes false positives
+	k := bitsPerKey * 69 / 100
+	if k < 1 {
+		k = 1
+	}
+	if k > 30 {
+		k = 30
+	}
+	size := len(hashes) * bitsPerKey
+	// small filters have a high false positive rate
+	if size < 64 {
+		size = 64
+	}
+	f := &BloomFilter{bits: NewBitSetWithSize(size), k: k}
+	for _, h := range hashes {
+		f.add(h)
+	}
+	return f
+}
+
+// Uses double hashing to get k bit positions from one hash
+func (f *BloomFilter) add(h uint32) {
+	n := uint32(f.bits.Size())
+	delta := h>>17 | h<<15
+	for i := 0; i < f.k; i++ {
+		f.bits.Set(int64(h%n), true)
+		h += delta
+	}
+}
+
+func (f *BloomFilter) MayContain(key []byte) bool {
+	return f.MayContainHash(Hash(key))
+}
+
+func (f *BloomFilter) MayContainHash(h uint32) bool {
+	n := uint32(f.bits.Size())
+	if n == 0 {
+		return true
+	}
+	delta := h>>17 | h<<15
+	for i := 0; i < f.k; i++ {
+		if !f.bits.Get(int(h % n)) {
+			return false
+		}
+		h += delta
+	}
+	return true
+}
+
+// Encodes the filter as
+// | Hash Count (1-byte) | Bits (8-bytes each word) | .... |
+func (f *BloomFilter) Encode() []byte {
+	words := f.bits.Words()
+	data := make([]byte, 1, 1+len(words)*8)
+	data[0] = byte(f.k)
+	for _, w := range words {
+		data = binary.LittleEndian.AppendUint64(data, w)
+	}
+	return data
+}
+
+func DecodeBloomFilter(data []byte) (*BloomFilter, error) {
+	if len(data) < 1 || (len(data)-1)%8 != 0 || data[0] == 0 {
+		return nil, ErrInvalidFilter
+	}
+	words := make([]uint64, (len(data)-1)/8)
+	for i := range words {
+		words[i] = binary.LittleEndian.Uint64(data[1+i*8:])
+	}
+	return &BloomFilter{bits: NewBitSetFromWords(words), k: int(data[0])}, nil
+}
@@ -0,0 +1,43 @@
+package bloomfilter
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestBloomFilter(t *testing.T) {
+	hashes := make([]uint32, 0)
+	for i := 0; i < 10000; i++ {
+		hashes = append(hashes, Hash([]byte(fmt.Sprintf("key%v", i))))
+	}
+	f, err := DecodeBloomFilter(NewBloomFilter(10, hashes).Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10000; i++ {
+		key := []byte(fmt.Sprintf("key%v", i))
+		if !f.MayContain(key) {
+			t.Errorf("MayContain(%s) = false, want true", key)
+		}
+	}
+
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if f.MayContain([]byte(fmt.Sprintf("absent%v", i))) {
+			falsePositives++
+		}
+	}
+	// expected rate is around 1%
+	if falsePositives > 300 {
+		t.Errorf("false positives = %d, want <= 300", falsePositives)
+	}
+}
+
+func TestDecodeBloomFilter(t *testing.T) {
+	for _, data := range [][]byte{{}, {0}, {5, 1, 2}} {
+		if _, err := DecodeBloomFilter(data); err != ErrInvalidFilter {
+			t.Errorf("DecodeBloomFilter(%v) error = %v, want %v", data, err, ErrInvalidFilter)
+		}
+	}
+}
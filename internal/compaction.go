@@ -1 +1,577 @@
 package internal
+
+import (
+	"bytes"
+	"os"
+	"path"
+)
+
+//
+//	Leveled Compaction
+//
+//	Level 0 files are flushed memtables, they can overlap with each other
+//	and newer files shadow older ones. Every other level is a sorted run of
+//	non-overlapping files ordered by their min keys.
+//
+//	When level 0 has too many files or a level grows over its target size,
+//	files from that level are merged with the overlapping files of the next
+//	level. Older versions of a key are dropped unless a live snapshot can
+//	still see them, and tombstones are dropped when no snapshot needs them
+//	and no deeper level can contain the key. Versions of a user key are
+//	never split between two output files.
+//
+//	Versions covered by a range tombstone which every snapshot can see are
+//	dropped, input files which are fully covered aren't even read. Range
+//	tombstones are clipped to the key range of each output file, so files
+//	of a level don't overlap, and they are dropped like point tombstones.
+//	Expired values are turned into tombstones, see Compactor.IsExpired.
+//	Merge operands which every snapshot can see are merged with older
+//	versions of the key into a value, see Compactor.Merger.
+//
+
+const (
+	// Number of level-0 files which triggers a compaction into level 1
+	L0CompactionTrigger = 4
+	// Target size of level 1, each following level is LevelSizeMultiplier times bigger
+	MaxBytesForLevelBase int64 = 10 * 1024 * 1024
+	LevelSizeMultiplier  int64 = 10
+	// Compaction outputs are cut once they reach this size
+	TargetFileSize int64 = 2 * 1024 * 1024
+)
+
+// Compaction describes input files which will be merged into Level+1.
+// Inputs[0] are from Level and Inputs[1] are from Level+1
+type Compaction struct {
+	Level  int
+	Inputs [2][]*MetaBlock
+	// Sequence number of the oldest live snapshot,
+	// versions which it can't see are dropped
+	SmallestSnapshot uint64
+	// Input files which are fully covered by range tombstones,
+	// they are removed without being read. It is set by Run
+	Dropped []*MetaBlock
+	levels  [][]*MetaBlock
+}
+
+type Compactor struct {
+	dbPath          string
+	newFileNum      func() uint64
+	compactPointers map[int][]byte
+	// Compressors of output levels, see CompressorForLevel
+	Compressors []Compressor
+	// Bits of the filter of outputs for each key, see SSTableWriter.BitsPerKey
+	BitsPerKey int
+	// Reports whether a value is expired, nil means values never expire.
+	// Expired values are written as tombstones with TombstoneValue, then
+	// they are dropped like other tombstones. They must be set before use
+	IsExpired      func(value []byte) bool
+	TombstoneValue []byte
+	// Merges operands of keys, nil means operands are kept as they are.
+	// It must be set before use
+	Merger ValueMerger
+}
+
+// ValueMerger combines merge operands in compaction. Values and
+// operands are stored values, operands are ordered from oldest to newest
+type ValueMerger interface {
+	// Returns the value which results from applying operands to
+	// existing, existing is nil if the key doesn't exist
+	FullMerge(key, existing []byte, operands [][]byte) ([]byte, error)
+	// Combines operands into one operand,
+	// false if they can't be combined without the value
+	PartialMerge(key []byte, operands [][]byte) ([]byte, bool)
+}
+
+// compactionEntry is an entry which is written into outputs
+type compactionEntry struct {
+	key   []byte
+	value []byte
+}
+
+// Returns a new Compactor.
+// newFileNum is called to allocate a number for each output file.
+// Its methods are *NOT* thread-safe
+func NewCompactor(dbPath string, newFileNum func() uint64) *Compactor {
+	return &Compactor{
+		dbPath:          dbPath,
+		newFileNum:      newFileNum,
+		BitsPerKey:      DefaultBitsPerKey,
+		compactPointers: map[int][]byte{},
+	}
+}
+
+// Returns maximum total file size for given level
+func MaxBytesForLevel(level int) int64 {
+	size := MaxBytesForLevelBase
+	for l := 1; l < level; l++ {
+		size *= LevelSizeMultiplier
+	}
+	return size
+}
+
+func totalFileSize(files []*MetaBlock) int64 {
+	var size int64
+	for _, f := range files {
+		size += f.FileSize
+	}
+	return size
+}
+
+func levelScore(levels [][]*MetaBlock, level int) float64 {
+	if level == 0 {
+		return float64(len(levels[0])) / float64(L0CompactionTrigger)
+	}
+	return float64(totalFileSize(levels[level])) / float64(MaxBytesForLevel(level))
+}
+
+// Returns files in given slice whose user keys overlap with [minKey, maxKey]
+func overlappingFiles(files []*MetaBlock, minKey, maxKey []byte) []*MetaBlock {
+	res := make([]*MetaBlock, 0)
+	for _, f := range files {
+		if CompareUserKeys(*f.MaxKey, minKey) < 0 || CompareUserKeys(*f.MinKey, maxKey) > 0 {
+			continue
+		}
+		res = append(res, f)
+	}
+	return res
+}
+
+// Returns key range covered by all given files
+func keyRange(files []*MetaBlock) ([]byte, []byte) {
+	minKey := *files[0].MinKey
+	maxKey := *files[0].MaxKey
+	for _, f := range files[1:] {
+		if bytes.Compare(*f.MinKey, minKey) < 0 {
+			minKey = *f.MinKey
+		}
+		if bytes.Compare(*f.MaxKey, maxKey) > 0 {
+			maxKey = *f.MaxKey
+		}
+	}
+	return minKey, maxKey
+}
+
+// Picks the level which needs compaction most and its input files.
+// Returns nil if no level needs compaction
+func (c *Compactor) PickCompaction(levels [][]*MetaBlock) *Compaction {
+	bestLevel := -1
+	bestScore := 1.0
+	// last level can't be compacted any further
+	for l := 0; l < len(levels)-1; l++ {
+		score := levelScore(levels, l)
+		if score >= bestScore {
+			bestLevel = l
+			bestScore = score
+		}
+	}
+	if bestLevel == -1 {
+		return nil
+	}
+
+	cm := &Compaction{Level: bestLevel, levels: levels}
+	if bestLevel == 0 {
+		// level-0 files overlap, all of them are compacted together
+		// so that newer versions are never left behind older ones
+		cm.Inputs[0] = append(cm.Inputs[0], levels[0]...)
+	} else {
+		// pick files in round-robin order over the key space
+		files := levels[bestLevel]
+		picked := files[0]
+		if ptr, ok := c.compactPointers[bestLevel]; ok {
+			for _, f := range files {
+				if bytes.Compare(*f.MinKey, ptr) > 0 {
+					picked = f
+					break
+				}
+			}
+		}
+		c.compactPointers[bestLevel] = *picked.MaxKey
+		cm.Inputs[0] = []*MetaBlock{picked}
+	}
+
+	minKey, maxKey := keyRange(cm.Inputs[0])
+	cm.Inputs[1] = overlappingFiles(levels[bestLevel+1], minKey, maxKey)
+	return cm
+}
+
+// Reports whether levels deeper than the output level can't contain the user key
+func (cm *Compaction) isBaseLevelForKey(key []byte) bool {
+	for l := cm.Level + 2; l < len(cm.levels); l++ {
+		for _, f := range cm.levels[l] {
+			if CompareUserKeys(key, *f.MinKey) >= 0 && CompareUserKeys(key, *f.MaxKey) <= 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Reports whether levels deeper than the output level
+// can't contain any user key in [start, end)
+func (cm *Compaction) isBaseLevelForRange(start, end []byte) bool {
+	for l := cm.Level + 2; l < len(cm.levels); l++ {
+		for _, f := range cm.levels[l] {
+			if bytes.Compare(*f.MaxKey, SeekKey(start, MaxSequence)) >= 0 && bytes.Compare(*f.MinKey, SeekKey(end, MaxSequence)) < 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Reports whether all entries of the file are deleted by a tombstone
+// which every snapshot can see
+func (cm *Compaction) isCovered(f *MetaBlock, tombstones *RangeTombstones) bool {
+	for _, t := range tombstones.List() {
+		if t.Seq <= cm.SmallestSnapshot && f.LargestSeq < t.Seq &&
+			bytes.Compare(*f.MinKey, SeekKey(t.Start, MaxSequence)) >= 0 &&
+			bytes.Compare(*f.MaxKey, SeekKey(t.End, MaxSequence)) <= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Merges input files and writes outputs into Level+1.
+// Input files are not removed, see Edit
+func (c *Compactor) Run(cm *Compaction) ([]*MetaBlock, error) {
+	// inputs are ordered from newest to oldest
+	inputs := make([]*MetaBlock, 0, len(cm.Inputs[0])+len(cm.Inputs[1]))
+	for i := len(cm.Inputs[0]) - 1; i >= 0; i-- {
+		inputs = append(inputs, cm.Inputs[0][i])
+	}
+	inputs = append(inputs, cm.Inputs[1]...)
+
+	tables := make([]*SSTable, 0, len(inputs))
+	sets := make([]*RangeTombstones, 0, len(inputs))
+	for _, f := range inputs {
+		table := NewSSTable(c.dbPath, f.FileName)
+		defer table.CloseFile()
+		err := table.ReadFooter()
+		if err != nil {
+			return nil, err
+		}
+		set, err := table.RangeTombstones()
+		if err != nil {
+			return nil, err
+		}
+		tables = append(tables, table)
+		sets = append(sets, set)
+	}
+	tombstones := MergeRangeTombstones(sets...)
+
+	cm.Dropped = nil
+	iters := make([]*SSTableIterator, 0, len(inputs))
+	for i, f := range inputs {
+		if cm.isCovered(f, tombstones) {
+			cm.Dropped = append(cm.Dropped, f)
+			continue
+		}
+		it, err := tables[i].Iterator()
+		if err != nil {
+			return nil, err
+		}
+		iters = append(iters, it)
+	}
+	// tombstones which may still hide versions from a snapshot or
+	// from deeper levels are written into outputs
+	kept := make([]RangeTombstone, 0)
+	for _, t := range tombstones.List() {
+		if t.Seq > cm.SmallestSnapshot || !cm.isBaseLevelForRange(t.Start, t.End) {
+			kept = append(kept, t)
+		}
+	}
+
+	outputs := make([]*MetaBlock, 0)
+	removeOutputs := func() {
+		for _, o := range outputs {
+			_ = os.Remove(path.Join(c.dbPath, o.FileName))
+		}
+	}
+
+	outLevel := cm.Level + 1
+	var w *SSTableWriter
+	var fileNum uint64
+	newWriter := func() error {
+		var err error
+		fileNum = c.newFileNum()
+		w, err = NewSSTableWriter(c.dbPath, TableFileName(outLevel, fileNum))
+		if err != nil {
+			return err
+		}
+		w.Compressor = CompressorForLevel(c.Compressors, outLevel)
+		w.BitsPerKey = c.BitsPerKey
+		return nil
+	}
+	// user key where the current output starts, nil for the first one.
+	// Outputs get parts of the tombstones within their own key range
+	var lower []byte
+	finishOutput := func(upper []byte) error {
+		for _, t := range kept {
+			if clipped, ok := t.Clip(lower, upper); ok {
+				w.AddRangeTombstone(clipped)
+			}
+		}
+		meta, err := w.Finish()
+		if err != nil {
+			return err
+		}
+		meta.FileNum = fileNum
+		outputs = append(outputs, meta)
+		w = nil
+		lower = upper
+		return nil
+	}
+	var lastUserKey []byte
+	// sequence number and kind of the previous version of the current user key
+	var lastSeqForKey uint64
+	var lastKindForKey ValueKind
+	m := newMergeIterator(iters)
+	for m.Next() {
+		ikey, err := ParseInternalKey(m.Key())
+		if err != nil {
+			if w != nil {
+				w.Abandon()
+			}
+			removeOutputs()
+			return nil, err
+		}
+		newUserKey := lastUserKey == nil || !bytes.Equal(encodedUserKey(m.Key()), lastUserKey)
+		if newUserKey {
+			lastUserKey = append(lastUserKey[:0], encodedUserKey(m.Key())...)
+		}
+		key, value := m.Key(), m.Value()
+		if ikey.Kind == KindSet && c.IsExpired != nil && c.IsExpired(value) {
+			// no reader can see the value, it still hides older versions
+			ikey.Kind = KindDelete
+			key = MakeInternalKey(ikey.UserKey, ikey.Seq, KindDelete)
+			value = c.TombstoneValue
+		}
+		drop := false
+		if !newUserKey && lastSeqForKey <= cm.SmallestSnapshot && lastKindForKey != KindMerge {
+			// a newer version of the key is visible to every snapshot
+			drop = true
+		} else if ikey.Kind == KindDelete && ikey.Seq <= cm.SmallestSnapshot && cm.isBaseLevelForKey(key) {
+			drop = true
+		} else if tombstones.Covers(ikey.UserKey, ikey.Seq, cm.SmallestSnapshot) {
+			drop = true
+		}
+		lastSeqForKey = ikey.Seq
+		lastKindForKey = ikey.Kind
+		if drop {
+			continue
+		}
+		entries := []compactionEntry{{key, value}}
+		if ikey.Kind == KindMerge && ikey.Seq <= cm.SmallestSnapshot && c.Merger != nil {
+			entries, err = c.mergeOperands(cm, m, ikey, tombstones)
+			if err != nil {
+				if w != nil {
+					w.Abandon()
+				}
+				removeOutputs()
+				return nil, err
+			}
+		}
+
+		// outputs are cut between user keys, so that
+		// a newer version never ends up in another file
+		if w != nil && newUserKey && w.Size() >= TargetFileSize {
+			err = finishOutput(ikey.UserKey)
+			if err != nil {
+				w.Abandon()
+				removeOutputs()
+				return nil, err
+			}
+		}
+		if w == nil {
+			err = newWriter()
+			if err != nil {
+				removeOutputs()
+				return nil, err
+			}
+		}
+		for _, e := range entries {
+			err = w.Add(e.key, e.value)
+			if err != nil {
+				w.Abandon()
+				removeOutputs()
+				return nil, err
+			}
+		}
+	}
+
+	for _, it := range iters {
+		if it.Err() != nil {
+			if w != nil {
+				w.Abandon()
+			}
+			removeOutputs()
+			return nil, it.Err()
+		}
+	}
+
+	if w == nil && len(kept) > 0 {
+		// inputs have only tombstones left
+		err := newWriter()
+		if err != nil {
+			removeOutputs()
+			return nil, err
+		}
+	}
+	if w != nil {
+		err := finishOutput(nil)
+		if err != nil {
+			w.Abandon()
+			removeOutputs()
+			return nil, err
+		}
+	}
+
+	return outputs, nil
+}
+
+// Returns the version edit which replaces inputs
+// of the compaction with the outputs
+func (cm *Compaction) Edit(outputs []*MetaBlock) *VersionEdit {
+	edit := &VersionEdit{}
+	for i, files := range cm.Inputs {
+		for _, f := range files {
+			edit.DeleteFile(cm.Level+i, f.FileName)
+		}
+	}
+	for _, o := range outputs {
+		edit.AddFile(cm.Level+1, o)
+	}
+	return edit
+}
+
+// Merges the operand at the current entry of m, which every snapshot can
+// see, with older versions of its key down to a value or a deletion.
+// Versions of the key are read, m is left on the last one. Returns the
+// entries which replace them, they are kept as they are if the operands
+// can't be merged, so reads report the error
+func (c *Compactor) mergeOperands(cm *Compaction, m *mergeIterator, first *ParsedKey, tombstones *RangeTombstones) ([]compactionEntry, error) {
+	firstKey := append([]byte{}, m.Key()...)
+	entries := []compactionEntry{{firstKey, append([]byte{}, m.Value()...)}}
+	// newest first
+	operands := [][]byte{entries[0].value}
+	var existing []byte
+	// set once a value or a deletion of the key is read,
+	// older versions are hidden by it
+	complete := false
+	for m.Next() {
+		ikey, err := ParseInternalKey(m.Key())
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(ikey.UserKey, first.UserKey) {
+			m.Unread()
+			break
+		}
+		if complete || tombstones.Covers(ikey.UserKey, ikey.Seq, cm.SmallestSnapshot) {
+			complete = true
+			continue
+		}
+		key, value := append([]byte{}, m.Key()...), append([]byte{}, m.Value()...)
+		if ikey.Kind == KindSet && c.IsExpired != nil && c.IsExpired(value) {
+			ikey.Kind = KindDelete
+			key = MakeInternalKey(ikey.UserKey, ikey.Seq, KindDelete)
+			value = c.TombstoneValue
+		}
+		entries = append(entries, compactionEntry{key, value})
+		switch ikey.Kind {
+		case KindMerge:
+			operands = append(operands, value)
+		case KindSet:
+			existing = value
+			complete = true
+		default:
+			complete = true
+		}
+	}
+	if !complete && cm.isBaseLevelForKey(firstKey) {
+		complete = true
+	}
+
+	for i, j := 0, len(operands)-1; i < j; i, j = i+1, j-1 {
+		operands[i], operands[j] = operands[j], operands[i]
+	}
+	if complete {
+		value, err := c.Merger.FullMerge(first.UserKey, existing, operands)
+		if err == nil {
+			return []compactionEntry{{MakeInternalKey(first.UserKey, first.Seq, KindSet), value}}, nil
+		}
+	} else if len(operands) > 1 {
+		if operand, ok := c.Merger.PartialMerge(first.UserKey, operands); ok {
+			return []compactionEntry{{firstKey, operand}}, nil
+		}
+	}
+	return entries, nil
+}
+
+// Merges sorted iterators into one sorted stream.
+// When more than one iterator has the same key,
+// the value from the iterator with lower index is used.
+type mergeIterator struct {
+	iters []*SSTableIterator
+	valid []bool
+	key   []byte
+	value []byte
+	// set by Unread, Next stays on the current entry
+	unread bool
+}
+
+func newMergeIterator(iters []*SSTableIterator) *mergeIterator {
+	m := &mergeIterator{
+		iters: iters,
+		valid: make([]bool, len(iters)),
+	}
+	for i, it := range iters {
+		m.valid[i] = it.Next()
+	}
+	return m
+}
+
+func (m *mergeIterator) Next() bool {
+	if m.unread {
+		m.unread = false
+		return m.key != nil
+	}
+	idx := -1
+	for i, it := range m.iters {
+		if !m.valid[i] {
+			continue
+		}
+		if idx == -1 || bytes.Compare(it.Key(), m.iters[idx].Key()) < 0 {
+			idx = i
+		}
+	}
+	if idx == -1 {
+		m.key = nil
+		m.value = nil
+		return false
+	}
+	m.key = m.iters[idx].Key()
+	m.value = m.iters[idx].Value()
+
+	// skip shadowed versions of the key
+	for i, it := range m.iters {
+		if m.valid[i] && bytes.Equal(it.Key(), m.key) {
+			m.valid[i] = it.Next()
+		}
+	}
+	return true
+}
+
+// Makes the next call of Next return the current entry again
+func (m *mergeIterator) Unread() {
+	m.unread = true
+}
+
+func (m *mergeIterator) Key() []byte {
+	return m.key
+}
+
+func (m *mergeIterator) Value() []byte {
+	return m.value
+}
@@ -0,0 +1,370 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Saves a table whose keys have the given sequence number,
+// "del" values are saved as tombstones and values which
+// start with "+" as merge operands
+func saveTestTable(t *testing.T, name string, seq uint64, kv ...string) *MetaBlock {
+	l := NewMemTable()
+	for i := 0; i < len(kv); i += 2 {
+		kind := KindSet
+		if kv[i+1] == "del" {
+			kind = KindDelete
+		} else if strings.HasPrefix(kv[i+1], "+") {
+			kind = KindMerge
+		}
+		l.Set(MakeInternalKey([]byte(kv[i]), seq, kind), []byte(kv[i+1]))
+	}
+	w, err := NewSSTableWriter(testPath(), name)
+	assert.Nil(t, err)
+	it := l.Iterator()
+	for it.Next() {
+		assert.Nil(t, w.Add(it.Key(), it.Value()))
+	}
+	meta, err := w.Finish()
+	assert.Nil(t, err)
+	return meta
+}
+
+// Saves a table which has only a range tombstone of [start, end)
+func saveTestRangeTable(t *testing.T, name string, seq uint64, start, end string) *MetaBlock {
+	w, err := NewSSTableWriter(testPath(), name)
+	assert.Nil(t, err)
+	w.AddRangeTombstone(RangeTombstone{Start: []byte(start), End: []byte(end), Seq: seq})
+	meta, err := w.Finish()
+	assert.Nil(t, err)
+	return meta
+}
+
+// Returns range tombstones of the table
+func readTestRanges(t *testing.T, name string) []RangeTombstone {
+	table := NewSSTable(testPath(), name)
+	defer table.CloseFile()
+	assert.Nil(t, table.ReadFooter())
+	set, err := table.RangeTombstones()
+	assert.Nil(t, err)
+	return set.List()
+}
+
+// Returns the newest version of each key in the table
+func readTestTable(t *testing.T, name string) map[string]string {
+	res := map[string]string{}
+	for _, v := range readTestVersions(t, name) {
+		if _, ok := res[v.key]; !ok {
+			res[v.key] = v.value
+		}
+	}
+	return res
+}
+
+type testVersion struct {
+	key   string
+	seq   uint64
+	value string
+}
+
+// Returns all versions in the table in order
+func readTestVersions(t *testing.T, name string) []testVersion {
+	res := make([]testVersion, 0)
+	table := NewSSTable(testPath(), name)
+	defer table.CloseFile()
+	it, err := table.Iterator()
+	assert.Nil(t, err)
+	for it.Next() {
+		ikey, err := ParseInternalKey(it.Key())
+		assert.Nil(t, err)
+		res = append(res, testVersion{string(ikey.UserKey), ikey.Seq, string(it.Value())})
+	}
+	assert.Nil(t, it.Err())
+	return res
+}
+
+func newTestCompactor() *Compactor {
+	num := uint64(100)
+	return NewCompactor(testPath(), func() uint64 {
+		num++
+		return num
+	})
+}
+
+func TestCompactor_PickCompaction(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+	c := newTestCompactor()
+
+	levels := [][]*MetaBlock{{}, {}, {}}
+	for i := 0; i < L0CompactionTrigger-1; i++ {
+		levels[0] = append(levels[0], saveTestTable(t, fmt.Sprintf("0_%v.db", i), uint64(i+3), "a", "1", "c", "1"))
+	}
+	levels[1] = append(levels[1],
+		saveTestTable(t, "1_10.db", 1, "a", "0", "b", "0"),
+		saveTestTable(t, "1_11.db", 2, "x", "0", "z", "0"))
+	assert.Nil(t, c.PickCompaction(levels))
+
+	levels[0] = append(levels[0], saveTestTable(t, "0_3.db", 10, "b", "2"))
+	cm := c.PickCompaction(levels)
+	assert.NotNil(t, cm)
+	assert.Equal(t, 0, cm.Level)
+	assert.Equal(t, L0CompactionTrigger, len(cm.Inputs[0]))
+	assert.Equal(t, 1, len(cm.Inputs[1]))
+	assert.Equal(t, "1_10.db", cm.Inputs[1][0].FileName)
+}
+
+func TestCompactor_Run(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+	c := newTestCompactor()
+
+	levels := [][]*MetaBlock{{}, {}, {}}
+	levels[0] = append(levels[0],
+		saveTestTable(t, "0_0.db", 3, "a", "a0", "b", "b0", "c", "c0"),
+		saveTestTable(t, "0_1.db", 4, "a", "a1", "d", "d1"),
+		saveTestTable(t, "0_2.db", 5, "b", "del", "e", "e2"),
+		saveTestTable(t, "0_3.db", 6, "a", "a3", "f", "del"))
+	levels[1] = append(levels[1], saveTestTable(t, "1_4.db", 2, "c", "old", "g", "g4"))
+	levels[2] = append(levels[2], saveTestTable(t, "2_5.db", 1, "f", "f5"))
+
+	cm := c.PickCompaction(levels)
+	assert.NotNil(t, cm)
+	cm.SmallestSnapshot = 6
+	outputs, err := c.Run(cm)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(outputs))
+
+	// "b" is dropped since no deeper level has it,
+	// "f" tombstone is kept since level 2 has an older version
+	assert.Equal(t, map[string]string{
+		"a": "a3",
+		"c": "c0",
+		"d": "d1",
+		"e": "e2",
+		"f": "del",
+		"g": "g4",
+	}, readTestTable(t, outputs[0].FileName))
+	assert.Equal(t, 6, len(readTestVersions(t, outputs[0].FileName)))
+
+	edit := cm.Edit(outputs)
+	assert.Equal(t, 5, len(edit.DeletedFiles))
+	res := edit.Apply(levels)
+	assert.Equal(t, 0, len(res[0]))
+	assert.Equal(t, outputs, res[1])
+	assert.Equal(t, levels[2], res[2])
+	// original levels are not modified
+	assert.Equal(t, 4, len(levels[0]))
+}
+
+func TestCompactor_RunSplitsOutputs(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+	c := newTestCompactor()
+
+	value := string(bytes.Repeat([]byte{'v'}, 1024))
+	kv := make([]string, 0)
+	count := int(2*TargetFileSize/1024) + 10
+	for i := 0; i < count; i++ {
+		kv = append(kv, fmt.Sprintf("k%08d", i), value)
+	}
+	levels := [][]*MetaBlock{{saveTestTable(t, "0_0.db", 1, kv...)}, {}}
+	cm := &Compaction{Level: 0, SmallestSnapshot: 1, levels: levels}
+	cm.Inputs[0] = levels[0]
+
+	outputs, err := c.Run(cm)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(outputs))
+
+	res := cm.Edit(outputs).Apply(levels)
+	var keyCount int64
+	for i, f := range res[1] {
+		keyCount += f.KeyCount
+		if i > 0 {
+			assert.True(t, bytes.Compare(*res[1][i-1].MaxKey, *f.MinKey) < 0)
+		}
+	}
+	assert.Equal(t, int64(count), keyCount)
+}
+
+func TestCompactor_RunKeepsSnapshotVersions(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+	c := newTestCompactor()
+
+	levels := [][]*MetaBlock{{}, {}, {}}
+	levels[0] = append(levels[0],
+		saveTestTable(t, "0_0.db", 1, "a", "a1", "b", "b1"),
+		saveTestTable(t, "0_1.db", 2, "a", "a2", "b", "del"),
+		saveTestTable(t, "0_2.db", 3, "a", "a3"),
+		saveTestTable(t, "0_3.db", 4, "a", "a4"))
+
+	// snapshot at 2 sees a2 and the tombstone of b
+	cm := c.PickCompaction(levels)
+	assert.NotNil(t, cm)
+	cm.SmallestSnapshot = 2
+	outputs, err := c.Run(cm)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(outputs))
+	assert.Equal(t, []testVersion{
+		{"a", 4, "a4"},
+		{"a", 3, "a3"},
+		{"a", 2, "a2"},
+	}, readTestVersions(t, outputs[0].FileName))
+}
+
+func TestCompactor_RunRangeTombstones(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+	c := newTestCompactor()
+
+	levels := [][]*MetaBlock{{}, {}, {}}
+	levels[0] = append(levels[0],
+		saveTestTable(t, "0_0.db", 1, "a", "a1", "b", "b1", "e", "e1"),
+		saveTestTable(t, "0_1.db", 2, "c", "c2", "d", "d2"),
+		saveTestRangeTable(t, "0_2.db", 3, "b", "d"),
+		saveTestTable(t, "0_3.db", 4, "b", "b4"))
+	levels[2] = append(levels[2], saveTestTable(t, "2_4.db", 1, "c", "old"))
+
+	cm := c.PickCompaction(levels)
+	assert.NotNil(t, cm)
+	cm.SmallestSnapshot = 4
+	outputs, err := c.Run(cm)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(outputs))
+
+	// versions older than the tombstone are dropped, the tombstone
+	// is kept since level 2 has an older version of "c"
+	assert.Equal(t, []testVersion{
+		{"a", 1, "a1"},
+		{"b", 4, "b4"},
+		{"d", 2, "d2"},
+		{"e", 1, "e1"},
+	}, readTestVersions(t, outputs[0].FileName))
+	assert.Equal(t, []RangeTombstone{
+		{Start: []byte("b"), End: []byte("d"), Seq: 3},
+	}, readTestRanges(t, outputs[0].FileName))
+}
+
+func TestCompactor_RunDropsCoveredFiles(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+	c := newTestCompactor()
+
+	levels := [][]*MetaBlock{{}, {}}
+	levels[0] = append(levels[0],
+		saveTestTable(t, "0_0.db", 1, "b", "b1", "c", "c1"),
+		saveTestTable(t, "0_1.db", 2, "x", "x2"),
+		saveTestRangeTable(t, "0_2.db", 3, "a", "d"),
+		saveTestRangeTable(t, "0_3.db", 4, "w", "y"))
+	cm := c.PickCompaction(levels)
+	assert.NotNil(t, cm)
+
+	// a snapshot older than the tombstone at "w" still sees "x"
+	cm.SmallestSnapshot = 3
+	outputs, err := c.Run(cm)
+	assert.Nil(t, err)
+	assert.Equal(t, []*MetaBlock{levels[0][0]}, cm.Dropped)
+	assert.Equal(t, 1, len(outputs))
+	assert.Equal(t, []testVersion{{"x", 2, "x2"}}, readTestVersions(t, outputs[0].FileName))
+	assert.Equal(t, []RangeTombstone{
+		{Start: []byte("w"), End: []byte("y"), Seq: 4},
+	}, readTestRanges(t, outputs[0].FileName))
+
+	// nothing is left once every snapshot sees both tombstones
+	cm.SmallestSnapshot = 4
+	outputs, err = c.Run(cm)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(cm.Dropped))
+	assert.Equal(t, 0, len(outputs))
+	assert.Equal(t, 4, len(cm.Edit(outputs).DeletedFiles))
+}
+
+func TestCompactor_RunDropsExpiredValues(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+	c := newTestCompactor()
+	c.IsExpired = func(value []byte) bool {
+		return string(value) == "expired"
+	}
+	c.TombstoneValue = []byte("del")
+
+	levels := [][]*MetaBlock{{}, {}, {}}
+	levels[0] = append(levels[0],
+		saveTestTable(t, "0_0.db", 1, "a", "a1", "b", "b1"),
+		saveTestTable(t, "0_1.db", 2, "a", "expired", "b", "expired", "c", "expired"))
+	levels[2] = append(levels[2], saveTestTable(t, "2_2.db", 1, "b", "old"))
+
+	cm := &Compaction{Level: 0, SmallestSnapshot: 2, levels: levels}
+	cm.Inputs[0] = levels[0]
+	outputs, err := c.Run(cm)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(outputs))
+
+	// "b" is kept as a tombstone since level 2 has an older version
+	assert.Equal(t, []testVersion{{"b", 2, "del"}}, readTestVersions(t, outputs[0].FileName))
+	assert.Equal(t, int64(1), outputs[0].DeletionCount)
+}
+
+// testMerger concatenates operands without their "+" prefix,
+// operands which start with "+!" can't be merged
+type testMerger struct{}
+
+func (testMerger) FullMerge(key, existing []byte, operands [][]byte) ([]byte, error) {
+	value := string(existing)
+	for _, op := range operands {
+		if strings.HasPrefix(string(op), "+!") {
+			return nil, fmt.Errorf("invalid operand")
+		}
+		value += string(op[1:])
+	}
+	return []byte(value), nil
+}
+
+func (testMerger) PartialMerge(key []byte, operands [][]byte) ([]byte, bool) {
+	value := "+"
+	for _, op := range operands {
+		if strings.HasPrefix(string(op), "+!") {
+			return nil, false
+		}
+		value += string(op[1:])
+	}
+	return []byte(value), true
+}
+
+func TestCompactor_RunMergesOperands(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+	c := newTestCompactor()
+	c.Merger = testMerger{}
+
+	levels := [][]*MetaBlock{{}, {}, {}}
+	levels[0] = append(levels[0],
+		saveTestTable(t, "0_0.db", 1, "a", "a", "b", "+b1", "c", "+c1", "d", "+!d1"),
+		saveTestTable(t, "0_1.db", 2, "a", "+a2", "b", "+b2", "c", "+c2", "d", "+d2"),
+		saveTestTable(t, "0_2.db", 3, "a", "+a3", "b", "+b3"))
+	levels[2] = append(levels[2], saveTestTable(t, "2_3.db", 1, "c", "c"))
+
+	cm := &Compaction{Level: 0, SmallestSnapshot: 2, levels: levels}
+	cm.Inputs[0] = levels[0]
+	outputs, err := c.Run(cm)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(outputs))
+
+	// operands newer than the snapshot are kept, "a" and "b" are merged
+	// since no deeper level has them, operands of "c" are combined since
+	// level 2 has a value and operands of "d" can't be combined
+	assert.Equal(t, []testVersion{
+		{"a", 3, "+a3"},
+		{"a", 2, "aa2"},
+		{"b", 3, "+b3"},
+		{"b", 2, "b1b2"},
+		{"c", 2, "+c1c2"},
+		{"d", 2, "+d2"},
+		{"d", 1, "+!d1"},
+	}, readTestVersions(t, outputs[0].FileName))
+}
@@ -0,0 +1,126 @@
+package internal
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"io"
+	"sync"
+)
+
+// CompressionType is stored after each block of a table, so readers
+// can find the Compressor which decompresses the block
+type CompressionType uint8
+
+const (
+	CompressionNone CompressionType = 0
+	CompressionZlib CompressionType = 1
+)
+
+var ErrUnknownCompression = errors.New("unknown compression type")
+
+// Compressor compresses blocks of tables. Compressors of custom types
+// must be registered by RegisterCompressor before tables are read
+type Compressor interface {
+	// Type must be unique among compressors
+	Type() CompressionType
+	Compress(src []byte) ([]byte, error)
+	Decompress(src []byte) ([]byte, error)
+}
+
+type noCompressor struct{}
+
+// Leaves blocks uncompressed
+var NoCompressor Compressor = noCompressor{}
+
+func (noCompressor) Type() CompressionType {
+	return CompressionNone
+}
+
+func (noCompressor) Compress(src []byte) ([]byte, error) {
+	return src, nil
+}
+
+func (noCompressor) Decompress(src []byte) ([]byte, error) {
+	return src, nil
+}
+
+type zlibCompressor struct {
+	level int
+}
+
+// Compresses blocks with zlib at its default level
+var ZlibCompressor Compressor = NewZlibCompressor(zlib.DefaultCompression)
+
+// Returns a zlib Compressor of given level, see compress/zlib for levels
+func NewZlibCompressor(level int) Compressor {
+	return &zlibCompressor{level: level}
+}
+
+func (z *zlibCompressor) Type() CompressionType {
+	return CompressionZlib
+}
+
+func (z *zlibCompressor) Compress(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := zlib.NewWriterLevel(&buf, z.level)
+	if err != nil {
+		return nil, err
+	}
+	_, err = w.Write(src)
+	if err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (z *zlibCompressor) Decompress(src []byte) ([]byte, error) {
+	r, err := zlib.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+var compressors = struct {
+	sync.RWMutex
+	types map[CompressionType]Compressor
+}{types: map[CompressionType]Compressor{
+	CompressionNone: NoCompressor,
+	CompressionZlib: ZlibCompressor,
+}}
+
+// Registers c to decompress blocks of its type, it replaces
+// the compressor which is registered for the same type
+func RegisterCompressor(c Compressor) {
+	compressors.Lock()
+	defer compressors.Unlock()
+	compressors.types[c.Type()] = c
+}
+
+func compressorOf(t CompressionType) (Compressor, error) {
+	compressors.RLock()
+	defer compressors.RUnlock()
+	c, ok := compressors.types[t]
+	if !ok {
+		return nil, ErrUnknownCompression
+	}
+	return c, nil
+}
+
+// Returns compressor of level, the last compressor is used for deeper levels.
+// Blocks aren't compressed if there is no compressor
+func CompressorForLevel(levelCompressors []Compressor, level int) Compressor {
+	if len(levelCompressors) == 0 {
+		return NoCompressor
+	}
+	if level >= len(levelCompressors) {
+		return levelCompressors[len(levelCompressors)-1]
+	}
+	return levelCompressors[level]
+}
@@ -1,8 +1,29 @@
 package internal
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 var (
 	ErrIndexNotFound  = errors.New("index not found")
 	ErrIndexReadError = errors.New("index read error")
+	ErrEmptyTable     = errors.New("sstable has no keys")
+	ErrCorruption     = errors.New("sstable is corrupted")
 )
+
+// CorruptionError reports a damaged block of an sstable,
+// errors.Is matches it with ErrCorruption
+type CorruptionError struct {
+	File   string
+	Offset int64
+	Reason string
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("%v: %s at offset %d of %s", ErrCorruption, e.Reason, e.Offset, e.File)
+}
+
+func (e *CorruptionError) Unwrap() error {
+	return ErrCorruption
+}
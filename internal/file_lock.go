@@ -0,0 +1,16 @@
+package internal
+
+import (
+	"errors"
+	"os"
+)
+
+// Name of the file which is locked while a database is open
+const LockFileName = "LOCK"
+
+var ErrLocked = errors.New("database is locked by another process")
+
+// FileLock is an advisory lock on a file which is held until Release
+type FileLock struct {
+	file *os.File
+}
@@ -0,0 +1,20 @@
+//go:build !unix
+
+package internal
+
+import "os"
+
+// Creates the file at path. Advisory locks aren't supported
+// on this platform, so the file isn't locked
+func LockFile(path string) (*FileLock, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileLock{file: f}, nil
+}
+
+// Closes the file
+func (l *FileLock) Release() error {
+	return l.file.Close()
+}
@@ -0,0 +1,37 @@
+//go:build unix
+
+package internal
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// Takes an exclusive advisory lock on the file at path, the file is created
+// if it doesn't exist. Returns ErrLocked if the lock is held by another
+// process or by another open database of this process
+func LockFile(path string) (*FileLock, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		_ = f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, ErrLocked
+		}
+		return nil, err
+	}
+	return &FileLock{file: f}, nil
+}
+
+// Releases the lock and closes the file
+func (l *FileLock) Release() error {
+	err := syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+	if cErr := l.file.Close(); err == nil {
+		err = cErr
+	}
+	return err
+}
@@ -0,0 +1,113 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+//
+//	Internal Keys
+//
+//	Every write gets a sequence number and is stored under an internal key
+//	made of the user key, the sequence number and the kind of the write.
+//	Internal keys are encoded so that plain bytes.Compare orders them by
+//	user key ascending and then by sequence number descending, so newer
+//	versions of a key come first.
+//
+//   ---------------------------------------------------------------
+//  | Escaped User Key | 0x00 0x00 | ^(Sequence << 8 | Kind) (8-bytes) |
+//   ---------------------------------------------------------------
+//
+//	0x00 bytes of the user key are escaped as 0x00 0x01, so the 0x00 0x00
+//	terminator sorts before any byte which can follow in a longer user key.
+//
+
+type ValueKind uint8
+
+const (
+	KindDelete ValueKind = 0
+	KindSet    ValueKind = 1
+	// Merge operands are combined with older versions of the key by reads
+	KindMerge ValueKind = 2
+	// Used in seek keys, it sorts before other kinds of the same sequence
+	kindSeek ValueKind = 0xff
+)
+
+// Largest sequence number which fits into an internal key
+const MaxSequence uint64 = 1<<56 - 1
+
+const internalKeyTrailerSize = 8
+
+var ErrInvalidInternalKey = errors.New("invalid internal key")
+
+type ParsedKey struct {
+	UserKey []byte
+	Seq     uint64
+	Kind    ValueKind
+}
+
+func MakeInternalKey(userKey []byte, seq uint64, kind ValueKind) []byte {
+	key := make([]byte, 0, len(userKey)+2+internalKeyTrailerSize+bytes.Count(userKey, []byte{0}))
+	for _, b := range userKey {
+		key = append(key, b)
+		if b == 0 {
+			key = append(key, 1)
+		}
+	}
+	key = append(key, 0, 0)
+	return binary.BigEndian.AppendUint64(key, ^(seq<<8 | uint64(kind)))
+}
+
+// Returns the smallest internal key of userKey which is visible at seq
+func SeekKey(userKey []byte, seq uint64) []byte {
+	return MakeInternalKey(userKey, seq, kindSeek)
+}
+
+func ParseInternalKey(key []byte) (*ParsedKey, error) {
+	n := len(key) - internalKeyTrailerSize
+	if n < 2 || key[n-2] != 0 || key[n-1] != 0 {
+		return nil, ErrInvalidInternalKey
+	}
+	userKey := make([]byte, 0, n-2)
+	for i := 0; i < n-2; i++ {
+		userKey = append(userKey, key[i])
+		if key[i] == 0 {
+			i++
+			if key[i] != 1 {
+				return nil, ErrInvalidInternalKey
+			}
+		}
+	}
+	trailer := ^binary.BigEndian.Uint64(key[n:])
+	return &ParsedKey{
+		UserKey: userKey,
+		Seq:     trailer >> 8,
+		Kind:    ValueKind(trailer & 0xff),
+	}, nil
+}
+
+// Returns sequence number and kind of an internal key without decoding
+// its user key, false if key isn't an internal key
+func parseTrailer(key []byte) (uint64, ValueKind, bool) {
+	n := len(key) - internalKeyTrailerSize
+	if n < 2 || key[n-2] != 0 || key[n-1] != 0 {
+		return 0, 0, false
+	}
+	trailer := ^binary.BigEndian.Uint64(key[n:])
+	return trailer >> 8, ValueKind(trailer & 0xff), true
+}
+
+// Returns the encoded user key part of an internal key,
+// it keeps the order of user keys
+func encodedUserKey(key []byte) []byte {
+	if len(key) < internalKeyTrailerSize {
+		return key
+	}
+	return key[:len(key)-internalKeyTrailerSize]
+}
+
+// Compares user keys of two internal keys
+func CompareUserKeys(a, b []byte) int {
+	return bytes.Compare(encodedUserKey(a), encodedUserKey(b))
+}
@@ -0,0 +1,274 @@
+package internal
+
+import (
+	"bytes"
+	"sort"
+)
+
+// SeekIterator is a positioned iterator which can move in both directions.
+// Key, Value, Next and Prev must only be called when Valid returns true.
+// A new iterator is not positioned until one of the seek methods is called
+type SeekIterator interface {
+	Valid() bool
+	SeekToFirst()
+	SeekToLast()
+	// Positions at the first key which is >= key
+	Seek(key []byte)
+	Next()
+	Prev()
+	Key() []byte
+	Value() []byte
+	Err() error
+	Close() error
+}
+
+const (
+	dirForward = iota
+	dirReverse
+)
+
+// mergingIterator merges sorted iterators into one sorted stream.
+// Keys are unique within each child; when more than one child has
+// the same key, the child with the lower index wins and the others
+// are skipped, so children must be ordered from newest to oldest
+type mergingIterator struct {
+	children  []SeekIterator
+	current   SeekIterator
+	direction int
+}
+
+func NewMergingIterator(children []SeekIterator) SeekIterator {
+	return &mergingIterator{children: children}
+}
+
+func (m *mergingIterator) Valid() bool {
+	return m.current != nil
+}
+
+func (m *mergingIterator) SeekToFirst() {
+	for _, c := range m.children {
+		c.SeekToFirst()
+	}
+	m.direction = dirForward
+	m.findSmallest()
+}
+
+func (m *mergingIterator) SeekToLast() {
+	for _, c := range m.children {
+		c.SeekToLast()
+	}
+	m.direction = dirReverse
+	m.findLargest()
+}
+
+func (m *mergingIterator) Seek(key []byte) {
+	for _, c := range m.children {
+		c.Seek(key)
+	}
+	m.direction = dirForward
+	m.findSmallest()
+}
+
+func (m *mergingIterator) Next() {
+	key := m.current.Key()
+	if m.direction != dirForward {
+		// children are positioned before key, move them to key or after
+		for _, c := range m.children {
+			c.Seek(key)
+		}
+		m.direction = dirForward
+	}
+	for _, c := range m.children {
+		if c.Valid() && bytes.Equal(c.Key(), key) {
+			c.Next()
+		}
+	}
+	m.findSmallest()
+}
+
+func (m *mergingIterator) Prev() {
+	key := m.current.Key()
+	if m.direction != dirReverse {
+		// children are positioned at key or after, move them before key
+		for _, c := range m.children {
+			c.Seek(key)
+			if c.Valid() {
+				c.Prev()
+			} else if c.Err() == nil {
+				c.SeekToLast()
+			}
+		}
+		m.direction = dirReverse
+	} else {
+		for _, c := range m.children {
+			if c.Valid() && bytes.Equal(c.Key(), key) {
+				c.Prev()
+			}
+		}
+	}
+	m.findLargest()
+}
+
+func (m *mergingIterator) findSmallest() {
+	m.current = nil
+	for _, c := range m.children {
+		if c.Valid() && (m.current == nil || bytes.Compare(c.Key(), m.current.Key()) < 0) {
+			m.current = c
+		}
+	}
+}
+
+func (m *mergingIterator) findLargest() {
+	m.current = nil
+	for _, c := range m.children {
+		if c.Valid() && (m.current == nil || bytes.Compare(c.Key(), m.current.Key()) > 0) {
+			m.current = c
+		}
+	}
+}
+
+func (m *mergingIterator) Key() []byte {
+	return m.current.Key()
+}
+
+func (m *mergingIterator) Value() []byte {
+	return m.current.Value()
+}
+
+func (m *mergingIterator) Err() error {
+	for _, c := range m.children {
+		if err := c.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *mergingIterator) Close() error {
+	var err error
+	for _, c := range m.children {
+		if cErr := c.Close(); cErr != nil && err == nil {
+			err = cErr
+		}
+	}
+	return err
+}
+
+// levelIterator concatenates iterators of non-overlapping
+// files of a level, files must be ordered by key range
+type levelIterator struct {
+	files []*MetaBlock
+	iters []SeekIterator
+	idx   int
+}
+
+func NewLevelIterator(files []*MetaBlock, iters []SeekIterator) SeekIterator {
+	return &levelIterator{files: files, iters: iters, idx: len(iters)}
+}
+
+func (l *levelIterator) Valid() bool {
+	return l.idx >= 0 && l.idx < len(l.iters) && l.iters[l.idx].Valid()
+}
+
+func (l *levelIterator) SeekToFirst() {
+	l.idx = 0
+	if l.idx < len(l.iters) {
+		l.iters[l.idx].SeekToFirst()
+	}
+	l.skipForward()
+}
+
+func (l *levelIterator) SeekToLast() {
+	l.idx = len(l.iters) - 1
+	if l.idx >= 0 {
+		l.iters[l.idx].SeekToLast()
+	}
+	l.skipBackward()
+}
+
+func (l *levelIterator) Seek(key []byte) {
+	l.idx = sort.Search(len(l.files), func(i int) bool {
+		return bytes.Compare(*l.files[i].MaxKey, key) >= 0
+	})
+	if l.idx < len(l.iters) {
+		l.iters[l.idx].Seek(key)
+	}
+	l.skipForward()
+}
+
+func (l *levelIterator) Next() {
+	l.iters[l.idx].Next()
+	l.skipForward()
+}
+
+func (l *levelIterator) Prev() {
+	l.iters[l.idx].Prev()
+	l.skipBackward()
+}
+
+func (l *levelIterator) skipForward() {
+	for l.idx < len(l.iters) && !l.iters[l.idx].Valid() {
+		if l.iters[l.idx].Err() != nil {
+			return
+		}
+		l.idx++
+		if l.idx < len(l.iters) {
+			l.iters[l.idx].SeekToFirst()
+		}
+	}
+}
+
+func (l *levelIterator) skipBackward() {
+	for l.idx >= 0 && !l.iters[l.idx].Valid() {
+		if l.iters[l.idx].Err() != nil {
+			return
+		}
+		l.idx--
+		if l.idx >= 0 {
+			l.iters[l.idx].SeekToLast()
+		}
+	}
+}
+
+func (l *levelIterator) Key() []byte {
+	return l.iters[l.idx].Key()
+}
+
+func (l *levelIterator) Value() []byte {
+	return l.iters[l.idx].Value()
+}
+
+func (l *levelIterator) Err() error {
+	for _, it := range l.iters {
+		if err := it.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *levelIterator) Close() error {
+	var err error
+	for _, it := range l.iters {
+		if cErr := it.Close(); cErr != nil && err == nil {
+			err = cErr
+		}
+	}
+	return err
+}
+
+// Returns value and sequence number of the newest version of the user key
+// in lookup which is visible at the sequence number of lookup.
+// lookup must be made by SeekKey
+func Lookup(it SeekIterator, lookup []byte) ([]byte, uint64, bool, error) {
+	it.Seek(lookup)
+	if !it.Valid() || CompareUserKeys(it.Key(), lookup) != 0 {
+		return nil, 0, false, it.Err()
+	}
+	seq, _, _ := parseTrailer(it.Key())
+	val := it.Value()
+	if err := it.Err(); err != nil {
+		return nil, 0, false, err
+	}
+	return val, seq, true, nil
+}
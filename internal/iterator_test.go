@@ -0,0 +1,107 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testMemTable(kv ...string) MemTable {
+	m := NewMemTable()
+	for i := 0; i < len(kv); i += 2 {
+		m.Set([]byte(kv[i]), []byte(kv[i+1]))
+	}
+	return m
+}
+
+// Saves a table with the keys as given, keys must be in order
+func saveRawTestTable(t *testing.T, name string, kv ...string) *MetaBlock {
+	w, err := NewSSTableWriter(testPath(), name)
+	assert.Nil(t, err)
+	for i := 0; i < len(kv); i += 2 {
+		assert.Nil(t, w.Add([]byte(kv[i]), []byte(kv[i+1])))
+	}
+	meta, err := w.Finish()
+	assert.Nil(t, err)
+	return meta
+}
+
+func collectForward(it SeekIterator) []string {
+	res := []string{}
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		res = append(res, string(it.Key())+"="+string(it.Value()))
+	}
+	return res
+}
+
+func collectBackward(it SeekIterator) []string {
+	res := []string{}
+	for it.SeekToLast(); it.Valid(); it.Prev() {
+		res = append(res, string(it.Key())+"="+string(it.Value()))
+	}
+	return res
+}
+
+func TestMergingIterator(t *testing.T) {
+	it := NewMergingIterator([]SeekIterator{
+		testMemTable("b", "new", "e", "new").SeekIterator(),
+		testMemTable("a", "mid", "b", "mid", "d", "mid").SeekIterator(),
+		testMemTable("a", "old", "c", "old", "e", "old").SeekIterator(),
+	})
+	defer it.Close()
+
+	want := []string{"a=mid", "b=new", "c=old", "d=mid", "e=new"}
+	assert.Equal(t, want, collectForward(it))
+	reversed := []string{"e=new", "d=mid", "c=old", "b=new", "a=mid"}
+	assert.Equal(t, reversed, collectBackward(it))
+
+	// switching directions
+	it.Seek([]byte("c"))
+	assert.Equal(t, []byte("c"), it.Key())
+	it.Prev()
+	assert.Equal(t, []byte("b"), it.Key())
+	assert.Equal(t, []byte("new"), it.Value())
+	it.Next()
+	assert.Equal(t, []byte("c"), it.Key())
+	it.Next()
+	assert.Equal(t, []byte("d"), it.Key())
+	it.Prev()
+	it.Prev()
+	assert.Equal(t, []byte("b"), it.Key())
+	it.Prev()
+	it.Prev()
+	assert.False(t, it.Valid())
+	assert.Nil(t, it.Err())
+}
+
+func TestLevelIterator(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	files := []*MetaBlock{
+		saveRawTestTable(t, "1_1.db", "a", "1", "b", "1"),
+		saveRawTestTable(t, "1_2.db", "d", "2", "e", "2"),
+		saveRawTestTable(t, "1_3.db", "g", "3"),
+	}
+	iters := []SeekIterator{}
+	for _, f := range files {
+		it, err := NewSSTable(testPath(), f.FileName).SeekIterator()
+		assert.Nil(t, err)
+		iters = append(iters, it)
+	}
+	it := NewLevelIterator(files, iters)
+	defer it.Close()
+
+	assert.Equal(t, []string{"a=1", "b=1", "d=2", "e=2", "g=3"}, collectForward(it))
+	assert.Equal(t, []string{"g=3", "e=2", "d=2", "b=1", "a=1"}, collectBackward(it))
+
+	it.Seek([]byte("c"))
+	assert.Equal(t, []byte("d"), it.Key())
+	it.Prev()
+	assert.Equal(t, []byte("b"), it.Key())
+	it.Seek([]byte("f"))
+	assert.Equal(t, []byte("g"), it.Key())
+	it.Seek([]byte("h"))
+	assert.False(t, it.Valid())
+	assert.Nil(t, it.Err())
+}
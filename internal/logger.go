@@ -0,0 +1,7 @@
+package internal
+
+// Logger receives errors which can't be returned to callers,
+// such as failures of background work. *log.Logger implements it
+type Logger interface {
+	Printf(format string, v ...any)
+}
@@ -0,0 +1,510 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/emin/spacedb/helpers"
+	"github.com/emin/spacedb/internal/wal"
+)
+
+//
+//	MANIFEST
+//
+//	MANIFEST-N files are logs of version edits, written with the same block
+//	format as WAL files. Each record is an encoded VersionEdit. Replaying all
+//	edits in order rebuilds the set of sstables on each level.
+//	CURRENT file contains the name of the MANIFEST which is in use.
+//
+//     Version Edit
+//   -----------------------------------------------------------------
+//  | Tag (1-byte) | Field | Tag (1-byte) | Field | .... |
+//   -----------------------------------------------------------------
+//
+//   Log Number, Next File Number, Last Sequence: uint64 (8-bytes)
+//   WAL files whose number is less than Log Number are flushed. Log Number
+//   was written with tag 1 before WAL file numbers were kept across restarts,
+//   it is ignored since it doesn't tell which WAL files are flushed
+//   Deleted File: Level (4-bytes) | File Name Len (4-bytes) | File Name
+//   New File: Level (4-bytes) | File Number (8-bytes) | File Size (8-bytes) | Key Count (8-bytes) |
+//             Deletion Count (8-bytes) | Largest Seq (8-bytes) | File Name Len (4-bytes) | File Name |
+//             Min Key Len (4-bytes) | Min Key | Max Key Len (4-bytes) | Max Key
+//   New File was written with tag 5 without Deletion Count and Largest Seq, and with
+//   tag 7 without Largest Seq. Largest Seq of those files is unknown
+//
+
+// Default number of levels
+const NumLevels = 7
+
+const currentFileName = "CURRENT"
+
+const (
+	tagLegacyLogNumber byte = 1
+	tagNextFileNum     byte = 2
+	tagLastSequence    byte = 3
+	tagDeletedFile     byte = 4
+	tagLegacyNewFile   byte = 5
+	tagLogNumber       byte = 6
+	tagNewFileV2       byte = 7
+	tagNewFile         byte = 8
+)
+
+var ErrCorruptManifest = errors.New("manifest is corrupted")
+
+type DeletedFile struct {
+	Level    int
+	FileName string
+}
+
+type NewFile struct {
+	Level int
+	Meta  *MetaBlock
+}
+
+// VersionEdit is a change on the set of sstables.
+// Counters are filled by VersionSet when the edit is logged
+type VersionEdit struct {
+	LogNumber    uint64
+	NextFileNum  uint64
+	LastSequence uint64
+	DeletedFiles []DeletedFile
+	NewFiles     []NewFile
+}
+
+func (e *VersionEdit) AddFile(level int, meta *MetaBlock) {
+	e.NewFiles = append(e.NewFiles, NewFile{Level: level, Meta: meta})
+}
+
+func (e *VersionEdit) DeleteFile(level int, fileName string) {
+	e.DeletedFiles = append(e.DeletedFiles, DeletedFile{Level: level, FileName: fileName})
+}
+
+func (e *VersionEdit) Encode() []byte {
+	buf := &bytes.Buffer{}
+	buf.WriteByte(tagLogNumber)
+	_ = helpers.WriteUint64(buf, e.LogNumber)
+	buf.WriteByte(tagNextFileNum)
+	_ = helpers.WriteUint64(buf, e.NextFileNum)
+	buf.WriteByte(tagLastSequence)
+	_ = helpers.WriteUint64(buf, e.LastSequence)
+	for _, d := range e.DeletedFiles {
+		buf.WriteByte(tagDeletedFile)
+		_ = helpers.WriteUint32(buf, uint32(d.Level))
+		_ = helpers.WriteSlice(buf, []byte(d.FileName))
+	}
+	for _, f := range e.NewFiles {
+		buf.WriteByte(tagNewFile)
+		_ = helpers.WriteUint32(buf, uint32(f.Level))
+		_ = helpers.WriteUint64(buf, f.Meta.FileNum)
+		_ = helpers.WriteUint64(buf, uint64(f.Meta.FileSize))
+		_ = helpers.WriteUint64(buf, uint64(f.Meta.KeyCount))
+		_ = helpers.WriteUint64(buf, uint64(f.Meta.DeletionCount))
+		_ = helpers.WriteUint64(buf, f.Meta.LargestSeq)
+		_ = helpers.WriteSlice(buf, []byte(f.Meta.FileName))
+		_ = helpers.WriteSlice(buf, *f.Meta.MinKey)
+		_ = helpers.WriteSlice(buf, *f.Meta.MaxKey)
+	}
+	return buf.Bytes()
+}
+
+func DecodeVersionEdit(data []byte) (*VersionEdit, error) {
+	e := &VersionEdit{}
+	rdr := bytes.NewReader(data)
+	for {
+		tag, err := rdr.ReadByte()
+		if err == io.EOF {
+			return e, nil
+		}
+		switch tag {
+		case tagLegacyLogNumber:
+			_, err = helpers.ReadUint64(rdr)
+		case tagLogNumber:
+			e.LogNumber, err = helpers.ReadUint64(rdr)
+		case tagNextFileNum:
+			e.NextFileNum, err = helpers.ReadUint64(rdr)
+		case tagLastSequence:
+			e.LastSequence, err = helpers.ReadUint64(rdr)
+		case tagDeletedFile:
+			err = e.decodeDeletedFile(rdr)
+		case tagLegacyNewFile, tagNewFileV2, tagNewFile:
+			err = e.decodeNewFile(rdr, tag)
+		default:
+			return nil, fmt.Errorf("%w: unknown tag %v", ErrCorruptManifest, tag)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrCorruptManifest, err)
+		}
+	}
+}
+
+func (e *VersionEdit) decodeDeletedFile(rdr io.Reader) error {
+	level, err := helpers.ReadUint32(rdr)
+	if err != nil {
+		return err
+	}
+	name, err := helpers.ReadSlice(rdr)
+	if err != nil {
+		return err
+	}
+	e.DeleteFile(int(level), string(*name))
+	return nil
+}
+
+func (e *VersionEdit) decodeNewFile(rdr io.Reader, tag byte) error {
+	level, err := helpers.ReadUint32(rdr)
+	if err != nil {
+		return err
+	}
+	meta := &MetaBlock{}
+	meta.FileNum, err = helpers.ReadUint64(rdr)
+	if err != nil {
+		return err
+	}
+	size, err := helpers.ReadUint64(rdr)
+	if err != nil {
+		return err
+	}
+	meta.FileSize = int64(size)
+	keyCount, err := helpers.ReadUint64(rdr)
+	if err != nil {
+		return err
+	}
+	meta.KeyCount = int64(keyCount)
+	if tag != tagLegacyNewFile {
+		deletionCount, err := helpers.ReadUint64(rdr)
+		if err != nil {
+			return err
+		}
+		meta.DeletionCount = int64(deletionCount)
+	}
+	meta.LargestSeq = MaxSequence
+	if tag == tagNewFile {
+		meta.LargestSeq, err = helpers.ReadUint64(rdr)
+		if err != nil {
+			return err
+		}
+	}
+	name, err := helpers.ReadSlice(rdr)
+	if err != nil {
+		return err
+	}
+	meta.FileName = string(*name)
+	meta.MinKey, err = helpers.ReadSlice(rdr)
+	if err != nil {
+		return err
+	}
+	meta.MaxKey, err = helpers.ReadSlice(rdr)
+	if err != nil {
+		return err
+	}
+	e.AddFile(int(level), meta)
+	return nil
+}
+
+// Returns a copy of levels with the edit applied.
+// Level 0 is kept in file number order, other levels are ordered by min key
+func (e *VersionEdit) Apply(levels [][]*MetaBlock) [][]*MetaBlock {
+	deleted := map[DeletedFile]bool{}
+	for _, d := range e.DeletedFiles {
+		deleted[d] = true
+	}
+
+	res := make([][]*MetaBlock, len(levels))
+	for l, files := range levels {
+		res[l] = make([]*MetaBlock, 0, len(files))
+		for _, f := range files {
+			if !deleted[DeletedFile{Level: l, FileName: f.FileName}] {
+				res[l] = append(res[l], f)
+			}
+		}
+	}
+
+	for _, f := range e.NewFiles {
+		for len(res) <= f.Level {
+			res = append(res, []*MetaBlock{})
+		}
+		res[f.Level] = append(res[f.Level], f.Meta)
+	}
+
+	for l := range res {
+		files := res[l]
+		if l == 0 {
+			sort.SliceStable(files, func(a, b int) bool {
+				return files[a].FileNum < files[b].FileNum
+			})
+		} else {
+			sort.Slice(files, func(a, b int) bool {
+				return bytes.Compare(*files[a].MinKey, *files[b].MinKey) < 0
+			})
+		}
+	}
+	return res
+}
+
+// Returns sstable file name for given level and file number
+func TableFileName(level int, num uint64) string {
+	return fmt.Sprintf("%v_%v.db", level, num)
+}
+
+func manifestFileName(num uint64) string {
+	return fmt.Sprintf("MANIFEST-%06d", num)
+}
+
+// VersionSet keeps the current set of sstables on each level
+// and persists every change into the MANIFEST.
+// Its methods are *NOT* thread-safe
+type VersionSet struct {
+	dbPath       string
+	levels       [][]*MetaBlock
+	LogNumber    uint64
+	LastSequence uint64
+	nextFileNum  uint64
+	manifestNum  uint64
+	manifestFile *os.File
+	manifestLog  *wal.WalWriter
+	// Logger of errors which don't fail the change, such as
+	// failures to remove old manifests
+	Logger Logger
+}
+
+func NewVersionSet(dbPath string, numLevels int) *VersionSet {
+	levels := make([][]*MetaBlock, numLevels)
+	for i := range levels {
+		levels[i] = []*MetaBlock{}
+	}
+	return &VersionSet{
+		dbPath: dbPath,
+		levels: levels,
+		// file number 0 is never allocated, manifest number 0 means no manifest
+		nextFileNum: 1,
+		Logger:      log.Default(),
+	}
+}
+
+// Returns current files on each level. Returned slices must not be modified,
+// they are replaced as a whole on each change
+func (v *VersionSet) Levels() [][]*MetaBlock {
+	return v.levels
+}
+
+// Allocates a new file number
+func (v *VersionSet) NewFileNum() uint64 {
+	n := v.nextFileNum
+	v.nextFileNum++
+	return n
+}
+
+// Marks the file number as used, so it is never allocated again
+func (v *VersionSet) MarkFileNumUsed(num uint64) {
+	if v.nextFileNum <= num {
+		v.nextFileNum = num + 1
+	}
+}
+
+// Rebuilds the version set from the MANIFEST which CURRENT points to.
+// Returns false if the database doesn't have a CURRENT file
+func (v *VersionSet) Recover() (bool, error) {
+	current, err := os.ReadFile(path.Join(v.dbPath, currentFileName))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	name := strings.TrimSpace(string(current))
+	num, err := strconv.ParseUint(strings.TrimPrefix(name, "MANIFEST-"), 10, 64)
+	if err != nil {
+		return false, fmt.Errorf("%w: invalid CURRENT file %q", ErrCorruptManifest, name)
+	}
+
+	f, err := os.Open(path.Join(v.dbPath, name))
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	walReader := wal.NewWalReader(&wal.WalOptions{BlockSize: wal.BlockSize})
+	for {
+		rec, err := walReader.ReadRecord(reader)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// a torn record at the tail was never acknowledged
+			break
+		}
+		if err != nil {
+			return false, fmt.Errorf("%w: %v", ErrCorruptManifest, err)
+		}
+		edit, err := DecodeVersionEdit(rec)
+		if err != nil {
+			return false, err
+		}
+		v.apply(edit)
+	}
+	v.manifestNum = num
+	v.MarkFileNumUsed(num)
+	return true, nil
+}
+
+func (v *VersionSet) apply(edit *VersionEdit) {
+	v.levels = edit.Apply(v.levels)
+	if edit.LogNumber > v.LogNumber {
+		v.LogNumber = edit.LogNumber
+	}
+	if edit.LastSequence > v.LastSequence {
+		v.LastSequence = edit.LastSequence
+	}
+	for _, f := range edit.NewFiles {
+		v.MarkFileNumUsed(f.Meta.FileNum)
+	}
+	if edit.NextFileNum > v.nextFileNum {
+		v.nextFileNum = edit.NextFileNum
+	}
+}
+
+// Writes the edit into MANIFEST and applies it to the current levels.
+// The first call after Recover starts a new MANIFEST with a snapshot
+// of the current state and points CURRENT to it
+func (v *VersionSet) LogAndApply(edit *VersionEdit) error {
+	if edit.LogNumber < v.LogNumber {
+		edit.LogNumber = v.LogNumber
+	}
+	if edit.LastSequence < v.LastSequence {
+		edit.LastSequence = v.LastSequence
+	}
+	for _, f := range edit.NewFiles {
+		v.MarkFileNumUsed(f.Meta.FileNum)
+	}
+
+	if v.manifestLog == nil {
+		err := v.createManifest()
+		if err != nil {
+			return err
+		}
+	}
+
+	edit.NextFileNum = v.nextFileNum
+	err := v.writeEdit(edit)
+	if err != nil {
+		return err
+	}
+	v.apply(edit)
+	return nil
+}
+
+func (v *VersionSet) writeEdit(edit *VersionEdit) error {
+	_, err := v.manifestLog.Write(edit.Encode())
+	if err != nil {
+		return err
+	}
+	err = v.manifestLog.Flush()
+	if err != nil {
+		return err
+	}
+	return v.manifestFile.Sync()
+}
+
+// Creates a new MANIFEST starting with current state,
+// switches CURRENT to it and removes the old one
+func (v *VersionSet) createManifest() error {
+	oldNum := v.manifestNum
+	hadManifest := oldNum != 0
+	num := v.NewFileNum()
+	f, err := os.Create(path.Join(v.dbPath, manifestFileName(num)))
+	if err != nil {
+		return err
+	}
+	v.manifestFile = f
+	v.manifestLog = wal.NewWalWriter(f, &wal.WalOptions{BlockSize: wal.BlockSize})
+
+	snapshot := &VersionEdit{
+		LogNumber:    v.LogNumber,
+		NextFileNum:  v.nextFileNum,
+		LastSequence: v.LastSequence,
+	}
+	for l, files := range v.levels {
+		for _, meta := range files {
+			snapshot.AddFile(l, meta)
+		}
+	}
+	err = v.writeEdit(snapshot)
+	if err == nil {
+		err = v.setCurrent(num)
+	}
+	if err != nil {
+		v.Close()
+		_ = os.Remove(f.Name())
+		return err
+	}
+
+	v.manifestNum = num
+	if hadManifest {
+		err = os.Remove(path.Join(v.dbPath, manifestFileName(oldNum)))
+		if err != nil {
+			v.Logger.Printf("error while removing old manifest: %v\n", err)
+		}
+	}
+	return nil
+}
+
+// Atomically points CURRENT to given manifest
+func (v *VersionSet) setCurrent(num uint64) error {
+	tmpPath := path.Join(v.dbPath, currentFileName+".tmp")
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(manifestFileName(num) + "\n")
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	err = os.Rename(tmpPath, path.Join(v.dbPath, currentFileName))
+	if err != nil {
+		return err
+	}
+	syncDir(v.dbPath)
+	return nil
+}
+
+// Syncs directory entries, errors are ignored since
+// not every platform supports syncing directories
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	_ = d.Sync()
+	_ = d.Close()
+}
+
+// Closes the MANIFEST file, next LogAndApply starts a new one
+func (v *VersionSet) Close() error {
+	var err error
+	if v.manifestLog != nil {
+		err = v.manifestLog.Flush()
+	}
+	v.manifestLog = nil
+	if v.manifestFile != nil {
+		if cErr := v.manifestFile.Close(); err == nil {
+			err = cErr
+		}
+	}
+	v.manifestFile = nil
+	return err
+}
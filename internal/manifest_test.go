@@ -0,0 +1,136 @@
+package internal
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testMeta(name string, num uint64, minKey, maxKey string) *MetaBlock {
+	min := []byte(minKey)
+	max := []byte(maxKey)
+	return &MetaBlock{
+		FileName:      name,
+		FileNum:       num,
+		MinKey:        &min,
+		MaxKey:        &max,
+		KeyCount:      2,
+		DeletionCount: 1,
+		LargestSeq:    9,
+		FileSize:      100,
+	}
+}
+
+func TestVersionEdit_Encode(t *testing.T) {
+	edit := &VersionEdit{
+		LogNumber:    3,
+		NextFileNum:  12,
+		LastSequence: 42,
+	}
+	edit.AddFile(0, testMeta("0_10.db", 10, "a", "c"))
+	edit.AddFile(2, testMeta("2_11.db", 11, "d", "f"))
+	edit.DeleteFile(1, "1_4.db")
+
+	decoded, err := DecodeVersionEdit(edit.Encode())
+	assert.Nil(t, err)
+	assert.Equal(t, edit, decoded)
+
+	// log numbers of older versions are ignored
+	legacy := append([]byte{tagLegacyLogNumber, 7, 0, 0, 0, 0, 0, 0, 0}, edit.Encode()[9:]...)
+	decoded, err = DecodeVersionEdit(legacy)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), decoded.LogNumber)
+	assert.Equal(t, edit.NewFiles, decoded.NewFiles)
+
+	// new files of older versions don't have deletion count and largest seq
+	single := &VersionEdit{}
+	single.AddFile(0, testMeta("0_10.db", 10, "a", "c"))
+	data := single.Encode()
+	legacy = append([]byte{}, data[:27]...)
+	legacy = append(legacy, tagLegacyNewFile)
+	legacy = append(legacy, data[28:56]...)
+	legacy = append(legacy, data[72:]...)
+	decoded, err = DecodeVersionEdit(legacy)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), decoded.NewFiles[0].Meta.KeyCount)
+	assert.Equal(t, int64(0), decoded.NewFiles[0].Meta.DeletionCount)
+	assert.Equal(t, MaxSequence, decoded.NewFiles[0].Meta.LargestSeq)
+	assert.Equal(t, "c", string(*decoded.NewFiles[0].Meta.MaxKey))
+
+	legacy = append([]byte{}, data[:27]...)
+	legacy = append(legacy, tagNewFileV2)
+	legacy = append(legacy, data[28:64]...)
+	legacy = append(legacy, data[72:]...)
+	decoded, err = DecodeVersionEdit(legacy)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), decoded.NewFiles[0].Meta.DeletionCount)
+	assert.Equal(t, MaxSequence, decoded.NewFiles[0].Meta.LargestSeq)
+	assert.Equal(t, "c", string(*decoded.NewFiles[0].Meta.MaxKey))
+
+	_, err = DecodeVersionEdit([]byte{99})
+	assert.ErrorIs(t, err, ErrCorruptManifest)
+	_, err = DecodeVersionEdit(edit.Encode()[:30])
+	assert.ErrorIs(t, err, ErrCorruptManifest)
+}
+
+func TestVersionSet_Recover(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	v := NewVersionSet(testPath(), NumLevels)
+	found, err := v.Recover()
+	assert.Nil(t, err)
+	assert.False(t, found)
+
+	edit := &VersionEdit{LogNumber: 5}
+	edit.AddFile(0, testMeta("0_1.db", v.NewFileNum(), "a", "c"))
+	edit.AddFile(0, testMeta("0_2.db", v.NewFileNum(), "b", "d"))
+	assert.Nil(t, v.LogAndApply(edit))
+
+	fileNum := v.NewFileNum()
+	edit = &VersionEdit{}
+	edit.DeleteFile(0, "0_1.db")
+	edit.AddFile(1, testMeta("1_3.db", fileNum, "a", "c"))
+	assert.Nil(t, v.LogAndApply(edit))
+	v.Close()
+
+	r := NewVersionSet(testPath(), NumLevels)
+	found, err = r.Recover()
+	assert.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, v.Levels(), r.Levels())
+	assert.Equal(t, uint64(5), r.LogNumber)
+	assert.Less(t, fileNum, r.NewFileNum())
+
+	// reopening starts a new manifest and removes the old one
+	oldManifest := manifestFileName(v.manifestNum)
+	assert.Nil(t, r.LogAndApply(&VersionEdit{}))
+	r.Close()
+	_, err = os.Stat(path.Join(testPath(), oldManifest))
+	assert.True(t, os.IsNotExist(err))
+
+	r = NewVersionSet(testPath(), NumLevels)
+	found, err = r.Recover()
+	assert.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, v.Levels(), r.Levels())
+}
+
+func TestVersionSet_RecoverDeepLevels(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	v := NewVersionSet(testPath(), NumLevels)
+	edit := &VersionEdit{}
+	edit.AddFile(12, testMeta("12_1.db", 1, "a", "c"))
+	assert.Nil(t, v.LogAndApply(edit))
+	v.Close()
+
+	r := NewVersionSet(testPath(), NumLevels)
+	_, err := r.Recover()
+	assert.Nil(t, err)
+	assert.Equal(t, 13, len(r.Levels()))
+	assert.Equal(t, "12_1.db", r.Levels()[12][0].FileName)
+}
@@ -1,14 +1,24 @@
 package internal
 
-import "github.com/emin/skiplist"
+import (
+	"sync"
+	"sync/atomic"
+)
 
 type MemTable interface {
 	Set(key, value []byte)
 	Get(key []byte) []byte
 	Delete(key []byte) bool
 	Iterator() Iterator
+	SeekIterator() SeekIterator
 	KeyCount() int64
+	// Returns number of tombstones among KeyCount entries
+	DeletionCount() int64
 	RawSize() int64
+	AddRangeTombstone(t RangeTombstone)
+	RangeTombstones() *RangeTombstones
+	// Reports whether the memtable has no entries and no range tombstones
+	Empty() bool
 }
 
 type Iterator interface {
@@ -18,21 +28,33 @@ type Iterator interface {
 }
 
 type iteratorImpl struct {
-	iter skiplist.Iterator
+	iter    *skipListIterator
+	started bool
 }
 
+// Memtable can be read and iterated while it is written,
+// but Set and Delete calls must be serialized by the caller
 type memtableImpl struct {
-	rep *skiplist.SkipList
+	rep       *skipList
+	deletions atomic.Int64
+	mu        sync.Mutex
+	ranges    []RangeTombstone
+	// fragments of ranges, nil until they are read after a change
+	fragmented *RangeTombstones
+	rangesSize atomic.Int64
 }
 
 func NewMemTable() MemTable {
 	return &memtableImpl{
-		rep: skiplist.New(),
+		rep: newSkipList(),
 	}
 }
 
 func (m *memtableImpl) Set(key, value []byte) {
 	m.rep.Set(key, value)
+	if _, kind, ok := parseTrailer(key); ok && kind == KindDelete {
+		m.deletions.Add(1)
+	}
 }
 
 func (m *memtableImpl) Get(key []byte) []byte {
@@ -43,26 +65,69 @@ func (m *memtableImpl) Delete(key []byte) bool {
 	return m.rep.Delete(key)
 }
 
+// Returns total size of keys, values and range tombstones
 func (m *memtableImpl) RawSize() int64 {
-	return m.rep.RawSize()
+	return m.rep.RawSize() + m.rangesSize.Load()
+}
+
+func (m *memtableImpl) AddRangeTombstone(t RangeTombstone) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.ranges = append(m.ranges, t)
+	m.fragmented = nil
+	m.rangesSize.Add(int64(len(t.Start) + len(t.End) + 8))
+}
+
+func (m *memtableImpl) RangeTombstones() *RangeTombstones {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.fragmented == nil {
+		m.fragmented = NewRangeTombstones(m.ranges)
+	}
+	return m.fragmented
+}
+
+func (m *memtableImpl) Empty() bool {
+	return m.KeyCount() == 0 && m.rangesSize.Load() == 0
 }
 
 func (m *memtableImpl) Iterator() Iterator {
-	return &iteratorImpl{iter: m.rep.Iterator()}
+	return &iteratorImpl{iter: &skipListIterator{list: m.rep}}
+}
+
+// Returns an iterator which is not positioned yet
+func (m *memtableImpl) SeekIterator() SeekIterator {
+	return &skipListIterator{list: m.rep}
 }
 
 func (m *memtableImpl) KeyCount() int64 {
 	return m.rep.KeyCount()
 }
 
+func (m *memtableImpl) DeletionCount() int64 {
+	return m.deletions.Load()
+}
+
 func (m *iteratorImpl) Next() bool {
-	return m.iter.Next()
+	if !m.started {
+		m.started = true
+		m.iter.SeekToFirst()
+	} else if m.iter.Valid() {
+		m.iter.Next()
+	}
+	return m.iter.Valid()
 }
 
 func (m *iteratorImpl) Key() []byte {
+	if !m.iter.Valid() {
+		return nil
+	}
 	return m.iter.Key()
 }
 
 func (m *iteratorImpl) Value() []byte {
+	if !m.iter.Valid() {
+		return nil
+	}
 	return m.iter.Value()
 }
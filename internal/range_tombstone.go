@@ -0,0 +1,211 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"sort"
+)
+
+//
+//	Range Tombstones
+//
+//	A range tombstone deletes all versions of user keys in [Start, End)
+//	which are older than its sequence number. Tombstones are kept apart
+//	from point entries, in memtables and in the range deletion block of
+//	sstables. For lookups they are split into non-overlapping fragments,
+//	each fragment has sequence numbers of all tombstones covering it.
+//
+//     Range Deletion Block
+//   -------------------------------------------------------------------------------
+//  | Start Len (4-bytes) | Start | End Len (4-bytes) | End | Seq (8-bytes) | .... |
+//   -------------------------------------------------------------------------------
+//
+
+var errInvalidRangeTombstones = errors.New("invalid range deletion block")
+
+type RangeTombstone struct {
+	Start []byte
+	End   []byte
+	Seq   uint64
+}
+
+// Reports whether the tombstone deletes version seq of userKey
+func (t RangeTombstone) Covers(userKey []byte, seq uint64) bool {
+	return seq < t.Seq && bytes.Compare(t.Start, userKey) <= 0 && bytes.Compare(userKey, t.End) < 0
+}
+
+// Returns the part of the tombstone within [lower, upper), nil bounds
+// are unbounded. Returns false if nothing is left
+func (t RangeTombstone) Clip(lower, upper []byte) (RangeTombstone, bool) {
+	if lower != nil && bytes.Compare(t.Start, lower) < 0 {
+		t.Start = lower
+	}
+	if upper != nil && bytes.Compare(t.End, upper) > 0 {
+		t.End = upper
+	}
+	return t, bytes.Compare(t.Start, t.End) < 0
+}
+
+// RangeTombstones is an immutable set of range tombstones
+type RangeTombstones struct {
+	list []RangeTombstone
+	// non-overlapping fragments ordered by start
+	fragments []rangeFragment
+}
+
+type rangeFragment struct {
+	start []byte
+	end   []byte
+	// sequence numbers of tombstones covering the fragment, descending
+	seqs []uint64
+}
+
+// Returns a set of the tombstones, empty tombstones are dropped
+func NewRangeTombstones(list []RangeTombstone) *RangeTombstones {
+	r := &RangeTombstones{}
+	for _, t := range list {
+		if bytes.Compare(t.Start, t.End) < 0 {
+			r.list = append(r.list, t)
+		}
+	}
+	r.fragment()
+	return r
+}
+
+// Returns a set of tombstones of all given sets, nil sets are skipped
+func MergeRangeTombstones(sets ...*RangeTombstones) *RangeTombstones {
+	list := make([]RangeTombstone, 0)
+	for _, s := range sets {
+		list = append(list, s.List()...)
+	}
+	return NewRangeTombstones(list)
+}
+
+// Splits tombstones at every start and end key
+func (r *RangeTombstones) fragment() {
+	if len(r.list) == 0 {
+		return
+	}
+	bounds := make([][]byte, 0, 2*len(r.list))
+	for _, t := range r.list {
+		bounds = append(bounds, t.Start, t.End)
+	}
+	sort.Slice(bounds, func(i, j int) bool {
+		return bytes.Compare(bounds[i], bounds[j]) < 0
+	})
+	sorted := append([]RangeTombstone{}, r.list...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i].Start, sorted[j].Start) < 0
+	})
+
+	active := make([]RangeTombstone, 0)
+	next := 0
+	for i := 0; i+1 < len(bounds); i++ {
+		start, end := bounds[i], bounds[i+1]
+		if bytes.Equal(start, end) {
+			continue
+		}
+		for next < len(sorted) && bytes.Compare(sorted[next].Start, start) <= 0 {
+			active = append(active, sorted[next])
+			next++
+		}
+		seqs := make([]uint64, 0, len(active))
+		n := 0
+		for _, t := range active {
+			if bytes.Compare(t.End, start) > 0 {
+				active[n] = t
+				n++
+				seqs = append(seqs, t.Seq)
+			}
+		}
+		active = active[:n]
+		if len(seqs) == 0 {
+			continue
+		}
+		sort.Slice(seqs, func(i, j int) bool { return seqs[i] > seqs[j] })
+		r.fragments = append(r.fragments, rangeFragment{start: start, end: end, seqs: seqs})
+	}
+}
+
+// Returns tombstones of the set
+func (r *RangeTombstones) List() []RangeTombstone {
+	if r == nil {
+		return nil
+	}
+	return r.list
+}
+
+func (r *RangeTombstones) Len() int {
+	if r == nil {
+		return 0
+	}
+	return len(r.list)
+}
+
+// Returns the largest sequence number of tombstones which cover userKey
+// and are visible at seq, 0 if there is no such tombstone
+func (r *RangeTombstones) MaxCoveringSeq(userKey []byte, seq uint64) uint64 {
+	if r.Len() == 0 {
+		return 0
+	}
+	i := sort.Search(len(r.fragments), func(i int) bool {
+		return bytes.Compare(r.fragments[i].end, userKey) > 0
+	})
+	if i == len(r.fragments) || bytes.Compare(r.fragments[i].start, userKey) > 0 {
+		return 0
+	}
+	for _, s := range r.fragments[i].seqs {
+		if s <= seq {
+			return s
+		}
+	}
+	return 0
+}
+
+// Reports whether version seq of userKey is deleted
+// by a tombstone which is visible at readSeq
+func (r *RangeTombstones) Covers(userKey []byte, seq, readSeq uint64) bool {
+	return seq < r.MaxCoveringSeq(userKey, readSeq)
+}
+
+func encodeRangeTombstones(list []RangeTombstone) []byte {
+	data := make([]byte, 0)
+	for _, t := range list {
+		data = binary.LittleEndian.AppendUint32(data, uint32(len(t.Start)))
+		data = append(data, t.Start...)
+		data = binary.LittleEndian.AppendUint32(data, uint32(len(t.End)))
+		data = append(data, t.End...)
+		data = binary.LittleEndian.AppendUint64(data, t.Seq)
+	}
+	return data
+}
+
+func decodeRangeTombstones(data []byte) ([]RangeTombstone, error) {
+	list := make([]RangeTombstone, 0)
+	readSlice := func() ([]byte, bool) {
+		if len(data) < 4 {
+			return nil, false
+		}
+		n := int(binary.LittleEndian.Uint32(data))
+		if len(data)-4 < n {
+			return nil, false
+		}
+		s := data[4 : 4+n]
+		data = data[4+n:]
+		return s, true
+	}
+	for len(data) > 0 {
+		start, ok := readSlice()
+		if !ok {
+			return nil, errInvalidRangeTombstones
+		}
+		end, ok := readSlice()
+		if !ok || len(data) < 8 {
+			return nil, errInvalidRangeTombstones
+		}
+		list = append(list, RangeTombstone{Start: start, End: end, Seq: binary.LittleEndian.Uint64(data)})
+		data = data[8:]
+	}
+	return list, nil
+}
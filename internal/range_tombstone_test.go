@@ -0,0 +1,67 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRangeTombstones_MaxCoveringSeq(t *testing.T) {
+	r := NewRangeTombstones([]RangeTombstone{
+		{Start: []byte("b"), End: []byte("f"), Seq: 5},
+		{Start: []byte("d"), End: []byte("h"), Seq: 8},
+		// empty tombstones are dropped
+		{Start: []byte("x"), End: []byte("x"), Seq: 9},
+	})
+	assert.Equal(t, 2, r.Len())
+	assert.Equal(t, uint64(0), r.MaxCoveringSeq([]byte("a"), 10))
+	assert.Equal(t, uint64(5), r.MaxCoveringSeq([]byte("b"), 10))
+	assert.Equal(t, uint64(8), r.MaxCoveringSeq([]byte("d"), 10))
+	assert.Equal(t, uint64(8), r.MaxCoveringSeq([]byte("g"), 10))
+	assert.Equal(t, uint64(0), r.MaxCoveringSeq([]byte("h"), 10))
+	assert.Equal(t, uint64(0), r.MaxCoveringSeq([]byte("x"), 10))
+
+	// newer tombstones aren't visible at older sequence numbers
+	assert.Equal(t, uint64(5), r.MaxCoveringSeq([]byte("e"), 7))
+	assert.Equal(t, uint64(0), r.MaxCoveringSeq([]byte("g"), 7))
+	assert.True(t, r.Covers([]byte("e"), 4, 7))
+	assert.False(t, r.Covers([]byte("e"), 5, 7))
+	assert.True(t, r.Covers([]byte("e"), 7, 8))
+
+	var empty *RangeTombstones
+	assert.False(t, empty.Covers([]byte("e"), 1, 10))
+	merged := MergeRangeTombstones(empty, r, NewRangeTombstones([]RangeTombstone{
+		{Start: []byte("a"), End: []byte("c"), Seq: 2},
+	}))
+	assert.Equal(t, 3, merged.Len())
+	assert.Equal(t, uint64(2), merged.MaxCoveringSeq([]byte("a"), 10))
+	assert.Equal(t, uint64(5), merged.MaxCoveringSeq([]byte("b"), 10))
+}
+
+func TestRangeTombstone_Clip(t *testing.T) {
+	rt := RangeTombstone{Start: []byte("b"), End: []byte("f"), Seq: 1}
+	c, ok := rt.Clip(nil, nil)
+	assert.True(t, ok)
+	assert.Equal(t, rt, c)
+	c, ok = rt.Clip([]byte("c"), []byte("e"))
+	assert.True(t, ok)
+	assert.Equal(t, RangeTombstone{Start: []byte("c"), End: []byte("e"), Seq: 1}, c)
+	_, ok = rt.Clip([]byte("f"), nil)
+	assert.False(t, ok)
+	_, ok = rt.Clip(nil, []byte("b"))
+	assert.False(t, ok)
+}
+
+func TestRangeTombstones_Encode(t *testing.T) {
+	list := []RangeTombstone{
+		{Start: []byte("a"), End: []byte("bb"), Seq: 3},
+		{Start: []byte(""), End: []byte("z"), Seq: 1 << 40},
+	}
+	data := encodeRangeTombstones(list)
+	decoded, err := decodeRangeTombstones(data)
+	assert.Nil(t, err)
+	assert.Equal(t, list, decoded)
+
+	_, err = decodeRangeTombstones(data[:len(data)-1])
+	assert.Equal(t, errInvalidRangeTombstones, err)
+}
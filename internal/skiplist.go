@@ -0,0 +1,227 @@
+package internal
+
+import (
+	"bytes"
+	"math/rand"
+	"sync/atomic"
+)
+
+const skipListMaxHeight = 12
+
+// skipList keeps keys in order, it is used as the memtable representation.
+// Writes must be serialized by the caller, but reads and iterators can run
+// concurrently with a writer since links between nodes are updated atomically
+// and a node is published only after it is fully initialized.
+// It replaces github.com/emin/skiplist, which can't Seek or move backward
+type skipList struct {
+	head   *skipNode
+	height atomic.Int32
+	count  atomic.Int64
+	size   atomic.Int64
+	rnd    *rand.Rand
+}
+
+type skipNode struct {
+	key   []byte
+	value atomic.Pointer[[]byte]
+	next  []atomic.Pointer[skipNode]
+}
+
+func newSkipNode(key, value []byte, height int) *skipNode {
+	n := &skipNode{
+		key:  key,
+		next: make([]atomic.Pointer[skipNode], height),
+	}
+	n.value.Store(&value)
+	return n
+}
+
+func newSkipList() *skipList {
+	l := &skipList{
+		head: newSkipNode(nil, nil, skipListMaxHeight),
+		rnd:  rand.New(rand.NewSource(0xdecafbad)),
+	}
+	l.height.Store(1)
+	return l
+}
+
+func (l *skipList) randomHeight() int {
+	h := 1
+	// each level is 4 times sparser than the one below
+	for h < skipListMaxHeight && l.rnd.Intn(4) == 0 {
+		h++
+	}
+	return h
+}
+
+// Returns the first node whose key is >= key. If prev is not nil,
+// it is filled with the last node before key on each level
+func (l *skipList) findGreaterOrEqual(key []byte, prev []*skipNode) *skipNode {
+	x := l.head
+	level := int(l.height.Load()) - 1
+	for {
+		next := x.next[level].Load()
+		if next != nil && bytes.Compare(next.key, key) < 0 {
+			x = next
+			continue
+		}
+		if prev != nil {
+			prev[level] = x
+		}
+		if level == 0 {
+			return next
+		}
+		level--
+	}
+}
+
+// Returns the last node whose key is < key, head if there is no such node
+func (l *skipList) findLessThan(key []byte) *skipNode {
+	x := l.head
+	level := int(l.height.Load()) - 1
+	for {
+		next := x.next[level].Load()
+		if next != nil && bytes.Compare(next.key, key) < 0 {
+			x = next
+			continue
+		}
+		if level == 0 {
+			return x
+		}
+		level--
+	}
+}
+
+// Returns the last node, head if the list is empty
+func (l *skipList) findLast() *skipNode {
+	x := l.head
+	level := int(l.height.Load()) - 1
+	for {
+		next := x.next[level].Load()
+		if next != nil {
+			x = next
+			continue
+		}
+		if level == 0 {
+			return x
+		}
+		level--
+	}
+}
+
+// Sets value for key, existing value of the key is replaced
+func (l *skipList) Set(key, value []byte) {
+	prev := make([]*skipNode, skipListMaxHeight)
+	x := l.findGreaterOrEqual(key, prev)
+	if x != nil && bytes.Equal(x.key, key) {
+		old := x.value.Load()
+		x.value.Store(&value)
+		l.size.Add(int64(len(value) - len(*old)))
+		return
+	}
+
+	h := l.randomHeight()
+	listHeight := int(l.height.Load())
+	if h > listHeight {
+		for i := listHeight; i < h; i++ {
+			prev[i] = l.head
+		}
+		// readers seeing the new height before the node is linked
+		// only find nil links on the new levels, which is fine
+		l.height.Store(int32(h))
+	}
+
+	n := newSkipNode(key, value, h)
+	for i := 0; i < h; i++ {
+		n.next[i].Store(prev[i].next[i].Load())
+		prev[i].next[i].Store(n)
+	}
+	l.count.Add(1)
+	l.size.Add(int64(len(key) + len(value)))
+}
+
+// Returns value of key, nil if it doesn't exist
+func (l *skipList) Get(key []byte) []byte {
+	x := l.findGreaterOrEqual(key, nil)
+	if x != nil && bytes.Equal(x.key, key) {
+		return *x.value.Load()
+	}
+	return nil
+}
+
+// Removes the key, returns false if it doesn't exist.
+// Readers positioned on the removed node can still move forward
+func (l *skipList) Delete(key []byte) bool {
+	prev := make([]*skipNode, skipListMaxHeight)
+	x := l.findGreaterOrEqual(key, prev)
+	if x == nil || !bytes.Equal(x.key, key) {
+		return false
+	}
+	for i := len(x.next) - 1; i >= 0; i-- {
+		prev[i].next[i].Store(x.next[i].Load())
+	}
+	l.count.Add(-1)
+	l.size.Add(-int64(len(key) + len(*x.value.Load())))
+	return true
+}
+
+func (l *skipList) KeyCount() int64 {
+	return l.count.Load()
+}
+
+// Returns total size of keys and values
+func (l *skipList) RawSize() int64 {
+	return l.size.Load()
+}
+
+// skipListIterator implements SeekIterator
+type skipListIterator struct {
+	list *skipList
+	node *skipNode
+}
+
+func (it *skipListIterator) Valid() bool {
+	return it.node != nil
+}
+
+func (it *skipListIterator) SeekToFirst() {
+	it.node = it.list.head.next[0].Load()
+}
+
+func (it *skipListIterator) SeekToLast() {
+	it.node = it.list.findLast()
+	if it.node == it.list.head {
+		it.node = nil
+	}
+}
+
+func (it *skipListIterator) Seek(key []byte) {
+	it.node = it.list.findGreaterOrEqual(key, nil)
+}
+
+func (it *skipListIterator) Next() {
+	it.node = it.node.next[0].Load()
+}
+
+func (it *skipListIterator) Prev() {
+	it.node = it.list.findLessThan(it.node.key)
+	if it.node == it.list.head {
+		it.node = nil
+	}
+}
+
+func (it *skipListIterator) Key() []byte {
+	return it.node.key
+}
+
+func (it *skipListIterator) Value() []byte {
+	return *it.node.value.Load()
+}
+
+func (it *skipListIterator) Err() error {
+	return nil
+}
+
+func (it *skipListIterator) Close() error {
+	return nil
+}
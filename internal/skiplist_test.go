@@ -0,0 +1,94 @@
+package internal
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSkipList_SetGet(t *testing.T) {
+	l := newSkipList()
+	l.Set([]byte("b"), []byte("1"))
+	l.Set([]byte("a"), []byte("2"))
+	l.Set([]byte("c"), []byte("3"))
+	l.Set([]byte("b"), []byte("4"))
+
+	assert.Equal(t, []byte("2"), l.Get([]byte("a")))
+	assert.Equal(t, []byte("4"), l.Get([]byte("b")))
+	assert.Nil(t, l.Get([]byte("d")))
+	assert.Equal(t, int64(3), l.KeyCount())
+	assert.Equal(t, int64(6), l.RawSize())
+
+	assert.True(t, l.Delete([]byte("b")))
+	assert.False(t, l.Delete([]byte("b")))
+	assert.Nil(t, l.Get([]byte("b")))
+	assert.Equal(t, int64(2), l.KeyCount())
+	assert.Equal(t, int64(4), l.RawSize())
+}
+
+func TestSkipList_Iterator(t *testing.T) {
+	l := newSkipList()
+	for i := 0; i < 100; i += 2 {
+		l.Set([]byte(fmt.Sprintf("k%03d", i)), []byte(fmt.Sprintf("v%03d", i)))
+	}
+
+	it := &skipListIterator{list: l}
+	it.SeekToFirst()
+	assert.Equal(t, []byte("k000"), it.Key())
+	it.SeekToLast()
+	assert.Equal(t, []byte("k098"), it.Key())
+
+	it.Seek([]byte("k051"))
+	assert.Equal(t, []byte("k052"), it.Key())
+	it.Prev()
+	assert.Equal(t, []byte("k050"), it.Key())
+	it.Next()
+	it.Next()
+	assert.Equal(t, []byte("k054"), it.Key())
+	assert.Equal(t, []byte("v054"), it.Value())
+
+	it.Seek([]byte("k099"))
+	assert.False(t, it.Valid())
+	it.SeekToFirst()
+	it.Prev()
+	assert.False(t, it.Valid())
+
+	empty := &skipListIterator{list: newSkipList()}
+	empty.SeekToFirst()
+	assert.False(t, empty.Valid())
+	empty.SeekToLast()
+	assert.False(t, empty.Valid())
+}
+
+func TestSkipList_ConcurrentReads(t *testing.T) {
+	l := newSkipList()
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 5000; i++ {
+			l.Set([]byte(fmt.Sprintf("k%05d", i)), []byte("v"))
+		}
+	}()
+
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 20; n++ {
+				it := &skipListIterator{list: l}
+				var prev []byte
+				for it.SeekToFirst(); it.Valid(); it.Next() {
+					if prev != nil {
+						assert.Less(t, string(prev), string(it.Key()))
+					}
+					prev = it.Key()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int64(5000), l.KeyCount())
+}
@@ -3,53 +3,145 @@ package internal
 import (
 	"bufio"
 	"bytes"
+	"encoding/binary"
 	"errors"
+	"fmt"
+	"hash/crc32"
 	"io"
 	"os"
 	"path"
+	"sort"
+	"sync/atomic"
 
 	"github.com/emin/spacedb/helpers"
+	bloomfilter "github.com/emin/spacedb/internal/bloom_filter"
 )
 
 // echo spacedb | sha256sum
 // 3ea370ccd0bfa0298a144f0324a944e348e555d67200d2645a02f03cde67a09f
 const MagicNumber uint32 = 0xde67a09f
 
+// Magic number of flat tables which have a filter block
+const FilterMagicNumber uint32 = 0x3ea370cc
+
+// Magic number of tables whose footer has a format version
+const VersionedMagicNumber uint32 = 0xd0bfa029
+
+const (
+	// One flat data block and one index entry for each key
+	FormatFlat uint32 = 1
+	// Data blocks with restart points and one index entry for each block
+	FormatBlock uint32 = 2
+	// FormatBlock with a CRC32C checksum after each block
+	FormatChecksum uint32 = 3
+	// FormatChecksum with a compression type before each checksum
+	FormatCompressed uint32 = 4
+	// FormatCompressed with a range deletion block before the meta block.
+	// Tables without range tombstones are written in FormatCompressed
+	FormatRangeDeletion uint32 = 5
+)
+
+// Size of the compression type and checksum after each block
+const blockTrailerSize = 5
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var ErrUnsupportedFormat = errors.New("unsupported sstable format version")
+
+// Bits of the bloom filter for each key, about 1% of absent keys pass the filter
+const DefaultBitsPerKey = 10
+
 type SSTable struct {
+	// Checksums of blocks are verified on read when set, it is set by constructors
+	VerifyChecksums bool
+	// Compressor of blocks written by Save, nil means no compression
+	Compressor  Compressor
 	dbPath      string
 	name        string
 	file        *os.File
 	footerBlock *FooterBlock
-	MinKey      *[]byte
-	MaxKey      *[]byte
-	KeyCount    int64
+	filter      *bloomfilter.BloomFilter
+	index       *tableIndex
+	// set on tables of TableCache, it is called instead of closing the file
+	release func()
+	// data blocks are read through blockCache if it is set, index and
+	// filter blocks too if cacheMeta is set. Blocks are keyed by fileNum
+	blockCache *BlockCache
+	cacheMeta  bool
+	fileNum    uint64
+	MinKey     *[]byte
+	MaxKey     *[]byte
+	KeyCount   int64
+	// number of tombstones among KeyCount entries
+	DeletionCount int64
+	LargestSeq    uint64
+	// range tombstones of the table, loaded on first use
+	rangeTombstones *RangeTombstones
 }
 
 type FooterBlock struct {
-	DataOffset  uint64
-	DataLength  uint64
-	IndexOffset uint64
-	IndexLength uint64
-	MetaOffset  uint64
-	MetaLength  uint64
+	Version      uint32
+	DataOffset   uint64
+	DataLength   uint64
+	IndexOffset  uint64
+	IndexLength  uint64
+	FilterOffset uint64
+	FilterLength uint64
+	// range deletion block fills the space between filter and meta blocks
+	RangeDelOffset uint64
+	RangeDelLength uint64
+	MetaOffset     uint64
+	MetaLength     uint64
+}
+
+// Reports whether data blocks have restart points and the index has an entry for each block
+func (f *FooterBlock) blockBased() bool {
+	return f.Version >= FormatBlock
+}
+
+// Reports whether blocks are followed by checksums
+func (f *FooterBlock) checksummed() bool {
+	return f.Version >= FormatChecksum
+}
+
+// Returns size of the trailer after each block
+func (f *FooterBlock) trailerSize() int64 {
+	switch {
+	case f.Version >= FormatCompressed:
+		return blockTrailerSize
+	case f.Version == FormatChecksum:
+		return 4
+	}
+	return 0
 }
 
+// IndexBlock is an entry of the index. In flat tables it points to a record,
+// in block based tables Key is the last key of the data block at Pos
 type IndexBlock struct {
-	Pos int64
-	Key []byte
+	Pos  int64
+	Size int64
+	Key  []byte
 }
 
 type MetaBlock struct {
 	MinKey   *[]byte
 	MaxKey   *[]byte
 	FileName string
+	FileNum  uint64
 	KeyCount int64
+	// number of tombstones among KeyCount entries
+	DeletionCount int64
+	// largest sequence number of entries and range tombstones,
+	// MaxSequence if it isn't known
+	LargestSeq uint64
+	FileSize   int64
 }
 
 func NewSSTable(dbPath string, name string) *SSTable {
 	return &SSTable{
-		dbPath: dbPath,
-		name:   name,
+		dbPath:          dbPath,
+		name:            name,
+		VerifyChecksums: true,
 	}
 }
 
@@ -57,162 +149,379 @@ func NewSSTable(dbPath string, name string) *SSTable {
 //	SSTable format on Disk
 //
 //	  ---------------
-//   |   Data Block  |
+//   |  Data Blocks  |
 //   |---------------|
 //   |  Index Block  |
 //   |---------------|
+//   |  Filter Block |
+//   |---------------|
+//   |  Range Del    |
+//   |     Block     |
+//   |---------------|
 //	 |   Meta Block  |
 //   |---------------|
 //   |    Footer     |
 //    ---------------
 //
-//     Data Block
-//   ------------------------------------------
-//  | Key Len (4-bytes) | Key |  Value Len (4-bytes) | Value | .... |
-//   ------------------------------------------
+//     Data Blocks
+//   Data blocks of about BlockSize bytes with prefix compressed keys, see block.go
+//
+//     Every block is followed by its compression type and the CRC32C (Castagnoli)
+//   checksum of the block and the type
+//   -----------------------------------------------------------
+//  | Block | Compression Type (1-byte) | Checksum (4-bytes) |
+//   -----------------------------------------------------------
+//   Block lengths in the footer include the trailer, sizes in the index don't.
+//   Blocks are stored uncompressed when compression doesn't save at least 1/8
+//
+//     Keys of data, index and meta blocks are internal keys, see internal_key.go
 //
 //     Index Block
-//   ----------------------------------
-//  | Key Len (4-bytes) | Key | Position (8-bytes) | .... |
-//   ----------------------------------
+//   One entry for each data block, Key is the last key of the block
+//   ---------------------------------------------------------------------------------
+//  | Key Len (4-bytes) | Key | Block Offset (8-bytes) | Block Size (4-bytes) | .... |
+//   ---------------------------------------------------------------------------------
+//
+//     Filter Block
+//   Bloom filter of user keys, see BloomFilter.Encode. It is missing
+//   when the table is written without a filter, Filter Len is 0 then
+//
+//     Range Del Block
+//   One entry for each range tombstone, Start and End are user keys
+//   ---------------------------------------------------------------------------------
+//  | Start Len (4-bytes) | Start | End Len (4-bytes) | End | Sequence (8-bytes) | .... |
+//   ---------------------------------------------------------------------------------
+//   It is written only by FormatRangeDeletion tables which have range tombstones,
+//   its length is the space between the filter and meta blocks
 //
 //     Meta Block
 //   ------------------------------------------------------
-//  | Min Key Len (4-bytes) | Min Key | Max Key Len (4-bytes) | Max Key | Key Count (8-bytes) | .... |
+//  | Min Key Len (4-bytes) | Min Key | Max Key Len (4-bytes) | Max Key | Key Count (8-bytes) |
+//  | Deletion Count (8-bytes) | Largest Seq (8-bytes) |
 //   ------------------------------------------------------
+//   Key Count is the number of entries including tombstones, Deletion Count
+//   is the number of tombstones. Largest Seq is the largest sequence of entries
+//   and range tombstones. Min Key and Max Key cover range tombstones too.
+//   Older tables don't have Deletion Count and Largest Seq
 //
 //     Footer
-//   ----------------------------------------------------------------------------------------
-//  | Data Len (8-bytes) | Index Len (8-bytes) | Meta Len (4-bytes) | Magic Number (4-bytes) |
-//   ----------------------------------------------------------------------------------------
+//   -----------------------------------------------------------------------------------------
+//  | Data Len (8-bytes) | Index Len (8-bytes) | Meta Len (4-bytes) | Filter Len (4-bytes) |
+//  | Format Version (4-bytes) | VersionedMagicNumber (4-bytes) |
+//   -----------------------------------------------------------------------------------------
+//   Format Version is FormatRangeDeletion if the table has range tombstones,
+//   FormatCompressed otherwise
+//
+//   Older tables are flat (FormatFlat), their data block is a run of
+//   | Key Len (4-bytes) | Key | Value Len (4-bytes) | Value | .... |
+//   and their index has one | Key Len (4-bytes) | Key | Position (8-bytes) | entry for each key.
+//   Tables written before filter blocks existed don't have Filter Len and Format Version
+//   and end with MagicNumber, flat tables with a filter block don't have Format Version
+//   and end with FilterMagicNumber. FormatBlock tables don't have checksums,
+//   blocks of FormatChecksum tables don't have a compression type
 //
-// TODO: add key count to meta block
 // TODO: add creation order index to meta block
-// TODO: add compression support
-// TODO: variable length ints
 
 func (t *SSTable) Save(table MemTable) error {
-	fPath := path.Join(t.dbPath, t.name)
-	file, err := os.Create(fPath)
+	w, err := NewSSTableWriter(t.dbPath, t.name)
 	if err != nil {
 		return err
 	}
-	defer func() {
-		_ = file.Close()
-	}()
+	w.Compressor = t.Compressor
 
-	indexes := make([]*IndexBlock, 0)
-	w := bufio.NewWriter(file)
 	it := table.Iterator()
-	// write data block
-	var pos int64 = 0
 	for it.Next() {
-		key := it.Key()
-		val := it.Value()
-		err = helpers.WriteUint32(w, uint32(len(key)))
-		if err != nil {
-			return err
-		}
-		_, err = w.Write(key)
+		err = w.Add(it.Key(), it.Value())
 		if err != nil {
+			w.Abandon()
 			return err
 		}
+	}
+	for _, r := range table.RangeTombstones().List() {
+		w.AddRangeTombstone(r)
+	}
 
-		err = helpers.WriteUint32(w, uint32(len(val)))
-		if err != nil {
-			return err
-		}
-		_, err = w.Write(val)
-		if err != nil {
-			return err
-		}
-		indexes = append(indexes, &IndexBlock{
-			Key: key,
-			Pos: pos,
-		})
-		pos += int64(4 + len(key) + 4 + len(val))
+	meta, err := w.Finish()
+	if err != nil {
+		w.Abandon()
+		return err
 	}
-	dataLen := pos
-	// write index block
-	pos = 0
-	for _, idx := range indexes {
-		err = helpers.WriteUint32(w, uint32(len(idx.Key)))
-		if err != nil {
-			return err
+	t.MinKey = meta.MinKey
+	t.MaxKey = meta.MaxKey
+	t.KeyCount = meta.KeyCount
+	t.DeletionCount = meta.DeletionCount
+	t.LargestSeq = meta.LargestSeq
+	return nil
+}
+
+// SSTableWriter writes a block based SSTable incrementally.
+// Keys must be added in ascending order, Finish must be called
+// to write index, meta and footer blocks.
+type SSTableWriter struct {
+	name  string
+	file  *os.File
+	w     *bufio.Writer
+	block *blockBuilder
+	// one entry for each written data block
+	indexes  []*IndexBlock
+	pos      int64
+	minKey   []byte
+	lastKey  []byte
+	keyCount int64
+	// number of added tombstones
+	deletionCount int64
+	largestSeq    uint64
+	rangeDels     []RangeTombstone
+	// hashes of user keys for the filter block
+	hashes []uint32
+	// Bits of the filter for each key, no filter is written if it isn't
+	// positive. It must be set before the first Add
+	BitsPerKey int
+	// Compressor of blocks, nil means no compression.
+	// It must be set before the first Add
+	Compressor Compressor
+}
+
+func NewSSTableWriter(dbPath string, name string) (*SSTableWriter, error) {
+	file, err := os.Create(path.Join(dbPath, name))
+	if err != nil {
+		return nil, err
+	}
+	return &SSTableWriter{
+		name:       name,
+		file:       file,
+		w:          bufio.NewWriter(file),
+		block:      newBlockBuilder(),
+		indexes:    make([]*IndexBlock, 0),
+		BitsPerKey: DefaultBitsPerKey,
+	}, nil
+}
+
+// Adds a record to the current data block
+func (s *SSTableWriter) Add(key, val []byte) error {
+	if s.BitsPerKey > 0 {
+		// versions of a user key are added once
+		if s.keyCount == 0 || !bytes.Equal(encodedUserKey(s.lastKey), encodedUserKey(key)) {
+			s.hashes = append(s.hashes, bloomfilter.Hash(encodedUserKey(key)))
 		}
-		n, err := w.Write(idx.Key)
-		if err != nil {
-			return err
+	}
+	if s.keyCount == 0 {
+		s.minKey = append([]byte{}, key...)
+	}
+	s.block.add(key, val)
+	s.lastKey = append(s.lastKey[:0], key...)
+	s.keyCount++
+	if seq, kind, ok := parseTrailer(key); ok {
+		if kind == KindDelete {
+			s.deletionCount++
 		}
-		if n != len(idx.Key) {
-			return errors.New("write index key error")
+		if seq > s.largestSeq {
+			s.largestSeq = seq
 		}
+	}
+	if s.block.estimatedSize() >= BlockSize {
+		return s.flushBlock()
+	}
+	return nil
+}
+
+// Writes the current data block and adds its index entry
+func (s *SSTableWriter) flushBlock() error {
+	if s.block.empty() {
+		return nil
+	}
+	data, n, err := s.writeBlock(s.block.finish())
+	if err != nil {
+		return err
+	}
+	s.indexes = append(s.indexes, &IndexBlock{
+		Key:  append([]byte{}, s.lastKey...),
+		Pos:  s.pos,
+		Size: int64(len(data)),
+	})
+	s.pos += n
+	s.block.reset()
+	return nil
+}
 
-		err = helpers.WriteUint64(w, uint64(idx.Pos))
+// Writes a block followed by its trailer. Returns the stored block,
+// which may be compressed, and the number of bytes written
+func (s *SSTableWriter) writeBlock(data []byte) ([]byte, int64, error) {
+	typ := CompressionNone
+	if s.Compressor != nil && s.Compressor.Type() != CompressionNone {
+		compressed, err := s.Compressor.Compress(data)
 		if err != nil {
-			return err
+			return nil, 0, err
 		}
+		if len(compressed) < len(data)-len(data)/8 {
+			data = compressed
+			typ = s.Compressor.Type()
+		}
+	}
+	_, err := s.w.Write(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	err = s.w.WriteByte(byte(typ))
+	if err != nil {
+		return nil, 0, err
+	}
+	crc := crc32.Update(crc32.Checksum(data, crcTable), crcTable, []byte{byte(typ)})
+	err = helpers.WriteUint32(s.w, crc)
+	if err != nil {
+		return nil, 0, err
+	}
+	return data, int64(len(data) + blockTrailerSize), nil
+}
 
-		pos += int64(4 + len(idx.Key) + 8)
+// Returns size of the data blocks written so far
+func (s *SSTableWriter) Size() int64 {
+	if s.block.empty() {
+		return s.pos
 	}
-	indexLen := pos
+	return s.pos + int64(s.block.estimatedSize())
+}
 
-	// write meta block
-	minKey := indexes[0].Key
-	maxKey := indexes[len(indexes)-1].Key
-	t.MinKey = &minKey
-	t.MaxKey = &maxKey
-	t.KeyCount = int64(len(indexes))
+// Adds a range tombstone, tombstones can be added in any order.
+// Key range of the table is extended to cover them
+func (s *SSTableWriter) AddRangeTombstone(t RangeTombstone) {
+	s.rangeDels = append(s.rangeDels, RangeTombstone{Start: append([]byte{}, t.Start...), End: append([]byte{}, t.End...), Seq: t.Seq})
+	if t.Seq > s.largestSeq {
+		s.largestSeq = t.Seq
+	}
+}
 
-	err = helpers.WriteUint32(w, uint32(len(minKey)))
-	if err != nil {
-		return err
+// Writes index, meta and footer blocks, syncs and closes the file.
+// Returns metadata of the written table.
+func (s *SSTableWriter) Finish() (*MetaBlock, error) {
+	if s.keyCount == 0 && len(s.rangeDels) == 0 {
+		return nil, ErrEmptyTable
 	}
-	_, err = w.Write(minKey)
+	err := s.flushBlock()
 	if err != nil {
-		return err
+		return nil, err
 	}
+	dataLen := s.pos
 
-	err = helpers.WriteUint32(w, uint32(len(maxKey)))
-	if err != nil {
-		return err
+	// write index block
+	index := make([]byte, 0)
+	for _, idx := range s.indexes {
+		index = binary.LittleEndian.AppendUint32(index, uint32(len(idx.Key)))
+		index = append(index, idx.Key...)
+		index = binary.LittleEndian.AppendUint64(index, uint64(idx.Pos))
+		index = binary.LittleEndian.AppendUint32(index, uint32(idx.Size))
 	}
-	_, err = w.Write(maxKey)
+	_, indexLen, err := s.writeBlock(index)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	// write filter block
+	filterLen := int64(0)
+	if s.BitsPerKey > 0 {
+		_, filterLen, err = s.writeBlock(bloomfilter.NewBloomFilter(s.BitsPerKey, s.hashes).Encode())
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	err = helpers.WriteUint64(w, uint64(t.KeyCount))
+	// write range deletion block
+	rangeDelLen := int64(0)
+	version := FormatCompressed
+	if len(s.rangeDels) > 0 {
+		_, rangeDelLen, err = s.writeBlock(encodeRangeTombstones(s.rangeDels))
+		if err != nil {
+			return nil, err
+		}
+		version = FormatRangeDeletion
+	}
+
+	// write meta block
+	minKey := s.minKey
+	maxKey := append([]byte{}, s.lastKey...)
+	keyCount := s.keyCount
+	for _, t := range s.rangeDels {
+		// smallest internal keys of start and of the exclusive end
+		if start := SeekKey(t.Start, MaxSequence); minKey == nil || bytes.Compare(start, minKey) < 0 {
+			minKey = start
+		}
+		if end := SeekKey(t.End, MaxSequence); bytes.Compare(end, maxKey) > 0 {
+			maxKey = end
+		}
+	}
+
+	meta := binary.LittleEndian.AppendUint32(nil, uint32(len(minKey)))
+	meta = append(meta, minKey...)
+	meta = binary.LittleEndian.AppendUint32(meta, uint32(len(maxKey)))
+	meta = append(meta, maxKey...)
+	meta = binary.LittleEndian.AppendUint64(meta, uint64(keyCount))
+	meta = binary.LittleEndian.AppendUint64(meta, uint64(s.deletionCount))
+	meta = binary.LittleEndian.AppendUint64(meta, s.largestSeq)
+	_, metaLen, err := s.writeBlock(meta)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// write footer
-	metaLen := 4 + len(minKey) + 4 + len(maxKey) + 8
-
+	w := s.w
 	err = helpers.WriteUint64(w, uint64(dataLen))
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	err = helpers.WriteUint64(w, uint64(indexLen))
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	err = helpers.WriteUint32(w, uint32(metaLen))
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	err = helpers.WriteUint32(w, MagicNumber)
+	err = helpers.WriteUint32(w, uint32(filterLen))
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	err = helpers.WriteUint32(w, version)
+	if err != nil {
+		return nil, err
+	}
+
+	err = helpers.WriteUint32(w, VersionedMagicNumber)
+	if err != nil {
+		return nil, err
 	}
 
 	err = w.Flush()
+	if err != nil {
+		return nil, err
+	}
+	err = s.file.Sync()
+	if err != nil {
+		return nil, err
+	}
+	err = s.file.Close()
+	if err != nil {
+		return nil, err
+	}
 
-	return err
+	return &MetaBlock{
+		FileName:      s.name,
+		MinKey:        &minKey,
+		MaxKey:        &maxKey,
+		KeyCount:      keyCount,
+		DeletionCount: s.deletionCount,
+		LargestSeq:    s.largestSeq,
+		FileSize:      dataLen + indexLen + filterLen + rangeDelLen + metaLen + 32,
+	}, nil
+}
+
+// Closes and removes the partially written file
+func (s *SSTableWriter) Abandon() {
+	_ = s.file.Close()
+	_ = os.Remove(s.file.Name())
 }
 
 func (t *SSTable) openForRead() error {
@@ -226,91 +535,241 @@ func (t *SSTable) openForRead() error {
 }
 
 func (t *SSTable) CloseFile() {
-	if t.file != nil {
-		_ = t.file.Close()
+	_ = t.closeFile()
+}
+
+// Closes the file, tables of TableCache release it instead
+func (t *SSTable) closeFile() error {
+	if t.release != nil {
+		t.release()
+		t.release = nil
+		t.file = nil
+		return nil
 	}
+	if t.file == nil {
+		return nil
+	}
+	err := t.file.Close()
+	t.file = nil
+	return err
 }
 
+// Returns value of the record at pos which is returned by FindKeyInIndex
 func (t *SSTable) ReadValueAt(pos uint64) ([]byte, error) {
-	if t.file == nil {
-		err := t.openForRead()
+	if t.footerBlock == nil {
+		err := t.ReadFooter()
 		if err != nil {
 			return nil, err
 		}
 	}
-	_, err := t.file.Seek(int64(pos), 0)
+	if t.footerBlock.blockBased() {
+		return t.readBlockValueAt(pos)
+	}
+	rdr := bufio.NewReader(io.NewSectionReader(t.file, int64(pos), int64(t.footerBlock.DataLength)-int64(pos)))
+	keyLen, err := helpers.ReadUint32(rdr)
 	if err != nil {
 		return nil, err
 	}
-	keyLen, err := helpers.ReadUint32(t.file)
+	_, err = rdr.Discard(int(keyLen))
 	if err != nil {
 		return nil, err
 	}
-	key := make([]byte, keyLen)
-	_, err = io.ReadFull(t.file, key)
+	val, err := helpers.ReadSlice(rdr)
 	if err != nil {
 		return nil, err
 	}
-	valLen, err := helpers.ReadUint32(t.file)
+	return *val, nil
+}
+
+// Returns position of the record with key. In flat tables it is the file offset
+// of the record, in block based tables it is the block number in the upper 32 bits
+// and the offset of the record in the block in the lower 32 bits
+func (t *SSTable) FindKeyInIndex(key []byte) (uint64, error) {
+	ok, err := t.MayContain(key)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, ErrIndexNotFound
+	}
+	idx, err := t.loadIndex()
+	if err != nil {
+		return 0, err
+	}
+	i := idx.lowerBound(key)
+	if t.footerBlock.blockBased() {
+		if i == len(idx.entries) {
+			return 0, ErrIndexNotFound
+		}
+		it, err := t.openBlock(idx.entries[i])
+		if err != nil {
+			return 0, err
+		}
+		it.Seek(key)
+		if it.Err() != nil {
+			return 0, it.Err()
+		}
+		if !it.Valid() || !bytes.Equal(it.Key(), key) {
+			return 0, ErrIndexNotFound
+		}
+		return uint64(i)<<32 | uint64(it.current), nil
+	}
+	if i == len(idx.entries) || !bytes.Equal(idx.entries[i].Key, key) {
+		return 0, ErrIndexNotFound
+	}
+	return uint64(idx.entries[i].Pos), nil
+}
+
+func (t *SSTable) readBlockValueAt(pos uint64) ([]byte, error) {
+	idx, err := t.loadIndex()
 	if err != nil {
 		return nil, err
 	}
-	val := make([]byte, valLen)
-	_, err = io.ReadFull(t.file, val)
+	i := int(pos >> 32)
+	if i >= len(idx.entries) {
+		return nil, ErrIndexNotFound
+	}
+	it, err := t.openBlock(idx.entries[i])
 	if err != nil {
 		return nil, err
 	}
-	return val, nil
+	return it.valueAt(int(pos & 0xffffffff))
 }
 
-func (t *SSTable) FindKeyInIndex(key []byte) (uint64, error) {
-	if t.footerBlock == nil {
-		err := t.ReadFooter()
-		if err != nil {
-			return 0, err
+// Keys of the index and filter blocks in the block cache,
+// footer must be read before
+func (t *SSTable) indexCacheKey() BlockCacheKey {
+	return BlockCacheKey{FileNum: t.fileNum, Offset: int64(t.footerBlock.IndexOffset)}
+}
+
+func (t *SSTable) filterCacheKey() BlockCacheKey {
+	return BlockCacheKey{FileNum: t.fileNum, Offset: int64(t.footerBlock.FilterOffset)}
+}
+
+// Reads the data block of an index entry
+func (t *SSTable) readBlock(entry *IndexBlock) ([]byte, error) {
+	key := BlockCacheKey{FileNum: t.fileNum, Offset: entry.Pos}
+	if t.blockCache != nil {
+		if data, ok := t.blockCache.Get(key); ok {
+			return data.([]byte), nil
 		}
 	}
-	_, err := t.file.Seek(int64(t.footerBlock.IndexOffset), 0)
+	data, err := t.readBlockAt(entry.Pos, entry.Size+t.footerBlock.trailerSize())
 	if err != nil {
-		return 0, err
+		return nil, err
+	}
+	if t.blockCache != nil {
+		t.blockCache.Insert(key, data, int64(len(data)))
 	}
+	return data, nil
+}
 
-	rdr := bufio.NewReader(t.file)
+// Reads length bytes of the file at offset. If the table has block trailers,
+// the checksum is verified and the block is decompressed
+func (t *SSTable) readBlockAt(offset, length int64) ([]byte, error) {
+	data := make([]byte, length)
+	_, err := t.file.ReadAt(data, offset)
+	if err == io.EOF {
+		return nil, t.corruption(offset, "truncated block")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !t.footerBlock.checksummed() {
+		return data, nil
+	}
+	// checksum covers the block and its compression type
+	n := length - 4
+	if n < 0 || n < t.footerBlock.trailerSize()-4 {
+		return nil, t.corruption(offset, "truncated block")
+	}
+	if t.VerifyChecksums && crc32.Checksum(data[:n], crcTable) != binary.LittleEndian.Uint32(data[n:]) {
+		return nil, t.corruption(offset, "checksum mismatch")
+	}
+	if t.footerBlock.Version < FormatCompressed {
+		return data[:n], nil
+	}
+	typ := CompressionType(data[n-1])
+	if typ == CompressionNone {
+		return data[:n-1], nil
+	}
+	c, err := compressorOf(typ)
+	if err != nil {
+		return nil, fmt.Errorf("%w %d in %s", err, typ, path.Join(t.dbPath, t.name))
+	}
+	block, err := c.Decompress(data[:n-1])
+	if err != nil {
+		return nil, t.corruption(offset, err.Error())
+	}
+	return block, nil
+}
 
-	c := int64(0)
-	idxLen := int64(t.footerBlock.IndexLength)
-	i := 0
+func (t *SSTable) corruption(offset int64, reason string) error {
+	return &CorruptionError{File: path.Join(t.dbPath, t.name), Offset: offset, Reason: reason}
+}
 
-	for c < idxLen {
+func (t *SSTable) openBlock(entry *IndexBlock) (*blockIter, error) {
+	data, err := t.readBlock(entry)
+	if err != nil {
+		return nil, err
+	}
+	it, err := newBlockIter(data)
+	if err != nil {
+		return nil, t.corruption(entry.Pos, err.Error())
+	}
+	return it, nil
+}
 
-		keyLen, err := helpers.ReadUint32(rdr)
-		if err != nil {
-			return 0, err
-		}
+// Returns the first index entry whose key is >= key, in block based
+// tables it is the entry of the block which may have key.
+// Returns nil if all keys of the table are smaller
+func (t *SSTable) LowerBound(key []byte) (*IndexBlock, error) {
+	idx, err := t.loadIndex()
+	if err != nil {
+		return nil, err
+	}
+	i := idx.lowerBound(key)
+	if i == len(idx.entries) {
+		return nil, nil
+	}
+	return idx.entries[i], nil
+}
 
-		curKey := make([]byte, keyLen)
+// tableIndex is the index block of a table loaded in memory,
+// entries are sorted by key
+type tableIndex struct {
+	entries []*IndexBlock
+}
 
-		n, err := io.ReadFull(rdr, curKey)
+// Returns position of the first entry whose key is >= key,
+// number of entries if there is no such entry
+func (x *tableIndex) lowerBound(key []byte) int {
+	return sort.Search(len(x.entries), func(i int) bool {
+		return bytes.Compare(x.entries[i].Key, key) >= 0
+	})
+}
 
-		if err != nil {
-			return 0, err
-		}
-		if n != int(keyLen) {
-			return 0, ErrIndexReadError
-		}
-		if bytes.Equal(key, curKey) {
-			pos, err := helpers.ReadUint64(rdr)
-			if err != nil {
-				return 0, err
-			}
-			return pos, nil
-		} else {
-			rdr.Discard(8)
+// Reads the index block once, it is read through the
+// block cache if the table caches its index and filter
+func (t *SSTable) loadIndex() (*tableIndex, error) {
+	if t.index != nil {
+		return t.index, nil
+	}
+	if t.cacheMeta {
+		if idx, ok := t.blockCache.Get(t.indexCacheKey()); ok {
+			t.index = idx.(*tableIndex)
+			return t.index, nil
 		}
-		c += int64(keyLen) + 12 // key len + key + pos
-		i++
 	}
-	return 0, ErrIndexNotFound
+	entries, err := t.readIndex()
+	if err != nil {
+		return nil, err
+	}
+	t.index = &tableIndex{entries: entries}
+	if t.cacheMeta {
+		t.blockCache.Insert(t.indexCacheKey(), t.index, int64(t.footerBlock.IndexLength))
+	}
+	return t.index, nil
 }
 
 func (t *SSTable) ReadMeta() error {
@@ -320,28 +779,45 @@ func (t *SSTable) ReadMeta() error {
 			return err
 		}
 	}
-	_, err := t.file.Seek(int64(t.footerBlock.MetaOffset), 0)
+	offset := int64(t.footerBlock.MetaOffset)
+	data, err := t.readBlockAt(offset, int64(t.footerBlock.MetaLength))
 	if err != nil {
 		return err
 	}
-	rdr := bufio.NewReader(t.file)
+	rdr := bytes.NewReader(data)
 	minKey, err := helpers.ReadSlice(rdr)
 	if err != nil {
-		return err
+		return t.corruption(offset, "invalid meta block")
 	}
 	t.MinKey = minKey
 	maxKey, err := helpers.ReadSlice(rdr)
 	if err != nil {
-		return err
+		return t.corruption(offset, "invalid meta block")
 	}
 	t.MaxKey = maxKey
 
 	keyCount, err := helpers.ReadUint64(rdr)
 	if err != nil {
-		return err
+		return t.corruption(offset, "invalid meta block")
 	}
 	t.KeyCount = int64(keyCount)
 
+	t.DeletionCount = 0
+	if rdr.Len() > 0 {
+		deletionCount, err := helpers.ReadUint64(rdr)
+		if err != nil {
+			return t.corruption(offset, "invalid meta block")
+		}
+		t.DeletionCount = int64(deletionCount)
+	}
+	t.LargestSeq = MaxSequence
+	if rdr.Len() > 0 {
+		t.LargestSeq, err = helpers.ReadUint64(rdr)
+		if err != nil {
+			return t.corruption(offset, "invalid meta block")
+		}
+	}
+
 	return nil
 }
 
@@ -352,11 +828,35 @@ func (t *SSTable) ReadFooter() error {
 			return err
 		}
 	}
-	_, err := t.file.Seek(-24, 2)
+	info, err := t.file.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+	if size < 24 {
+		return t.corruption(0, "file is smaller than footer")
+	}
+	magic := make([]byte, 4)
+	_, err = t.file.ReadAt(magic, size-4)
 	if err != nil {
 		return err
 	}
-	rdr := bufio.NewReader(t.file)
+	magicNum := binary.LittleEndian.Uint32(magic)
+	footerLen := int64(24)
+	switch magicNum {
+	case MagicNumber:
+	case FilterMagicNumber:
+		footerLen = 28
+	case VersionedMagicNumber:
+		footerLen = 32
+	default:
+		return errors.New("magic number doesn't match")
+	}
+
+	if size < footerLen {
+		return t.corruption(0, "file is smaller than footer")
+	}
+	rdr := io.NewSectionReader(t.file, size-footerLen, footerLen)
 	dataLen, err := helpers.ReadUint64(rdr)
 	if err != nil {
 		return err
@@ -369,23 +869,502 @@ func (t *SSTable) ReadFooter() error {
 	if err != nil {
 		return err
 	}
-	magicNum, err := helpers.ReadUint32(rdr)
+	filterLen := uint32(0)
+	if magicNum != MagicNumber {
+		filterLen, err = helpers.ReadUint32(rdr)
+		if err != nil {
+			return err
+		}
+	}
+	version := FormatFlat
+	if magicNum == VersionedMagicNumber {
+		version, err = helpers.ReadUint32(rdr)
+		if err != nil {
+			return err
+		}
+		if version < FormatFlat || version > FormatRangeDeletion {
+			return ErrUnsupportedFormat
+		}
+	}
+
+	rangeDelOffset := dataLen + indexLen + uint64(filterLen)
+	metaOffset := uint64(size-footerLen) - uint64(metaLen)
+	if uint64(size-footerLen) < uint64(metaLen) || metaOffset < rangeDelOffset ||
+		(version < FormatRangeDeletion && metaOffset != rangeDelOffset) {
+		return t.corruption(size-footerLen, "block lengths don't match file size")
+	}
+	t.footerBlock = &FooterBlock{
+		Version:        version,
+		DataOffset:     0,
+		DataLength:     uint64(dataLen),
+		IndexOffset:    uint64(dataLen),
+		IndexLength:    uint64(indexLen),
+		FilterOffset:   uint64(dataLen + indexLen),
+		FilterLength:   uint64(filterLen),
+		RangeDelOffset: rangeDelOffset,
+		RangeDelLength: metaOffset - rangeDelOffset,
+		MetaOffset:     metaOffset,
+		MetaLength:     uint64(metaLen),
+	}
+
+	return nil
+}
+
+// Reports whether the table may have the user key of given key.
+// Filter block is read on first call, tables without a filter may have any key
+func (t *SSTable) MayContain(key []byte) (bool, error) {
+	if t.footerBlock == nil {
+		err := t.ReadFooter()
+		if err != nil {
+			return false, err
+		}
+	}
+	if t.footerBlock.FilterLength == 0 {
+		return true, nil
+	}
+	err := t.loadFilter()
+	if err != nil {
+		return false, err
+	}
+	return t.filter.MayContain(encodedUserKey(key)), nil
+}
+
+// Returns range tombstones of the table, the range deletion
+// block is read on first call. Footer must be read before
+func (t *SSTable) RangeTombstones() (*RangeTombstones, error) {
+	if t.rangeTombstones != nil {
+		return t.rangeTombstones, nil
+	}
+	if t.footerBlock.RangeDelLength == 0 {
+		t.rangeTombstones = NewRangeTombstones(nil)
+		return t.rangeTombstones, nil
+	}
+	offset := int64(t.footerBlock.RangeDelOffset)
+	data, err := t.readBlockAt(offset, int64(t.footerBlock.RangeDelLength))
+	if err != nil {
+		return nil, err
+	}
+	list, err := decodeRangeTombstones(data)
+	if err != nil {
+		return nil, t.corruption(offset, err.Error())
+	}
+	t.rangeTombstones = NewRangeTombstones(list)
+	return t.rangeTombstones, nil
+}
+
+// Reads the filter block once, footer must be read before
+func (t *SSTable) loadFilter() error {
+	if t.filter != nil || t.footerBlock.FilterLength == 0 {
+		return nil
+	}
+	offset := int64(t.footerBlock.FilterOffset)
+	key := t.filterCacheKey()
+	if t.cacheMeta {
+		if filter, ok := t.blockCache.Get(key); ok {
+			t.filter = filter.(*bloomfilter.BloomFilter)
+			return nil
+		}
+	}
+	data, err := t.readBlockAt(offset, int64(t.footerBlock.FilterLength))
 	if err != nil {
 		return err
 	}
+	t.filter, err = bloomfilter.DecodeBloomFilter(data)
+	if err != nil {
+		return t.corruption(offset, err.Error())
+	}
+	if t.cacheMeta {
+		t.blockCache.Insert(key, t.filter, int64(t.footerBlock.FilterLength))
+	}
+	return nil
+}
 
-	if magicNum != MagicNumber {
-		return errors.New("magic number doesn't match")
+// FilterStats counts bloom filter checks of table lookups
+type FilterStats struct {
+	// lookups which are ruled out by the filter without reading the index
+	Misses atomic.Int64
+	// lookups which pass the filter
+	Hits atomic.Int64
+	// lookups which pass the filter but don't find the key
+	FalsePositives atomic.Int64
+}
+
+// Returns value and sequence number of the newest version of the user key
+// in lookup which is visible at the sequence of lookup. lookup must be made
+// by SeekKey. The filter is checked before the index is read, stats can be nil
+func (t *SSTable) Get(lookup []byte, stats *FilterStats) ([]byte, uint64, bool, error) {
+	defer t.CloseFile()
+	ok, err := t.MayContain(lookup)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	if !ok {
+		if stats != nil {
+			stats.Misses.Add(1)
+		}
+		return nil, 0, false, nil
+	}
+	if stats != nil {
+		stats.Hits.Add(1)
 	}
 
-	t.footerBlock = &FooterBlock{
-		DataOffset:  0,
-		DataLength:  uint64(dataLen),
-		IndexOffset: uint64(dataLen),
-		IndexLength: uint64(indexLen),
-		MetaOffset:  uint64(dataLen + indexLen),
-		MetaLength:  uint64(metaLen),
+	it, err := t.SeekIterator()
+	if err != nil {
+		return nil, 0, false, err
+	}
+	defer it.Close()
+	val, seq, found, err := Lookup(it, lookup)
+	if err == nil && !found && stats != nil {
+		stats.FalsePositives.Add(1)
 	}
+	return val, seq, found, err
+}
 
-	return nil
+// SSTableIterator reads records of an SSTable sequentially.
+// It implements Iterator, read errors can be checked with Err
+type SSTableIterator struct {
+	rdr       *bufio.Reader
+	remaining int64
+	// iterator over data blocks of block based tables
+	blocks  SeekIterator
+	started bool
+	key     []byte
+	value   []byte
+	err     error
+}
+
+// Returns an iterator over all records of the table in key order
+func (t *SSTable) Iterator() (*SSTableIterator, error) {
+	if t.footerBlock == nil {
+		err := t.ReadFooter()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if t.footerBlock.blockBased() {
+		return &SSTableIterator{blocks: &blockTableIterator{table: t}}, nil
+	}
+	data := io.NewSectionReader(t.file, int64(t.footerBlock.DataOffset), int64(t.footerBlock.DataLength))
+	return &SSTableIterator{
+		rdr:       bufio.NewReader(data),
+		remaining: int64(t.footerBlock.DataLength),
+	}, nil
+}
+
+func (it *SSTableIterator) Next() bool {
+	it.key = nil
+	it.value = nil
+	if it.blocks != nil {
+		return it.nextInBlocks()
+	}
+	if it.err != nil || it.remaining <= 0 {
+		return false
+	}
+	key, err := helpers.ReadSlice(it.rdr)
+	if err != nil {
+		it.err = err
+		return false
+	}
+	val, err := helpers.ReadSlice(it.rdr)
+	if err != nil {
+		it.err = err
+		return false
+	}
+	it.key = *key
+	it.value = *val
+	it.remaining -= int64(4 + len(it.key) + 4 + len(it.value))
+	return true
+}
+
+func (it *SSTableIterator) nextInBlocks() bool {
+	if it.err != nil {
+		return false
+	}
+	if !it.started {
+		it.started = true
+		it.blocks.SeekToFirst()
+	} else if it.blocks.Valid() {
+		it.blocks.Next()
+	}
+	if !it.blocks.Valid() {
+		it.err = it.blocks.Err()
+		return false
+	}
+	it.key = it.blocks.Key()
+	it.value = it.blocks.Value()
+	return true
+}
+
+func (it *SSTableIterator) Key() []byte {
+	return it.key
+}
+
+func (it *SSTableIterator) Value() []byte {
+	return it.value
+}
+
+// Returns the first error encountered while reading the table
+func (it *SSTableIterator) Err() error {
+	return it.err
+}
+
+// Reads all entries of the index block
+func (t *SSTable) readIndex() ([]*IndexBlock, error) {
+	if t.footerBlock == nil {
+		err := t.ReadFooter()
+		if err != nil {
+			return nil, err
+		}
+	}
+	offset := int64(t.footerBlock.IndexOffset)
+	data, err := t.readBlockAt(offset, int64(t.footerBlock.IndexLength))
+	if err != nil {
+		return nil, err
+	}
+	rdr := bytes.NewReader(data)
+	indexes := make([]*IndexBlock, 0)
+	for rdr.Len() > 0 {
+		key, err := helpers.ReadSlice(rdr)
+		if err != nil {
+			return nil, t.corruption(offset, "invalid index block")
+		}
+		pos, err := helpers.ReadUint64(rdr)
+		if err != nil {
+			return nil, t.corruption(offset, "invalid index block")
+		}
+		entry := &IndexBlock{Key: *key, Pos: int64(pos)}
+		if t.footerBlock.blockBased() {
+			size, err := helpers.ReadUint32(rdr)
+			if err != nil {
+				return nil, t.corruption(offset, "invalid index block")
+			}
+			entry.Size = int64(size)
+		}
+		indexes = append(indexes, entry)
+	}
+	return indexes, nil
+}
+
+// sstableSeekIterator implements SeekIterator over the index of a flat table.
+// Index is loaded on first positioning and values are read when requested
+type sstableSeekIterator struct {
+	table    *SSTable
+	indexes  []*IndexBlock
+	index    *tableIndex
+	idx      int
+	value    []byte
+	valueIdx int
+	err      error
+}
+
+// Returns a SeekIterator over the table. The file is opened
+// right away and kept open until the iterator is closed,
+// so the iterator keeps working if the file is removed meanwhile.
+// The table shouldn't be used for other reads until it is closed.
+func (t *SSTable) SeekIterator() (SeekIterator, error) {
+	if t.file == nil {
+		err := t.openForRead()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if t.footerBlock == nil {
+		err := t.ReadFooter()
+		if err != nil {
+			t.CloseFile()
+			t.file = nil
+			return nil, err
+		}
+	}
+	if t.footerBlock.blockBased() {
+		return &blockTableIterator{table: t, blockIdx: -1}, nil
+	}
+	return &sstableSeekIterator{table: t, idx: -1, valueIdx: -1}, nil
+}
+
+func (s *sstableSeekIterator) load() bool {
+	if s.index == nil && s.err == nil {
+		s.index, s.err = s.table.loadIndex()
+		if s.err == nil {
+			s.indexes = s.index.entries
+		}
+	}
+	if s.err != nil {
+		s.idx = -1
+		return false
+	}
+	return true
+}
+
+func (s *sstableSeekIterator) Valid() bool {
+	return s.err == nil && s.idx >= 0 && s.idx < len(s.indexes)
+}
+
+func (s *sstableSeekIterator) SeekToFirst() {
+	if s.load() {
+		s.idx = 0
+	}
+}
+
+func (s *sstableSeekIterator) SeekToLast() {
+	if s.load() {
+		s.idx = len(s.indexes) - 1
+	}
+}
+
+func (s *sstableSeekIterator) Seek(key []byte) {
+	if s.load() {
+		s.idx = s.index.lowerBound(key)
+	}
+}
+
+func (s *sstableSeekIterator) Next() {
+	s.idx++
+}
+
+func (s *sstableSeekIterator) Prev() {
+	s.idx--
+}
+
+func (s *sstableSeekIterator) Key() []byte {
+	return s.indexes[s.idx].Key
+}
+
+func (s *sstableSeekIterator) Value() []byte {
+	if s.valueIdx != s.idx {
+		val, err := s.table.ReadValueAt(uint64(s.indexes[s.idx].Pos))
+		if err != nil {
+			s.err = err
+			return nil
+		}
+		s.value = val
+		s.valueIdx = s.idx
+	}
+	return s.value
+}
+
+func (s *sstableSeekIterator) Err() error {
+	return s.err
+}
+
+func (s *sstableSeekIterator) Close() error {
+	return s.table.closeFile()
+}
+
+// blockTableIterator implements SeekIterator over a block based table.
+// Index is loaded on first positioning and data blocks are read when reached
+type blockTableIterator struct {
+	table    *SSTable
+	index    *tableIndex
+	blockIdx int
+	block    *blockIter
+	err      error
+}
+
+func (b *blockTableIterator) load() bool {
+	if b.index == nil && b.err == nil {
+		b.index, b.err = b.table.loadIndex()
+	}
+	if b.err != nil {
+		b.block = nil
+		return false
+	}
+	return true
+}
+
+// Positions at block i, returns false if there is no such block
+func (b *blockTableIterator) loadBlock(i int) bool {
+	b.block = nil
+	b.blockIdx = i
+	if i < 0 || i >= len(b.index.entries) {
+		return false
+	}
+	b.block, b.err = b.table.openBlock(b.index.entries[i])
+	if b.err != nil {
+		b.block = nil
+		return false
+	}
+	return true
+}
+
+// Moves to the first entry of the next blocks while the current block is exhausted
+func (b *blockTableIterator) skipForward() {
+	for b.block != nil && !b.block.Valid() {
+		if b.block.Err() != nil {
+			b.err = b.block.Err()
+			b.block = nil
+			return
+		}
+		if !b.loadBlock(b.blockIdx + 1) {
+			return
+		}
+		b.block.SeekToFirst()
+	}
+}
+
+// Moves to the last entry of the previous blocks while the current block is exhausted
+func (b *blockTableIterator) skipBackward() {
+	for b.block != nil && !b.block.Valid() {
+		if b.block.Err() != nil {
+			b.err = b.block.Err()
+			b.block = nil
+			return
+		}
+		if !b.loadBlock(b.blockIdx - 1) {
+			return
+		}
+		b.block.SeekToLast()
+	}
+}
+
+func (b *blockTableIterator) Valid() bool {
+	return b.err == nil && b.block != nil && b.block.Valid()
+}
+
+func (b *blockTableIterator) SeekToFirst() {
+	if b.load() && b.loadBlock(0) {
+		b.block.SeekToFirst()
+		b.skipForward()
+	}
+}
+
+func (b *blockTableIterator) SeekToLast() {
+	if b.load() && b.loadBlock(len(b.index.entries)-1) {
+		b.block.SeekToLast()
+		b.skipBackward()
+	}
+}
+
+func (b *blockTableIterator) Seek(key []byte) {
+	// the first block whose last key is >= key has the entry
+	if b.load() && b.loadBlock(b.index.lowerBound(key)) {
+		b.block.Seek(key)
+		b.skipForward()
+	}
+}
+
+func (b *blockTableIterator) Next() {
+	b.block.Next()
+	b.skipForward()
+}
+
+func (b *blockTableIterator) Prev() {
+	b.block.Prev()
+	b.skipBackward()
+}
+
+func (b *blockTableIterator) Key() []byte {
+	return b.block.Key()
+}
+
+func (b *blockTableIterator) Value() []byte {
+	return b.block.Value()
+}
+
+func (b *blockTableIterator) Err() error {
+	return b.err
+}
+
+func (b *blockTableIterator) Close() error {
+	return b.table.closeFile()
 }
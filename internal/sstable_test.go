@@ -1,11 +1,16 @@
 package internal
 
 import (
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"log"
 	"os"
 	"path"
+	"strings"
 	"testing"
 
+	bloomfilter "github.com/emin/spacedb/internal/bloom_filter"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -83,6 +88,27 @@ func TestSSTable_ReadMeta(t *testing.T) {
 	assert.Equal(t, []byte("ca1"), *ss.MaxKey)
 }
 
+func TestSSTable_DeletionCount(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+	ss := NewSSTable(testPath(), "0.db")
+	l := NewMemTable()
+	l.Set(MakeInternalKey([]byte("a"), 3, KindDelete), nil)
+	l.Set(MakeInternalKey([]byte("a"), 1, KindSet), []byte("v"))
+	l.Set(MakeInternalKey([]byte("b"), 2, KindSet), []byte("v"))
+	assert.Equal(t, int64(1), l.DeletionCount())
+	assert.Nil(t, ss.Save(l))
+	assert.Equal(t, int64(3), ss.KeyCount)
+	assert.Equal(t, int64(1), ss.DeletionCount)
+
+	ss = NewSSTable(testPath(), "0.db")
+	err := ss.ReadMeta()
+	ss.CloseFile()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), ss.KeyCount)
+	assert.Equal(t, int64(1), ss.DeletionCount)
+}
+
 func TestSSTable_FindKeyInIndex(t *testing.T) {
 	beforeTest()
 	defer afterTest()
@@ -133,3 +159,384 @@ func TestSSTable_ReadValueAt(t *testing.T) {
 		assert.Equal(t, test.want, value)
 	}
 }
+
+func TestSSTable_Get(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+	l := NewMemTable()
+	for i := 0; i < 100; i++ {
+		l.Set(MakeInternalKey([]byte(fmt.Sprintf("k%03d", i*2)), 1, KindSet), []byte("v"))
+	}
+	assert.Nil(t, NewSSTable(testPath(), "0.db").Save(l))
+
+	stats := &FilterStats{}
+	for i := 0; i < 100; i++ {
+		val, _, found, err := NewSSTable(testPath(), "0.db").Get(SeekKey([]byte(fmt.Sprintf("k%03d", i*2)), 1), stats)
+		assert.Nil(t, err)
+		assert.True(t, found)
+		assert.Equal(t, []byte("v"), val)
+
+		_, _, found, err = NewSSTable(testPath(), "0.db").Get(SeekKey([]byte(fmt.Sprintf("k%03d", i*2+1)), 1), stats)
+		assert.Nil(t, err)
+		assert.False(t, found)
+	}
+	assert.Equal(t, int64(200), stats.Hits.Load()+stats.Misses.Load())
+	assert.True(t, stats.Misses.Load() > 90)
+	assert.Equal(t, stats.Hits.Load()-100, stats.FalsePositives.Load())
+}
+
+// Writes a flat table as it was written before block based tables,
+// filterBits 0 writes the footer of tables without filter blocks
+func saveFlatTestTable(t *testing.T, name string, filterBits int, kv ...string) {
+	data := make([]byte, 0)
+	index := make([]byte, 0)
+	hashes := make([]uint32, 0)
+	for i := 0; i < len(kv); i += 2 {
+		index = binary.LittleEndian.AppendUint32(index, uint32(len(kv[i])))
+		index = append(index, kv[i]...)
+		index = binary.LittleEndian.AppendUint64(index, uint64(len(data)))
+		data = binary.LittleEndian.AppendUint32(data, uint32(len(kv[i])))
+		data = append(data, kv[i]...)
+		data = binary.LittleEndian.AppendUint32(data, uint32(len(kv[i+1])))
+		data = append(data, kv[i+1]...)
+		hashes = append(hashes, bloomfilter.Hash([]byte(kv[i])))
+	}
+	filter := make([]byte, 0)
+	if filterBits > 0 {
+		filter = bloomfilter.NewBloomFilter(filterBits, hashes).Encode()
+	}
+	meta := binary.LittleEndian.AppendUint32(nil, uint32(len(kv[0])))
+	meta = append(meta, kv[0]...)
+	meta = binary.LittleEndian.AppendUint32(meta, uint32(len(kv[len(kv)-2])))
+	meta = append(meta, kv[len(kv)-2]...)
+	meta = binary.LittleEndian.AppendUint64(meta, uint64(len(kv)/2))
+
+	file := append(append(append(data, index...), filter...), meta...)
+	file = binary.LittleEndian.AppendUint64(file, uint64(len(data)))
+	file = binary.LittleEndian.AppendUint64(file, uint64(len(index)))
+	file = binary.LittleEndian.AppendUint32(file, uint32(len(meta)))
+	if filterBits > 0 {
+		file = binary.LittleEndian.AppendUint32(file, uint32(len(filter)))
+		file = binary.LittleEndian.AppendUint32(file, FilterMagicNumber)
+	} else {
+		file = binary.LittleEndian.AppendUint32(file, MagicNumber)
+	}
+	assert.Nil(t, os.WriteFile(path.Join(testPath(), name), file, 0644))
+}
+
+func TestSSTable_ReadTableWithoutFilter(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+	saveFlatTestTable(t, "0.db", 0, "aa1", "test1", "ab1", "test2")
+
+	ss := NewSSTable(testPath(), "0.db")
+	defer ss.CloseFile()
+	assert.Nil(t, ss.ReadMeta())
+	assert.Equal(t, int64(2), ss.KeyCount)
+	ok, err := ss.MayContain([]byte("zz"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	pos, err := ss.FindKeyInIndex([]byte("ab1"))
+	assert.Nil(t, err)
+	value, err := ss.ReadValueAt(pos)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("test2"), value)
+}
+
+func TestSSTable_ReadFlatTable(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+	kv := make([]string, 0)
+	for i := 0; i < 100; i++ {
+		kv = append(kv, fmt.Sprintf("k%03d", i), fmt.Sprintf("v%d", i))
+	}
+	saveFlatTestTable(t, "0.db", DefaultBitsPerKey, kv...)
+
+	ss := NewSSTable(testPath(), "0.db")
+	assert.Nil(t, ss.ReadFooter())
+	assert.Equal(t, FormatFlat, ss.footerBlock.Version)
+	ss.CloseFile()
+
+	it, err := NewSSTable(testPath(), "0.db").SeekIterator()
+	assert.Nil(t, err)
+	defer it.Close()
+	it.Seek([]byte("k050"))
+	assert.True(t, it.Valid())
+	assert.Equal(t, []byte("v50"), it.Value())
+	it.Prev()
+	assert.Equal(t, []byte("k049"), it.Key())
+	it.SeekToLast()
+	assert.Equal(t, []byte("k099"), it.Key())
+}
+
+func TestSSTable_Blocks(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+	w, err := NewSSTableWriter(testPath(), "0.db")
+	assert.Nil(t, err)
+	for i := 0; i < 5000; i++ {
+		assert.Nil(t, w.Add([]byte(fmt.Sprintf("key%05d", i)), []byte(fmt.Sprintf("value%d", i))))
+	}
+	meta, err := w.Finish()
+	assert.Nil(t, err)
+
+	ss := NewSSTable(testPath(), meta.FileName)
+	assert.Nil(t, ss.ReadFooter())
+	assert.Equal(t, FormatCompressed, ss.footerBlock.Version)
+	idx, err := ss.loadIndex()
+	assert.Nil(t, err)
+	// sparse index has an entry for each block
+	assert.True(t, len(idx.entries) > 1)
+	assert.True(t, len(idx.entries) < 100)
+	ss.CloseFile()
+
+	ss = NewSSTable(testPath(), meta.FileName)
+	it, err := ss.Iterator()
+	assert.Nil(t, err)
+	count := 0
+	for it.Next() {
+		assert.Equal(t, []byte(fmt.Sprintf("key%05d", count)), it.Key())
+		count++
+	}
+	assert.Nil(t, it.Err())
+	assert.Equal(t, 5000, count)
+	ss.CloseFile()
+
+	sit, err := NewSSTable(testPath(), meta.FileName).SeekIterator()
+	assert.Nil(t, err)
+	defer sit.Close()
+	sit.Seek([]byte("key01234x"))
+	assert.Equal(t, []byte("key01235"), sit.Key())
+	// crosses block boundaries backwards
+	count = 0
+	for ; sit.Valid(); sit.Prev() {
+		count++
+	}
+	assert.Nil(t, sit.Err())
+	assert.Equal(t, 1236, count)
+	sit.SeekToLast()
+	assert.Equal(t, []byte("value4999"), sit.Value())
+	sit.Seek([]byte("zzz"))
+	assert.False(t, sit.Valid())
+
+	ss = NewSSTable(testPath(), meta.FileName)
+	defer ss.CloseFile()
+	pos, err := ss.FindKeyInIndex([]byte("key03333"))
+	assert.Nil(t, err)
+	value, err := ss.ReadValueAt(pos)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value3333"), value)
+	_, err = ss.FindKeyInIndex([]byte("key03333x"))
+	assert.Equal(t, ErrIndexNotFound, err)
+}
+
+func TestSSTable_Corruption(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+	w, err := NewSSTableWriter(testPath(), "0.db")
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, w.Add([]byte(fmt.Sprintf("key%04d", i)), []byte(fmt.Sprintf("value%d", i))))
+	}
+	meta, err := w.Finish()
+	assert.Nil(t, err)
+
+	// flip a bit of a value in the second data block
+	ss := NewSSTable(testPath(), meta.FileName)
+	idx, err := ss.loadIndex()
+	assert.Nil(t, err)
+	second := idx.entries[1]
+	ss.CloseFile()
+	fPath := path.Join(testPath(), "0.db")
+	data, err := os.ReadFile(fPath)
+	assert.Nil(t, err)
+	data[second.Pos+second.Size/2] ^= 0x01
+	assert.Nil(t, os.WriteFile(fPath, data, 0644))
+
+	// the first block is still readable
+	sit, err := NewSSTable(testPath(), meta.FileName).SeekIterator()
+	assert.Nil(t, err)
+	sit.Seek([]byte("key0000"))
+	assert.True(t, sit.Valid())
+	assert.Equal(t, []byte("value0"), sit.Value())
+	sit.Close()
+
+	ss = NewSSTable(testPath(), meta.FileName)
+	it, err := ss.Iterator()
+	assert.Nil(t, err)
+	for it.Next() {
+	}
+	err = it.Err()
+	ss.CloseFile()
+	assert.ErrorIs(t, err, ErrCorruption)
+	var corruption *CorruptionError
+	assert.ErrorAs(t, err, &corruption)
+	assert.Equal(t, fPath, corruption.File)
+	assert.Equal(t, second.Pos, corruption.Offset)
+
+	ss = NewSSTable(testPath(), meta.FileName)
+	ss.VerifyChecksums = false
+	it, err = ss.Iterator()
+	assert.Nil(t, err)
+	count := 0
+	for it.Next() {
+		count++
+	}
+	assert.Nil(t, it.Err())
+	assert.Equal(t, 1000, count)
+	ss.CloseFile()
+}
+
+type fakeCompressor struct{}
+
+func (fakeCompressor) Type() CompressionType {
+	return 0x7f
+}
+
+func (fakeCompressor) Compress(src []byte) ([]byte, error) {
+	return []byte(strings.Repeat("x", len(src)/2)), nil
+}
+
+func (fakeCompressor) Decompress(src []byte) ([]byte, error) {
+	return nil, errors.New("not supported")
+}
+
+func TestSSTable_Compression(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+	l := NewMemTable()
+	for i := 0; i < 1000; i++ {
+		l.Set([]byte(fmt.Sprintf("key%04d", i)), []byte(fmt.Sprintf(`{"id": %d, "name": "user", "active": true}`, i)))
+	}
+	plain := NewSSTable(testPath(), "0.db")
+	assert.Nil(t, plain.Save(l))
+	compressed := NewSSTable(testPath(), "1.db")
+	compressed.Compressor = ZlibCompressor
+	assert.Nil(t, compressed.Save(l))
+
+	plainInfo, err := os.Stat(path.Join(testPath(), "0.db"))
+	assert.Nil(t, err)
+	compressedInfo, err := os.Stat(path.Join(testPath(), "1.db"))
+	assert.Nil(t, err)
+	assert.True(t, compressedInfo.Size() < plainInfo.Size()/2)
+
+	ss := NewSSTable(testPath(), "1.db")
+	it, err := ss.Iterator()
+	assert.Nil(t, err)
+	count := 0
+	for it.Next() {
+		assert.Equal(t, []byte(fmt.Sprintf(`{"id": %d, "name": "user", "active": true}`, count)), it.Value())
+		count++
+	}
+	assert.Nil(t, it.Err())
+	assert.Equal(t, 1000, count)
+	ss.CloseFile()
+
+	ss = NewSSTable(testPath(), "1.db")
+	defer ss.CloseFile()
+	pos, err := ss.FindKeyInIndex([]byte("key0500"))
+	assert.Nil(t, err)
+	value, err := ss.ReadValueAt(pos)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte(`{"id": 500, "name": "user", "active": true}`), value)
+
+	// blocks of unregistered types can't be read
+	unknown := NewSSTable(testPath(), "2.db")
+	unknown.Compressor = fakeCompressor{}
+	assert.Nil(t, unknown.Save(l))
+	unknown = NewSSTable(testPath(), "2.db")
+	_, err = unknown.FindKeyInIndex([]byte("key0500"))
+	assert.ErrorIs(t, err, ErrUnknownCompression)
+	unknown.CloseFile()
+}
+
+func TestCompressorForLevel(t *testing.T) {
+	levels := []Compressor{NoCompressor, ZlibCompressor}
+	assert.Equal(t, NoCompressor, CompressorForLevel(levels, 0))
+	assert.Equal(t, ZlibCompressor, CompressorForLevel(levels, 1))
+	assert.Equal(t, ZlibCompressor, CompressorForLevel(levels, 5))
+	assert.Equal(t, NoCompressor, CompressorForLevel(nil, 3))
+}
+
+func TestSSTable_LowerBound(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+	// each record fills a block
+	val := strings.Repeat("v", BlockSize)
+	meta := saveRawTestTable(t, "0.db", "b", val, "d", val, "f", val)
+
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"a", "b"},
+		{"b", "b"},
+		{"c", "d"},
+		{"f", "f"},
+		{"g", ""},
+	}
+	for _, test := range tests {
+		ss := NewSSTable(testPath(), meta.FileName)
+		entry, err := ss.LowerBound([]byte(test.key))
+		assert.Nil(t, err)
+		if test.want == "" {
+			assert.Nil(t, entry)
+		} else {
+			assert.Equal(t, []byte(test.want), entry.Key)
+		}
+		ss.CloseFile()
+	}
+}
+
+func TestSSTable_RangeTombstones(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+	l := NewMemTable()
+	l.Set(MakeInternalKey([]byte("c"), 1, KindSet), []byte("v"))
+	l.AddRangeTombstone(RangeTombstone{Start: []byte("a"), End: []byte("b"), Seq: 2})
+	l.AddRangeTombstone(RangeTombstone{Start: []byte("b"), End: []byte("e"), Seq: 3})
+	ss := NewSSTable(testPath(), "0.db")
+	assert.Nil(t, ss.Save(l))
+	assert.Equal(t, uint64(3), ss.LargestSeq)
+	// key range of the table includes tombstones
+	assert.Equal(t, SeekKey([]byte("a"), MaxSequence), *ss.MinKey)
+	assert.Equal(t, SeekKey([]byte("e"), MaxSequence), *ss.MaxKey)
+
+	ss = NewSSTable(testPath(), "0.db")
+	defer ss.CloseFile()
+	assert.Nil(t, ss.ReadMeta())
+	assert.Equal(t, FormatRangeDeletion, ss.footerBlock.Version)
+	assert.Equal(t, uint64(3), ss.LargestSeq)
+	set, err := ss.RangeTombstones()
+	assert.Nil(t, err)
+	assert.Equal(t, l.RangeTombstones().List(), set.List())
+	value, seq, ok, err := ss.Get(SeekKey([]byte("c"), MaxSequence), nil)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(1), seq)
+	assert.Equal(t, []byte("v"), value)
+
+	// a table with only tombstones
+	l = NewMemTable()
+	l.AddRangeTombstone(RangeTombstone{Start: []byte("x"), End: []byte("y"), Seq: 4})
+	assert.False(t, l.Empty())
+	assert.Nil(t, NewSSTable(testPath(), "1.db").Save(l))
+	ss = NewSSTable(testPath(), "1.db")
+	defer ss.CloseFile()
+	assert.Nil(t, ss.ReadFooter())
+	set, err = ss.RangeTombstones()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, set.Len())
+
+	// tables without tombstones keep the previous format
+	l = NewMemTable()
+	l.Set(MakeInternalKey([]byte("c"), 1, KindSet), []byte("v"))
+	assert.Nil(t, NewSSTable(testPath(), "2.db").Save(l))
+	ss = NewSSTable(testPath(), "2.db")
+	defer ss.CloseFile()
+	assert.Nil(t, ss.ReadFooter())
+	assert.Equal(t, FormatCompressed, ss.footerBlock.Version)
+	set, err = ss.RangeTombstones()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, set.Len())
+}
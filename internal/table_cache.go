@@ -0,0 +1,228 @@
+package internal
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// TableCache keeps sstables open together with their footer, index and
+// filter, so lookups don't open and parse the file each time. Tables are
+// keyed by file number. At most capacity tables are kept, the least
+// recently used one is dropped when another is opened. Tables which are
+// in use are closed once they are released. It is safe for concurrent use
+type TableCache struct {
+	dbPath   string
+	capacity int
+	// Checksums of blocks are verified on read when set, it must be set before use
+	VerifyChecksums bool
+	// Data blocks of tables are cached in BlockCache if it is set.
+	// Index and filter blocks are cached in it too if CacheIndexAndFilter
+	// is set, and they are pinned while the table is open if
+	// PinIndexAndFilter is set. Otherwise they are kept with the table.
+	// They must be set before use
+	BlockCache          *BlockCache
+	CacheIndexAndFilter bool
+	PinIndexAndFilter   bool
+	mu                  sync.Mutex
+	// front is the most recently used table
+	lru    *list.List
+	tables map[uint64]*list.Element
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+// cachedTable is an open table shared by readers of the cache
+type cachedTable struct {
+	fileNum uint64
+	table   *SSTable
+	// number of tables which are returned by Get and not released yet
+	refs int
+	// set once the table is dropped from the cache,
+	// the file is closed when refs drops to zero
+	evicted bool
+	// blocks pinned in the block cache while the table is open
+	pinned []BlockCacheKey
+}
+
+// Returns a new TableCache which keeps at most capacity tables open
+func NewTableCache(dbPath string, capacity int) *TableCache {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &TableCache{
+		dbPath:          dbPath,
+		capacity:        capacity,
+		VerifyChecksums: true,
+		lru:             list.New(),
+		tables:          make(map[uint64]*list.Element),
+	}
+}
+
+// Returns a table of meta which shares the open file of the cache.
+// Table must be released after use by CloseFile or by closing its
+// SeekIterator. Reads of the table don't change the shared file offset,
+// so tables of the same file can be used concurrently
+func (c *TableCache) Get(meta *MetaBlock) (*SSTable, error) {
+	c.mu.Lock()
+	if e, ok := c.tables[meta.FileNum]; ok {
+		c.hits.Add(1)
+		t := c.acquire(e)
+		c.mu.Unlock()
+		return t, nil
+	}
+	c.mu.Unlock()
+
+	// file is opened without holding the lock, so lookups of other
+	// tables aren't blocked. Concurrent misses may open it twice
+	c.misses.Add(1)
+	table, err := c.open(meta)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.tables[meta.FileNum]; ok {
+		table.CloseFile()
+		return c.acquire(e), nil
+	}
+	ct := &cachedTable{fileNum: meta.FileNum, table: table}
+	if c.metaInBlockCache() && c.PinIndexAndFilter {
+		ct.pinned = c.pin(table)
+	}
+	e := c.lru.PushFront(ct)
+	c.tables[meta.FileNum] = e
+	t := c.acquire(e)
+	for c.lru.Len() > c.capacity {
+		c.remove(c.lru.Back())
+	}
+	return t, nil
+}
+
+// Opens the table and reads its footer and range tombstones. Index and
+// filter are read too unless they are read through the block cache when
+// they are needed
+func (c *TableCache) open(meta *MetaBlock) (*SSTable, error) {
+	t := NewSSTable(c.dbPath, meta.FileName)
+	t.VerifyChecksums = c.VerifyChecksums
+	t.fileNum = meta.FileNum
+	t.blockCache = c.BlockCache
+	t.cacheMeta = c.metaInBlockCache()
+	err := t.ReadFooter()
+	if err == nil {
+		_, err = t.RangeTombstones()
+	}
+	if err == nil && (!t.cacheMeta || c.PinIndexAndFilter) {
+		_, err = t.loadIndex()
+		if err == nil {
+			err = t.loadFilter()
+		}
+	}
+	if err != nil {
+		t.CloseFile()
+		return nil, err
+	}
+	if t.cacheMeta && !c.PinIndexAndFilter {
+		// tables read them from the block cache, so they are
+		// dropped with the block which may be evicted
+		t.index = nil
+		t.filter = nil
+	}
+	return t, nil
+}
+
+func (c *TableCache) metaInBlockCache() bool {
+	return c.BlockCache != nil && (c.CacheIndexAndFilter || c.PinIndexAndFilter)
+}
+
+// Pins index and filter blocks which are loaded by open and returns
+// their keys, tables read them from the block cache afterwards
+func (c *TableCache) pin(t *SSTable) []BlockCacheKey {
+	var keys []BlockCacheKey
+	if t.index != nil {
+		key := t.indexCacheKey()
+		c.BlockCache.Pin(key, t.index, int64(t.footerBlock.IndexLength))
+		keys = append(keys, key)
+	}
+	if t.filter != nil {
+		key := t.filterCacheKey()
+		c.BlockCache.Pin(key, t.filter, int64(t.footerBlock.FilterLength))
+		keys = append(keys, key)
+	}
+	t.index = nil
+	t.filter = nil
+	return keys
+}
+
+// Closes the file of the table and unpins its blocks
+func (c *TableCache) closeTable(ct *cachedTable) {
+	ct.table.CloseFile()
+	for _, key := range ct.pinned {
+		c.BlockCache.Unpin(key)
+	}
+}
+
+// Returns a copy of the cached table which releases it when closed.
+// c.mu must be held
+func (c *TableCache) acquire(e *list.Element) *SSTable {
+	ct := e.Value.(*cachedTable)
+	c.lru.MoveToFront(e)
+	ct.refs++
+	t := *ct.table
+	t.release = func() {
+		c.release(ct)
+	}
+	return &t
+}
+
+func (c *TableCache) release(ct *cachedTable) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ct.refs--
+	if ct.refs == 0 && ct.evicted {
+		c.closeTable(ct)
+	}
+}
+
+// Drops the table from the cache, its file is closed if it isn't in use.
+// c.mu must be held
+func (c *TableCache) remove(e *list.Element) {
+	ct := e.Value.(*cachedTable)
+	c.lru.Remove(e)
+	delete(c.tables, ct.fileNum)
+	ct.evicted = true
+	if ct.refs == 0 {
+		c.closeTable(ct)
+	}
+}
+
+// Drops the table of fileNum, it is called when the file is removed
+func (c *TableCache) Evict(fileNum uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.tables[fileNum]; ok {
+		c.remove(e)
+	}
+}
+
+// Drops all tables, files of tables in use are closed when they are released
+func (c *TableCache) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
+	}
+}
+
+// Returns number of tables in the cache
+func (c *TableCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// Returns number of lookups which found the table open and which opened it
+func (c *TableCache) Stats() (hits, misses int64) {
+	return c.hits.Load(), c.misses.Load()
+}
@@ -0,0 +1,96 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func saveCacheTestTable(t *testing.T, num uint64) *MetaBlock {
+	w, err := NewSSTableWriter(testPath(), TableFileName(0, num))
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, w.Add([]byte(fmt.Sprintf("key%05d", i)), []byte(fmt.Sprintf("value%d_%d", num, i))))
+	}
+	meta, err := w.Finish()
+	assert.Nil(t, err)
+	meta.FileNum = num
+	return meta
+}
+
+func readCacheTestTable(t *testing.T, table *SSTable, i int) []byte {
+	it, err := table.SeekIterator()
+	assert.Nil(t, err)
+	defer it.Close()
+	it.Seek([]byte(fmt.Sprintf("key%05d", i)))
+	assert.True(t, it.Valid())
+	return it.Value()
+}
+
+func TestTableCache_Evict(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+	metas := []*MetaBlock{saveCacheTestTable(t, 1), saveCacheTestTable(t, 2), saveCacheTestTable(t, 3)}
+	c := NewTableCache(testPath(), 2)
+
+	t1, err := c.Get(metas[0])
+	assert.Nil(t, err)
+	f := t1.file
+	for _, m := range metas[1:] {
+		table, err := c.Get(m)
+		assert.Nil(t, err)
+		table.CloseFile()
+	}
+	// least recently used table is dropped, it stays open while in use
+	assert.Equal(t, 2, c.Len())
+	assert.Equal(t, []byte("value1_7"), readCacheTestTable(t, t1, 7))
+	_, err = f.Stat()
+	assert.ErrorIs(t, err, os.ErrClosed)
+
+	t1, err = c.Get(metas[0])
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value1_8"), readCacheTestTable(t, t1, 8))
+	hits, misses := c.Stats()
+	assert.Equal(t, int64(0), hits)
+	assert.Equal(t, int64(4), misses)
+
+	t3, err := c.Get(metas[2])
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value3_9"), readCacheTestTable(t, t3, 9))
+	hits, _ = c.Stats()
+	assert.Equal(t, int64(1), hits)
+
+	c.Evict(3)
+	assert.Equal(t, 1, c.Len())
+	c.Close()
+	assert.Equal(t, 0, c.Len())
+}
+
+func TestTableCache_Concurrent(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+	metas := []*MetaBlock{saveCacheTestTable(t, 1), saveCacheTestTable(t, 2), saveCacheTestTable(t, 3)}
+	c := NewTableCache(testPath(), 2)
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				m := metas[(g+i)%len(metas)]
+				table, err := c.Get(m)
+				if !assert.Nil(t, err) {
+					return
+				}
+				assert.Equal(t, []byte(fmt.Sprintf("value%d_%d", m.FileNum, i)), readCacheTestTable(t, table, i))
+			}
+		}(g)
+	}
+	wg.Wait()
+	assert.True(t, c.Len() <= 2)
+}
@@ -1,9 +1,8 @@
 package wal
 
 import (
+	"errors"
 	"fmt"
-	"io/ioutil"
-	"log"
 	"os"
 	"path"
 	"sort"
@@ -18,11 +17,18 @@ const BlockPayloadSize = BlockSize - BlockHeaderSize
 const flushOnWrite = true
 const LogHeaderSize = 8
 
+// Key length value which marks a batch record, no key can be that long
+const batchMarker uint32 = 0xffffffff
+const batchHeaderSize = 16
+
 const typeFull uint8 = 1
 const typeFirst uint8 = 2
 const typeMiddle uint8 = 3
 const typeLast uint8 = 4
 
+// Returned by writes when no WAL file is open
+var ErrNoFile = errors.New("no wal file is open")
+
 // WAL blocks which will be stored into disk
 type Block struct {
 	CRC     uint32
@@ -37,6 +43,14 @@ type Log struct {
 	Value []byte
 }
 
+// Batch is a group of logs which are written as a single record.
+// First log has sequence number Seq and following logs take the next
+// numbers. Seq is 0 for records which are written without a sequence
+type Batch struct {
+	Seq  uint64
+	Logs []*Log
+}
+
 // Write-Ahead-Log Manager
 // Provides interface for writing to and recovering from WAL files
 // Its methods are *NOT* thread-safe
@@ -46,15 +60,27 @@ type Manager struct {
 	dbPath          string
 	currentFile     *os.File
 	counter         int
+	currentNum      int
 	currentFileSize int64
-	opts            *WalOptions
+	// records are written since the last sync
+	unsynced bool
+	// files which are filled since the last SwitchFile
+	filledFiles []string
+	// size of the files written since the last SwitchFile
+	switchSize int64
+	opts       *WalOptions
 }
 
-// Return new WAL Manager
-func NewManager(dbPath string) *Manager {
-	opts := &WalOptions{
-		BlockSize: BlockSize,
+// Return new WAL Manager, nil opts means default options
+func NewManager(dbPath string, opts *WalOptions) *Manager {
+	if opts == nil {
+		opts = &WalOptions{}
+	}
+	maxFileSize := opts.MaxFileSize
+	if maxFileSize <= 0 {
+		maxFileSize = MaxWalFileSize
 	}
+	opts = &WalOptions{BlockSize: BlockSize, Sync: opts.Sync, MaxFileSize: maxFileSize}
 	m := &Manager{
 		dbPath: dbPath,
 		reader: NewWalReader(opts),
@@ -66,29 +92,37 @@ func NewManager(dbPath string) *Manager {
 // This should be called first for initialization.
 // this will create wal/ directory if it does not exist
 // under the dbPath, in WAL directory, a new WAL file will be created
-func (m *Manager) Init() {
+func (m *Manager) Init() error {
 	walDir := path.Join(m.dbPath, "wal") //fmt.Sprintf("%v/wal/", m.dbPath)
 	if _, err := os.Stat(walDir); err != nil {
-		if os.IsNotExist(err) {
-			err = os.Mkdir(walDir, 0774)
-			if err != nil {
-				log.Println(err)
-				return
-			}
-		} else {
-			log.Fatal(err)
+		if !os.IsNotExist(err) {
+			return err
 		}
+		err = os.Mkdir(walDir, 0774)
+		if err != nil {
+			return err
+		}
+	}
+	return m.createNewFile()
+}
+
+// Makes the next WAL file at least num, so numbers of WAL files
+// keep growing across restarts. It must be called before Init
+func (m *Manager) SetNextFileNum(num int) {
+	if num > m.counter {
+		m.counter = num
 	}
-	m.createNewFile()
 }
 
 // Creates a new WAL file and maintain counter for WAL files.
 // After this call newly created file will be used for logs
-func (m *Manager) createNewFile() {
+func (m *Manager) createNewFile() error {
 	p := path.Join(m.dbPath, "wal", fmt.Sprintf("%v.log", m.counter))
 	for {
+		// files which are being recovered keep their number with .old suffix
 		_, err := os.Stat(p)
-		if os.IsNotExist(err) {
+		_, errOld := os.Stat(p + ".old")
+		if os.IsNotExist(err) && os.IsNotExist(errOld) {
 			break
 		}
 		m.counter++
@@ -97,45 +131,129 @@ func (m *Manager) createNewFile() {
 
 	f, err := os.Create(p)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	m.currentFileSize = 0
+	m.unsynced = false
+	m.currentNum = m.counter
 	m.counter++
-	if m.counter >= (1<<31 - 1) {
-		m.counter = 0
-	}
 	m.currentFile = f
 	m.writer = NewWalWriter(f, m.opts)
+	return nil
 }
 
 // Adds a log to WAL file
 func (m *Manager) Add(l *Log) error {
+	if m.writer == nil {
+		return ErrNoFile
+	}
+
+	_, err := m.writer.WriteLog(l)
+	if err != nil {
+		return err
+	}
+	m.written()
+	err = m.maybeSync()
+	if err != nil {
+		return err
+	}
+	return m.maybeRotate()
+}
+
+// Returns path of the WAL file which is currently written
+func (m *Manager) CurrentFilePath() string {
+	return path.Join(m.dbPath, "wal", fmt.Sprintf("%v.log", m.currentNum))
+}
+
+// Returns number of the WAL file which is currently written
+func (m *Manager) CurrentFileNum() int {
+	return m.currentNum
+}
+
+// Adds logs of the batch to WAL file as a single record,
+// they are recovered all together or not at all
+func (m *Manager) AddBatch(b *Batch) error {
+	if m.writer == nil {
+		return ErrNoFile
+	}
+	_, err := m.writer.WriteBatch(b)
+	if err != nil {
+		return err
+	}
+	m.written()
+	err = m.maybeSync()
+	if err != nil {
+		return err
+	}
+	return m.maybeRotate()
+}
 
-	n, err := m.writer.WriteLog(l)
+// Accounts the bytes which writer wrote since the last call
+func (m *Manager) written() {
+	size := m.writer.Size()
+	m.switchSize += size - m.currentFileSize
+	m.currentFileSize = size
+	m.unsynced = true
+}
+
+// Starts a new file if the current one reached the size limit.
+// Filled file is synced unless the sync mode is SyncNone
+func (m *Manager) maybeRotate() error {
+	if m.currentFileSize < m.opts.MaxFileSize {
+		return nil
+	}
+	if m.opts.Sync != SyncNone {
+		err := m.Sync()
+		if err != nil {
+			return err
+		}
+	}
+	name := m.currentFile.Name()
+	err := m.closeFile()
 	if err != nil {
 		return err
 	}
-	m.currentFileSize += int64(n)
+	m.filledFiles = append(m.filledFiles, name)
+	return m.createNewFile()
+}
 
-	// if m.currentFileSize >= MaxWalFileSize {
-	// 	m.SwitchFile()
-	// }
+// Returns size of the files written since the last SwitchFile
+func (m *Manager) SizeSinceSwitch() int64 {
+	return m.switchSize
+}
 
+// Syncs current file to disk if the sync mode requires it
+func (m *Manager) maybeSync() error {
+	if m.opts.Sync == SyncAlways {
+		return m.Sync()
+	}
 	return nil
 }
 
-func (m *Manager) GetCurrentWalPath() string {
-	currentPath := path.Join(m.dbPath, "wal", "current")
-	data, err := ioutil.ReadFile(currentPath)
+// Flushes buffered records and syncs current file to disk.
+// It does nothing if no record is written since the last sync
+func (m *Manager) Sync() error {
+	if m.writer == nil {
+		return ErrNoFile
+	}
+	if !m.unsynced {
+		return nil
+	}
+	err := m.writer.Flush()
+	if err != nil {
+		return err
+	}
+	err = m.currentFile.Sync()
 	if err != nil {
-		log.Println(err)
-		return ""
+		return err
 	}
-	return string(data)
+	m.unsynced = false
+	return nil
 }
 
 // Returns a FileIterator which can be used to iterate WAL files
-// to recover the data
+// to recover the data. Files are iterated in the order of their
+// numbers, they are left in place until they are removed
 func (m *Manager) GetRecoverIterator() (*FileIterator, error) {
 	dir := path.Join(m.dbPath, "wal")
 	if _, err := os.Stat(dir); err != nil {
@@ -147,42 +265,39 @@ func (m *Manager) GetRecoverIterator() (*FileIterator, error) {
 	}
 
 	sort.Slice(files, func(a, b int) bool {
-		fA := files[a].Name()
-		fB := files[b].Name()
-		fA = strings.TrimSuffix(fA, ".log")
-		fB = strings.TrimSuffix(fB, ".log")
-
-		f1, err := strconv.ParseInt(fA, 10, 64)
-		if err != nil {
-			log.Println(err)
-			return false
-		}
-		f2, err := strconv.ParseInt(fB, 10, 64)
-		if err != nil {
-			log.Println(err)
-			return false
-		}
-		return f1 < f2
+		return logFileNum(files[a].Name()) < logFileNum(files[b].Name())
 	})
 	it := &FileIterator{
 		filePaths: make([]string, 0, len(files)),
+		fileNums:  make([]int, 0, len(files)),
 		idx:       -1,
 		m:         m,
 	}
 	for _, f := range files {
-		if !f.IsDir() && strings.HasSuffix(f.Name(), ".log") {
-			fPath := path.Join(dir, f.Name())
-			fPathNew := fPath + ".old"
-			err := os.Rename(fPath, fPathNew)
-			if err != nil {
-				log.Fatalf("Failed to rename file %v", fPath)
-			}
-			it.filePaths = append(it.filePaths, fPathNew)
+		// older versions renamed files to .log.old while recovering them
+		num := logFileNum(f.Name())
+		if f.IsDir() || num < 0 {
+			continue
 		}
+		it.filePaths = append(it.filePaths, path.Join(dir, f.Name()))
+		it.fileNums = append(it.fileNums, int(num))
 	}
 	return it, nil
 }
 
+// Returns number of a WAL file, -1 if the name isn't a WAL file
+func logFileNum(name string) int64 {
+	name = strings.TrimSuffix(name, ".old")
+	if !strings.HasSuffix(name, ".log") {
+		return -1
+	}
+	num, err := strconv.ParseInt(strings.TrimSuffix(name, ".log"), 10, 64)
+	if err != nil {
+		return -1
+	}
+	return num
+}
+
 func min(x, y uint32) uint32 {
 	if x < y {
 		return x
@@ -192,31 +307,57 @@ func min(x, y uint32) uint32 {
 }
 
 // Gracefully closes WAL Manager
-// it'll flush and close open files
+// it'll flush, sync and close open files, whatever the sync mode is.
 // after calling this WAL Manager will be unusable
-func (m *Manager) Close() {
+func (m *Manager) Close() error {
+	var err error
+	if m.currentFile != nil {
+		m.unsynced = true
+		err = m.Sync()
+	}
+	if cErr := m.closeFile(); err == nil {
+		err = cErr
+	}
+	return err
+}
+
+// Flushes buffered records and closes current file without syncing it
+func (m *Manager) closeFile() error {
+	var err error
 	if m.writer != nil {
-		err := m.writer.Flush()
-		if err != nil {
-			log.Println(err)
-		}
+		err = m.writer.Flush()
 	}
 	m.writer = nil
 
 	if m.currentFile != nil {
-		err := m.currentFile.Close()
-		if err != nil {
-			log.Println(err)
+		if cErr := m.currentFile.Close(); err == nil {
+			err = cErr
 		}
 	}
 	m.currentFile = nil
+	return err
 }
 
-// Closes current file and creates new WAL file
-// returns last wal file number
-func (m *Manager) SwitchFile() string {
-	name := m.currentFile.Name()
-	m.Close()
-	m.createNewFile()
-	return name
+// Closes current file and creates new WAL file. Closed file is synced
+// unless the sync mode is SyncNone. Returns paths of the files written
+// since the last switch
+func (m *Manager) SwitchFile() ([]string, error) {
+	if m.opts.Sync != SyncNone {
+		err := m.Sync()
+		if err != nil {
+			return nil, err
+		}
+	}
+	names := append(m.filledFiles, m.currentFile.Name())
+	err := m.closeFile()
+	if err != nil {
+		return nil, err
+	}
+	err = m.createNewFile()
+	if err != nil {
+		return nil, err
+	}
+	m.filledFiles = nil
+	m.switchSize = 0
+	return names, nil
 }
@@ -3,48 +3,186 @@ package wal
 import (
 	"bufio"
 	"errors"
+	"fmt"
 	"io"
-	"log"
 	"os"
+	"strings"
 )
 
+// RecoveryMode tells how damaged WAL records are handled on recovery
+type RecoveryMode int
+
+const (
+	// Damaged records at the end of a file are dropped, they are left by
+	// a write which was torn by a crash. Damage followed by valid records
+	// fails recovery
+	RecoverTolerateCorruptedTail RecoveryMode = iota
+	// Any damaged record fails recovery, including a torn tail
+	RecoverAbsoluteConsistency
+	// Recovery stops at the first damaged record, it and all records after
+	// it are dropped, including the ones in later files
+	RecoverPointInTime
+	// Damaged records are dropped and recovery continues after them
+	RecoverSkipAnyCorruptedRecord
+)
+
+// RecoveryError is returned when recovery mode doesn't allow dropping
+// a damaged record, Err wraps ErrCorruptRecord
+type RecoveryError struct {
+	File   string
+	Offset int64
+	Err    error
+}
+
+func (e *RecoveryError) Error() string {
+	return fmt.Sprintf("wal recovery failed in %v at offset %v: %v", e.File, e.Offset, e.Err)
+}
+
+func (e *RecoveryError) Unwrap() error {
+	return e.Err
+}
+
+// SkippedRecords describes a part of a WAL file which isn't recovered
+type SkippedRecords struct {
+	File   string
+	Offset int64
+	// Number of bytes which are dropped
+	Length int64
+	Reason string
+}
+
+// RecoveryReport describes what recovery replayed and what it dropped
+type RecoveryReport struct {
+	Mode    RecoveryMode
+	Files   int
+	Batches int
+	Skipped []SkippedRecords
+}
+
 type FileIterator struct {
 	filePaths []string
+	fileNums  []int
 	idx       int
 	m         *Manager
+	// Mode is used by RecoverCurrentFile, it can be set before iterating
+	Mode   RecoveryMode
+	report RecoveryReport
+	// set once PointInTime mode drops the rest of the logs
+	stopped bool
+	err     error
 }
 
 func (f *FileIterator) Next() bool {
-	if (f.idx + 1) >= len(f.filePaths) {
+	if f.err != nil || (f.idx+1) >= len(f.filePaths) {
 		return false
 	}
 	f.idx++
 	return true
 }
 
-func (f *FileIterator) RecoverCurrentFile() []*Log {
-	logs := make([]*Log, 0, 1024)
+// Returns path of the current file
+func (f *FileIterator) CurrentFilePath() string {
+	return f.filePaths[f.idx]
+}
+
+// Returns number of the current file
+func (f *FileIterator) CurrentFileNum() int {
+	return f.fileNums[f.idx]
+}
+
+// Returns the error which stopped recovery
+func (f *FileIterator) Err() error {
+	return f.err
+}
+
+// Returns what is recovered so far
+func (f *FileIterator) Report() *RecoveryReport {
+	report := f.report
+	report.Mode = f.Mode
+	return &report
+}
+
+// Returns batches of the current file in the order they are written.
+// Logs of a batch are returned all together or not at all. Damaged
+// records are handled by Mode, Err is set if Mode doesn't allow dropping them
+func (f *FileIterator) RecoverCurrentFile() []*Batch {
+	name := strings.TrimSuffix(f.filePaths[f.idx], ".old")
 	file, err := os.Open(f.filePaths[f.idx])
 	if err != nil {
-		log.Println(err)
+		f.err = err
 		return nil
 	}
 	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		f.err = err
+		return nil
+	}
+	if f.stopped {
+		f.skip(SkippedRecords{File: name, Length: info.Size(), Reason: "after an earlier damaged record"})
+		return nil
+	}
+	f.report.Files++
 
+	batches := make([]*Batch, 0, 1024)
 	reader := bufio.NewReader(file)
 	walReader := NewWalReader(&WalOptions{BlockSize: BlockSize})
+	// damaged records which are tolerated only if the file ends after them
+	var damaged *SkippedRecords
+	var damagedErr error
 	for {
-		l, err := walReader.ReadLog(reader)
-		if err != nil {
-			if err != io.EOF {
-				log.Println(err)
-			}
+		offset := walReader.Offset()
+		b, err := walReader.ReadBatch(reader)
+		if err == io.EOF {
 			break
 		}
-		logs = append(logs, l)
+		if err == nil {
+			if damaged != nil {
+				f.err = &RecoveryError{File: name, Offset: damaged.Offset, Err: damagedErr}
+				return nil
+			}
+			batches = append(batches, b)
+			continue
+		}
+		if err != io.ErrUnexpectedEOF && !errors.Is(err, ErrCorruptRecord) {
+			f.err = err
+			return nil
+		}
+
+		if err == io.ErrUnexpectedEOF {
+			err = fmt.Errorf("%w: record is truncated", ErrCorruptRecord)
+		}
+		s := SkippedRecords{File: name, Offset: offset, Length: walReader.Offset() - offset, Reason: err.Error()}
+		switch f.Mode {
+		case RecoverAbsoluteConsistency:
+			f.err = &RecoveryError{File: name, Offset: s.Offset, Err: err}
+			return nil
+		case RecoverPointInTime:
+			s.Length = info.Size() - s.Offset
+			f.skip(s)
+			f.stopped = true
+			f.report.Batches += len(batches)
+			return batches
+		case RecoverSkipAnyCorruptedRecord:
+			f.skip(s)
+		default:
+			if damaged == nil {
+				damaged = &s
+				damagedErr = err
+			} else {
+				damaged.Length = walReader.Offset() - damaged.Offset
+			}
+		}
 	}
+	if damaged != nil {
+		f.skip(*damaged)
+	}
+	f.report.Batches += len(batches)
+	return batches
+}
 
-	return logs
+func (f *FileIterator) skip(s SkippedRecords) {
+	f.report.Skipped = append(f.report.Skipped, s)
 }
 
 func (f *FileIterator) RemoveCurrentFile() error {
@@ -8,181 +8,221 @@ import (
 	"io"
 )
 
+// ErrCorruptRecord is returned for records whose blocks fail checksum
+// or don't fit together. Reader continues with the next block after it
+var ErrCorruptRecord = errors.New("corrupted wal record")
+
 type WalReader struct {
 	opts          *WalOptions
 	offset        int
 	lastBlockType byte
-	// currentBlock *Block
+	// block which is read but belongs to the next record
+	pending *Block
 }
 
 func NewWalReader(opts *WalOptions) *WalReader {
 	return &WalReader{
 		opts: opts,
-		// currentBlock: nil,
 	}
 }
 
+// Returns offset of the next block which isn't consumed yet
+func (w *WalReader) Offset() int64 {
+	if w.pending != nil {
+		return int64(w.offset - BlockHeaderSize - len(w.pending.Payload))
+	}
+	return int64(w.offset)
+}
+
 /**
 * Skips the trailer bytes if needed
  */
-func (w *WalReader) skipIfNeeded(reader io.Reader) {
+func (w *WalReader) skipIfNeeded(reader io.Reader) error {
 	o := w.offset % w.opts.BlockSize
 	rem := w.opts.BlockSize - o
 	if rem < BlockHeaderSize {
-		// fmt.Println("skipping ", rem, " bytes")
 		n, err := io.ReadFull(reader, make([]byte, rem))
-		if err != nil {
-			fmt.Println("error while skipping trailer: ", err)
-		}
 		w.offset += n
+		// a torn trailer doesn't lose any record
+		if err == io.ErrUnexpectedEOF {
+			return io.EOF
+		}
+		return err
 	}
+	return nil
 }
 
+// Skips the rest of the current block, its contents can't be trusted
+// once a block in it is corrupted
+func (w *WalReader) skipBlock(reader io.Reader) {
+	rem := w.opts.BlockSize - w.offset%w.opts.BlockSize
+	if rem == w.opts.BlockSize {
+		return
+	}
+	n, _ := io.CopyN(io.Discard, reader, int64(rem))
+	w.offset += int(n)
+}
+
+func (w *WalReader) corrupt(reader io.Reader, reason string) error {
+	w.skipBlock(reader)
+	return fmt.Errorf("%w: %v at offset %v", ErrCorruptRecord, reason, w.offset)
+}
+
+// Reads a log written by WalWriter.WriteLog
 func (w *WalReader) ReadLog(reader io.Reader) (*Log, error) {
-	// fmt.Println("offset: ", w.offset)
-	block, err := w.ReadBlock(reader)
+	rec, err := w.ReadRecord(reader)
 	if err != nil {
 		return nil, err
 	}
+	l, _, err := decodeLog(rec)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorruptRecord, err)
+	}
+	return l, nil
+}
 
-	if block.Type != typeFirst && block.Type != typeFull {
-		fmt.Println("unexpected block type at the start of log, skipping to valid block")
-		for {
-			var err error
-			block, err = w.ReadBlock(reader)
-			if err == io.EOF {
-				return nil, err
-			}
-			if err != nil {
-				fmt.Println("error while reading block: ", err)
-				continue
-			}
-			if block.Type == typeFirst || block.Type == typeFull {
-				break
-			}
-		}
+// Reads the next record as a batch. A record written by WriteLog
+// is returned as a batch of one log without a sequence number
+func (w *WalReader) ReadBatch(reader io.Reader) (*Batch, error) {
+	rec, err := w.ReadRecord(reader)
+	if err != nil {
+		return nil, err
 	}
+	return decodeBatch(rec)
+}
 
-	if block.Type == typeFull {
-		keyLen := binary.LittleEndian.Uint32(block.Payload[0:4])
-		valLen := binary.LittleEndian.Uint32(block.Payload[4:8])
-		l := Log{}
-
-		l.Key = make([]byte, keyLen)
-		copy(l.Key, block.Payload[LogHeaderSize:LogHeaderSize+keyLen])
-		l.Value = make([]byte, valLen)
-		copy(l.Value, block.Payload[LogHeaderSize+keyLen:LogHeaderSize+keyLen+valLen])
-		block = nil
-		return &l, nil
-	} else if block.Type == typeFirst {
-
-		payload := block.Payload
-		if len(block.Payload) < LogHeaderSize {
-			block, err = w.ReadBlock(reader)
+func decodeBatch(rec []byte) (*Batch, error) {
+	if len(rec) >= batchHeaderSize && binary.LittleEndian.Uint32(rec[0:4]) == batchMarker {
+		b := &Batch{Seq: binary.LittleEndian.Uint64(rec[4:12])}
+		count := binary.LittleEndian.Uint32(rec[12:16])
+		b.Logs = make([]*Log, 0, count)
+		rec = rec[batchHeaderSize:]
+		for i := uint32(0); i < count; i++ {
+			l, n, err := decodeLog(rec)
 			if err != nil {
-				return nil, err
+				return nil, fmt.Errorf("%w: %v", ErrCorruptRecord, err)
 			}
-			block.Size += uint16(len(payload))
-			block.Payload = append(payload, block.Payload...)
+			b.Logs = append(b.Logs, l)
+			rec = rec[n:]
 		}
+		return b, nil
+	}
+	l, _, err := decodeLog(rec)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorruptRecord, err)
+	}
+	return &Batch{Logs: []*Log{l}}, nil
+}
 
-		keyLen := binary.LittleEndian.Uint32(block.Payload[0:4])
-		valLen := binary.LittleEndian.Uint32(block.Payload[4:8])
-		curIdx := uint32(LogHeaderSize)
-		l := Log{}
-		l.Key = make([]byte, keyLen)
-		l.Value = make([]byte, valLen)
-		keyIdx := uint32(0)
-		valIdx := uint32(0)
-
-		//read key first
-		for keyIdx < keyLen {
-			remaining := uint32(block.Size) - curIdx
-			needed := keyLen - keyIdx
-			am := int(min(needed, remaining))
-			for i := 0; i < am; i++ {
-				l.Key[keyIdx] = block.Payload[curIdx]
-				keyIdx++
-				curIdx++
-			}
-			var err error
-			if curIdx == uint32(block.Size) {
-				block, err = w.ReadBlock(reader)
-				if err != nil {
-					return nil, err
-				}
-				curIdx = 0
-				if block.Type != typeMiddle && block.Type != typeLast {
-					return nil, errors.New("expecting next block to be middle or last")
-				}
-			}
-		}
+// Decodes a log from the start of data, returns the log and its encoded size
+func decodeLog(data []byte) (*Log, int, error) {
+	if len(data) < LogHeaderSize {
+		return nil, 0, errors.New("log header is truncated")
+	}
+	keyLen := int(binary.LittleEndian.Uint32(data[0:4]))
+	valLen := int(binary.LittleEndian.Uint32(data[4:8]))
+	end := LogHeaderSize + keyLen + valLen
+	if keyLen < 0 || valLen < 0 || end < LogHeaderSize || end > len(data) {
+		return nil, 0, errors.New("log is truncated")
+	}
+	l := &Log{
+		Key:   data[LogHeaderSize : LogHeaderSize+keyLen],
+		Value: data[LogHeaderSize+keyLen : end],
+	}
+	return l, end, nil
+}
 
-		// read value
-		for valIdx < valLen {
-			remaining := uint32(block.Size) - curIdx
-			needed := valLen - valIdx
-			am := int(min(needed, remaining))
-			for i := 0; i < am; i++ {
-				l.Value[valIdx] = block.Payload[curIdx]
-				valIdx++
-				curIdx++
-			}
+// Reads a record written by WalWriter.Write, fragmented
+// records are joined back into a single slice. Returns io.EOF at the
+// end of the file, io.ErrUnexpectedEOF if the file ends within a record
+// and ErrCorruptRecord for damaged records
+func (w *WalReader) ReadRecord(reader io.Reader) ([]byte, error) {
+	block, err := w.ReadBlock(reader)
+	if err != nil {
+		return nil, err
+	}
+	if block.Type != typeFirst && block.Type != typeFull {
+		// start of the record is lost
+		return nil, fmt.Errorf("%w: record starts with block type %v at offset %v", ErrCorruptRecord, block.Type, w.offset)
+	}
+	if block.Type == typeFull {
+		return block.Payload, nil
+	}
 
-			if block.Type == typeLast {
-				// we're done
-				block = nil
-				return &l, nil
-			}
-			var err error
-			if curIdx == uint32(block.Size) {
-				block, err = w.ReadBlock(reader)
-				if err != nil {
-					return nil, err
-				}
-				curIdx = 0
-				if block.Type != typeMiddle && block.Type != typeLast {
-					return nil, errors.New("expecting next block to be middle or last")
-				}
+	rec := block.Payload
+	for {
+		block, err = w.ReadBlock(reader)
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(rec) == 0 && (block.Type == typeFirst || block.Type == typeFull) {
+			// older writers marked the fragment after an empty first
+			// fragment as first too
+			if block.Type == typeFull {
+				return block.Payload, nil
 			}
+			rec = block.Payload
+			continue
+		}
+		if block.Type != typeMiddle && block.Type != typeLast {
+			// keep the block, it starts the next record
+			w.pending = block
+			return nil, fmt.Errorf("%w: record is cut by block type %v at offset %v", ErrCorruptRecord, block.Type, w.Offset())
+		}
+		rec = append(rec, block.Payload...)
+		if block.Type == typeLast {
+			return rec, nil
 		}
-
 	}
-
-	return nil, errors.New("unexpected error happened")
 }
 
 func (w *WalReader) ReadBlock(reader io.Reader) (*Block, error) {
-	w.skipIfNeeded(reader)
+	if w.pending != nil {
+		block := w.pending
+		w.pending = nil
+		return block, nil
+	}
+	err := w.skipIfNeeded(reader)
+	if err != nil {
+		return nil, err
+	}
+	avail := w.opts.BlockSize - w.offset%w.opts.BlockSize - BlockHeaderSize
+
 	// read block header
 	var header = make([]byte, BlockHeaderSize)
 	n, err := io.ReadFull(reader, header)
+	w.offset += n
 	if err != nil {
 		return nil, err
 	}
-	w.offset += n
-	if n != BlockHeaderSize {
-		return nil, errors.New("unexpected error while reading block header")
-	}
 
 	block := Block{}
 	block.CRC = binary.LittleEndian.Uint32(header[0:4])
 	block.Size = binary.LittleEndian.Uint16(header[4:6])
 	block.Type = header[6]
+	if int(block.Size) > avail {
+		return nil, w.corrupt(reader, fmt.Sprintf("block size %v exceeds the block", block.Size))
+	}
 
 	buf := make([]byte, block.Size)
 	n, err = io.ReadFull(reader, buf)
+	w.offset += n
+	if err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	}
 	if err != nil {
 		return nil, err
 	}
-	if n != int(block.Size) {
-		return nil, fmt.Errorf("unexpected error while reading block, read %v expected %v", n, block.Size)
-	}
-	w.offset += n
 
 	block.Payload = buf
 	if crc32.ChecksumIEEE(block.Payload) != block.CRC {
-		return nil, errors.New("crc32 doesn't match for the block")
+		return nil, w.corrupt(reader, "crc32 doesn't match for the block")
+	}
+	if block.Type < typeFull || block.Type > typeLast {
+		return nil, w.corrupt(reader, fmt.Sprintf("unknown block type %v", block.Type))
 	}
 	w.lastBlockType = block.Type
 
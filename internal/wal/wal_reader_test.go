@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"fmt"
 	"hash/crc32"
+	"io"
 	"math/rand"
 	"os"
 	"testing"
@@ -146,3 +147,52 @@ func testFragmentedReadBlock(t *testing.T) {
 	assert.ErrorIs(t, nil, err)
 	assert.Equal(t, expectedBlock, *block)
 }
+
+func TestWalReader_ReadRecord(t *testing.T) {
+	opts := &WalOptions{BlockSize: 64}
+	b := NewTestFile()
+	w := NewWalWriter(b, opts)
+	recs := [][]byte{
+		[]byte("hello"),
+		bytes.Repeat([]byte{'a'}, 200),
+		bytes.Repeat([]byte{'b'}, 57),
+	}
+	for _, rec := range recs {
+		_, err := w.Write(rec)
+		assert.Nil(t, err)
+	}
+	w.Flush()
+
+	r := NewWalReader(opts)
+	reader := bufio.NewReader(b)
+	for _, rec := range recs {
+		res, err := r.ReadRecord(reader)
+		assert.Nil(t, err)
+		assert.Equal(t, rec, res)
+	}
+	_, err := r.ReadRecord(reader)
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestWalReader_EmptyFirstFragment(t *testing.T) {
+	opts := &WalOptions{BlockSize: 64}
+	b := NewTestFile()
+	w := NewWalWriter(b, opts)
+	// leaves exactly a header in the first block
+	recs := [][]byte{bytes.Repeat([]byte{'a'}, 64-2*BlockHeaderSize), []byte("hello")}
+	for _, rec := range recs {
+		_, err := w.Write(rec)
+		assert.Nil(t, err)
+	}
+	w.Flush()
+	assert.Equal(t, typeFirst, b.buf.Bytes()[64-BlockHeaderSize+6])
+	assert.Equal(t, typeLast, b.buf.Bytes()[64+6])
+
+	r := NewWalReader(opts)
+	reader := bufio.NewReader(b)
+	for _, rec := range recs {
+		res, err := r.ReadRecord(reader)
+		assert.Nil(t, err)
+		assert.Equal(t, rec, res)
+	}
+}
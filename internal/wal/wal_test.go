@@ -45,7 +45,7 @@ func TestNewManager(t *testing.T) {
 	defer afterTest()
 	a := assert.New(t)
 	path := testPath()
-	m := NewManager(path)
+	m := NewManager(path, nil)
 	a.NotNil(m)
 	a.Equal(m.dbPath, path)
 	a.Equal(m.counter, 0)
@@ -56,7 +56,7 @@ func TestManager_Init(t *testing.T) {
 	defer afterTest()
 	a := assert.New(t)
 	p := testPath()
-	m := NewManager(p)
+	m := NewManager(p, nil)
 	m.Init()
 	defer m.Close()
 	walDir := path.Join(testPath(), "wal")
@@ -72,7 +72,7 @@ func TestManager_Add(t *testing.T) {
 	beforeTest()
 	defer afterTest()
 	a := assert.New(t)
-	m := NewManager(testPath())
+	m := NewManager(testPath(), nil)
 	m.Init()
 	defer m.Close()
 	rec := &Log{
@@ -96,7 +96,7 @@ func TestManager_RecoverLogs(t *testing.T) {
 	beforeTest()
 	defer afterTest()
 	path := testPath()
-	m := NewManager(path)
+	m := NewManager(path, nil)
 	m.Init()
 	a := assert.New(t)
 	recCount := 1
@@ -108,14 +108,17 @@ func TestManager_RecoverLogs(t *testing.T) {
 		}
 		m.Add(rec)
 	}
-	m.Close()
+	a.True(m.unsynced)
+	a.Nil(m.Close())
+	a.False(m.unsynced)
+	// closed manager has no file to close
+	a.Nil(m.Close())
 	it, err := m.GetRecoverIterator()
 	a.NotNil(it)
 	logs := make([]*Log, 0)
 	for it.Next() {
-		l := it.RecoverCurrentFile()
-		for i := 0; i < len(l); i++ {
-			logs = append(logs, l[i])
+		for _, b := range it.RecoverCurrentFile() {
+			logs = append(logs, b.Logs...)
 		}
 	}
 	a.Nil(err)
@@ -137,7 +140,7 @@ func BenchmarkManager_Add(b *testing.B) {
 	beforeTest()
 	defer afterTest()
 	path := testPath()
-	m := NewManager(path)
+	m := NewManager(path, nil)
 	m.Init()
 	defer m.Close()
 	for i := 0; i < b.N; i++ {
@@ -149,3 +152,161 @@ func BenchmarkManager_Add(b *testing.B) {
 		m.Add(rec)
 	}
 }
+
+func TestManager_RecoverBatch(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+	m := NewManager(testPath(), nil)
+	m.Init()
+	a := assert.New(t)
+
+	a.Nil(m.Add(&Log{Key: []byte("k0"), Value: []byte("v0")}))
+	batch := &Batch{Seq: 7, Logs: []*Log{
+		{Key: []byte("k1"), Value: []byte("v1")},
+		{Key: []byte("k2"), Value: bytes.Repeat([]byte{'v'}, 40000)},
+	}}
+	a.Nil(m.AddBatch(batch))
+	a.Nil(m.AddBatch(batch))
+	walPath := m.CurrentFilePath()
+	m.Close()
+
+	// tear the last batch, it must be dropped as a whole
+	info, err := os.Stat(walPath)
+	a.Nil(err)
+	a.Nil(os.Truncate(walPath, info.Size()-100))
+
+	it, err := m.GetRecoverIterator()
+	a.Nil(err)
+	a.True(it.Next())
+	batches := it.RecoverCurrentFile()
+	a.Equal(2, len(batches))
+	a.Equal(uint64(0), batches[0].Seq)
+	a.Equal(1, len(batches[0].Logs))
+	a.Equal([]byte("k0"), batches[0].Logs[0].Key)
+	a.Equal(batch, batches[1])
+}
+
+func TestManager_RotateBySize(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+	a := assert.New(t)
+	m := NewManager(testPath(), &WalOptions{MaxFileSize: 1024})
+	a.Nil(m.Init())
+
+	for i := 0; i < 100; i++ {
+		a.Nil(m.Add(&Log{Key: []byte(fmt.Sprintf("k%v", i)), Value: bytes.Repeat([]byte{'v'}, 100)}))
+	}
+	size := m.SizeSinceSwitch()
+	a.True(size > 100*100)
+	files, err := m.SwitchFile()
+	a.Nil(err)
+	a.True(len(files) > 5)
+	var total int64
+	for _, f := range files {
+		info, err := os.Stat(f)
+		a.Nil(err)
+		a.True(info.Size() < 1024+BlockSize)
+		total += info.Size()
+	}
+	a.Equal(size, total)
+	a.Equal(int64(0), m.SizeSinceSwitch())
+	m.Close()
+
+	// records of rotated files are recovered in order
+	it, err := m.GetRecoverIterator()
+	a.Nil(err)
+	keys := make([]string, 0)
+	for it.Next() {
+		for _, b := range it.RecoverCurrentFile() {
+			for _, l := range b.Logs {
+				keys = append(keys, string(l.Key))
+			}
+		}
+	}
+	a.Equal(100, len(keys))
+	for i, k := range keys {
+		a.Equal(fmt.Sprintf("k%v", i), k)
+	}
+}
+
+func TestFileIterator_RecoveryModes(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+	a := assert.New(t)
+	m := NewManager(testPath(), nil)
+	a.Nil(m.Init())
+	// records span blocks, so records after a damaged block are readable
+	for i := 0; i < 4; i++ {
+		a.Nil(m.AddBatch(&Batch{Seq: uint64(i + 1), Logs: []*Log{
+			{Key: []byte(fmt.Sprintf("k%v", i)), Value: bytes.Repeat([]byte{'v'}, 20000)},
+		}}))
+	}
+	walPath := m.CurrentFilePath()
+	m.Close()
+	data, err := os.ReadFile(walPath)
+	a.Nil(err)
+	a.Nil(os.Remove(walPath))
+
+	corrupted := append([]byte{}, data...)
+	corrupted[20100] ^= 0xff
+	torn := data[:len(data)-100]
+
+	recover := func(data []byte, mode RecoveryMode) ([]uint64, *FileIterator) {
+		a.Nil(os.WriteFile(walPath, data, 0664))
+		it, err := m.GetRecoverIterator()
+		a.Nil(err)
+		it.Mode = mode
+		seqs := make([]uint64, 0)
+		for it.Next() {
+			for _, b := range it.RecoverCurrentFile() {
+				seqs = append(seqs, b.Seq)
+			}
+			a.Nil(it.RemoveCurrentFile())
+		}
+		return seqs, it
+	}
+
+	// damage in the middle of the file
+	_, it := recover(corrupted, RecoverTolerateCorruptedTail)
+	a.ErrorIs(it.Err(), ErrCorruptRecord)
+	var recErr *RecoveryError
+	a.ErrorAs(it.Err(), &recErr)
+	a.Equal(walPath, recErr.File)
+
+	_, it = recover(corrupted, RecoverAbsoluteConsistency)
+	a.ErrorIs(it.Err(), ErrCorruptRecord)
+
+	seqs, it := recover(corrupted, RecoverPointInTime)
+	a.Nil(it.Err())
+	a.Equal([]uint64{1}, seqs)
+	report := it.Report()
+	a.Equal(RecoverPointInTime, report.Mode)
+	a.Equal(1, report.Batches)
+	a.Equal(1, len(report.Skipped))
+	a.Equal(int64(len(data)), report.Skipped[0].Offset+report.Skipped[0].Length)
+
+	seqs, it = recover(corrupted, RecoverSkipAnyCorruptedRecord)
+	a.Nil(it.Err())
+	a.Equal([]uint64{1, 3, 4}, seqs)
+	a.True(len(it.Report().Skipped) > 0)
+	for _, s := range it.Report().Skipped {
+		a.True(s.Offset > 20000 && s.Offset+s.Length < 60000)
+	}
+
+	// torn write at the end of the file
+	for _, mode := range []RecoveryMode{RecoverTolerateCorruptedTail, RecoverPointInTime, RecoverSkipAnyCorruptedRecord} {
+		seqs, it = recover(torn, mode)
+		a.Nil(it.Err())
+		a.Equal([]uint64{1, 2, 3}, seqs)
+		a.Equal(1, len(it.Report().Skipped))
+		a.Equal(int64(len(torn)), it.Report().Skipped[0].Offset+it.Report().Skipped[0].Length)
+	}
+	_, it = recover(torn, RecoverAbsoluteConsistency)
+	a.ErrorIs(it.Err(), ErrCorruptRecord)
+
+	// intact file
+	seqs, it = recover(data, RecoverAbsoluteConsistency)
+	a.Nil(it.Err())
+	a.Equal([]uint64{1, 2, 3, 4}, seqs)
+	a.Equal(0, len(it.Report().Skipped))
+}
@@ -11,8 +11,26 @@ import (
 // header size of trailer
 var trailer = []byte{0xfa, 0xfa, 0xfa, 0xfa, 0xfa, 0xfa, 0xfa}
 
+// SyncMode tells when WAL files are synced to disk
+type SyncMode int
+
+const (
+	// Records are handed to the OS on each write. They survive a crash
+	// of the process but may be lost if the machine crashes
+	SyncNone SyncMode = iota
+	// File is synced to disk after each write
+	SyncAlways
+	// File is synced in the background periodically, records written
+	// since the last sync may be lost if the machine crashes
+	SyncInterval
+	// Concurrent writes are written together and synced once
+	SyncGroupCommit
+)
+
 type WalOptions struct {
-	BlockSize int // Size of each WAL block
+	BlockSize   int      // Size of each WAL block
+	Sync        SyncMode // Manager syncs on each write in SyncAlways, other modes call Sync
+	MaxFileSize int64    // Manager starts a new file once the current one is larger
 }
 
 type WalWriter struct {
@@ -65,10 +83,33 @@ func (w *WalWriter) WriteLog(l *Log) (int, error) {
 	return n, err
 }
 
+// Writes logs of the batch as a single record, so they are recovered all together or not at all.
+// data layout: batch marker (4 byte) | sequence (8 byte) | log count (4 byte) | logs...
+// each log is encoded with the same layout as WriteLog
+func (w *WalWriter) WriteBatch(b *Batch) (int, error) {
+	totalLen := batchHeaderSize
+	for _, l := range b.Logs {
+		totalLen += LogHeaderSize + len(l.Key) + len(l.Value)
+	}
+	data := make([]byte, batchHeaderSize, totalLen)
+	binary.LittleEndian.PutUint32(data[0:], batchMarker)
+	binary.LittleEndian.PutUint64(data[4:], b.Seq)
+	binary.LittleEndian.PutUint32(data[12:], uint32(len(b.Logs)))
+	for _, l := range b.Logs {
+		data = binary.LittleEndian.AppendUint32(data, uint32(len(l.Key)))
+		data = binary.LittleEndian.AppendUint32(data, uint32(len(l.Value)))
+		data = append(data, l.Key...)
+		data = append(data, l.Value...)
+	}
+	return w.Write(data)
+}
+
 func (w *WalWriter) Write(b []byte) (int, error) {
 
 	offset := 0
 	rem := len(b)
+	// first fragment may be empty when only a header fits into the block
+	begin := true
 
 	for rem > 0 {
 		leftOver := w.opts.BlockSize - w.offset
@@ -87,9 +128,9 @@ func (w *WalWriter) Write(b []byte) (int, error) {
 		}
 
 		blockType := typeMiddle
-		if offset == 0 && amount == rem {
+		if begin && amount == rem {
 			blockType = typeFull
-		} else if offset == 0 {
+		} else if begin {
 			blockType = typeFirst
 		} else if amount == rem {
 			blockType = typeLast
@@ -118,13 +159,22 @@ func (w *WalWriter) Write(b []byte) (int, error) {
 		}
 		w.offset += n
 		rem -= n
+		begin = false
 	}
 	if flushOnWrite {
-		w.f.Flush()
+		err := w.f.Flush()
+		if err != nil {
+			return len(b), err
+		}
 	}
 	return len(b), nil
 }
 
+// Returns number of bytes written including block headers and trailers
+func (w *WalWriter) Size() int64 {
+	return int64(w.total + w.offset)
+}
+
 func (w *WalWriter) Flush() error {
 	return w.f.Flush()
 }
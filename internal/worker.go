@@ -1,63 +1,147 @@
 package internal
 
 import (
-	"fmt"
 	"log"
 	"os"
-
-	"github.com/emin/spacedb/internal/wal"
+	"path"
 )
 
+// SwitchRequest is an immutable memtable waiting to be flushed into level 0
 type SwitchRequest struct {
-	memTable   MemTable
-	lastWalNum int
-	curFileNum int
+	MemTable MemTable
+	// WAL files which hold records of the memtable
+	WalPaths []string
+	// Total size of the WAL files
+	WalSize int64
+	// First WAL file which is not covered by the memtable
+	LogNumber int
+	// File number of the level 0 table
+	FileNum uint64
 }
 
+// Worker flushes immutable memtables into level 0 tables in the background.
+// Requests are flushed one by one in the order they are added.
+// After a table is durable, onFlush is called to install it and the WAL
+// file of the memtable is removed only if onFlush succeeds. A failed flush
+// isn't retried, it is passed to OnError and the worker stops flushing.
 type Worker struct {
-	queue      chan SwitchRequest
-	dbPath     string
-	walManager *wal.Manager
+	queue   chan *SwitchRequest
+	quit    chan struct{}
+	done    chan struct{}
+	dbPath  string
+	onFlush func(req *SwitchRequest, meta *MetaBlock) error
+	// Compressor of level 0 tables, nil means no compression.
+	// It must be set before Start
+	Compressor Compressor
+	// Bits of the filter of level 0 tables for each key, see
+	// SSTableWriter.BitsPerKey. It must be set before Start
+	BitsPerKey int
+	// Logger of flush errors, it must be set before Start
+	Logger Logger
+	// Called with the error of a failed flush, it must be set before Start
+	OnError func(err error)
 }
 
-func NewWorker(dbPath string, walManager *wal.Manager) *Worker {
-	return &Worker{queue: make(chan SwitchRequest), dbPath: dbPath, walManager: walManager}
+// Returns a new Worker, at most queueSize requests can wait for flush
+func NewWorker(dbPath string, queueSize int, onFlush func(req *SwitchRequest, meta *MetaBlock) error) *Worker {
+	return &Worker{
+		queue:      make(chan *SwitchRequest, queueSize),
+		quit:       make(chan struct{}),
+		done:       make(chan struct{}),
+		dbPath:     dbPath,
+		onFlush:    onFlush,
+		Logger:     log.Default(),
+		BitsPerKey: DefaultBitsPerKey,
+	}
 }
 
 func (w *Worker) Start() {
 	go func() {
+		defer close(w.done)
 		for {
-			req := <-w.queue
-			fileName := fmt.Sprintf("%v.db", req.curFileNum)
-			table := NewSSTable(w.dbPath, fileName)
-			err := table.Save(req.memTable)
-			if err != nil {
-				log.Println(err)
-				continue
+			select {
+			case <-w.quit:
+				return
+			case req := <-w.queue:
+				err := w.flush(req)
+				if err != nil {
+					// memtables which are not flushed are kept in their WAL files
+					w.Logger.Printf("error while flushing memtable: %v\n", err)
+					if w.OnError != nil {
+						w.OnError(err)
+					}
+					return
+				}
+				for _, p := range req.WalPaths {
+					w.ClearWAL(p)
+				}
 			}
-			w.ClearWAL(req.lastWalNum)
 		}
 	}()
 }
 
-func (w *Worker) ClearWAL(num int) {
-	path := fmt.Sprintf("%v/wal/%v.log", w.dbPath, num)
+// Stops the worker after the flush in progress is done.
+// Requests which are still queued are dropped, their
+// records are kept in their WAL files
+func (w *Worker) Stop() {
+	close(w.quit)
+	<-w.done
+}
+
+func (w *Worker) flush(req *SwitchRequest) error {
+	meta, err := w.WriteTable(req.MemTable, req.FileNum)
+	if err != nil {
+		return err
+	}
+	err = w.onFlush(req, meta)
+	if err != nil {
+		_ = os.Remove(path.Join(w.dbPath, meta.FileName))
+		return err
+	}
+	return nil
+}
+
+// Writes the memtable into a durable level 0 table
+func (w *Worker) WriteTable(mem MemTable, fileNum uint64) (*MetaBlock, error) {
+	writer, err := NewSSTableWriter(w.dbPath, TableFileName(0, fileNum))
+	if err != nil {
+		return nil, err
+	}
+	writer.Compressor = w.Compressor
+	writer.BitsPerKey = w.BitsPerKey
+	it := mem.Iterator()
+	for it.Next() {
+		err = writer.Add(it.Key(), it.Value())
+		if err != nil {
+			writer.Abandon()
+			return nil, err
+		}
+	}
+	for _, t := range mem.RangeTombstones().List() {
+		writer.AddRangeTombstone(t)
+	}
+	meta, err := writer.Finish()
+	if err != nil {
+		writer.Abandon()
+		return nil, err
+	}
+	meta.FileNum = fileNum
+	return meta, nil
+}
+
+func (w *Worker) ClearWAL(path string) {
 	_, err := os.Stat(path)
 	if os.IsNotExist(err) {
 		return
 	}
 	err = os.Remove(path)
 	if err != nil {
-		log.Println(err)
+		w.Logger.Printf("error while removing wal file: %v\n", err)
 	}
 }
 
-func (w *Worker) Add(m MemTable, curWalNum, curFileNum int) {
-	go func() {
-		w.queue <- SwitchRequest{
-			memTable:   m,
-			lastWalNum: curWalNum,
-			curFileNum: curFileNum,
-		}
-	}()
+// Queues the memtable for flush. Caller must make sure
+// that no more than queueSize requests are waiting
+func (w *Worker) Add(req *SwitchRequest) {
+	w.queue <- req
 }
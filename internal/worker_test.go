@@ -0,0 +1,48 @@
+package internal
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorker_StopsOnError(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+	installErr := errors.New("install failed")
+	flushed := 0
+	w := NewWorker(testPath(), 2, func(req *SwitchRequest, meta *MetaBlock) error {
+		flushed++
+		return installErr
+	})
+	w.Logger = log.New(io.Discard, "", 0)
+	errs := make(chan error, 2)
+	w.OnError = func(err error) {
+		errs <- err
+	}
+
+	walPath := path.Join(testPath(), "1.log")
+	assert.Nil(t, os.WriteFile(walPath, []byte("x"), 0644))
+	for i := 1; i <= 2; i++ {
+		m := NewMemTable()
+		m.Set(MakeInternalKey([]byte("k"), uint64(i), KindSet), []byte("v"))
+		w.Add(&SwitchRequest{MemTable: m, WalPaths: []string{walPath}, FileNum: uint64(i)})
+	}
+	w.Start()
+	assert.Equal(t, installErr, <-errs)
+	w.Stop()
+
+	// the failed flush isn't retried and later requests are dropped
+	assert.Equal(t, 1, flushed)
+	assert.Equal(t, 0, len(errs))
+	// table of the failed install is removed, WAL file is kept
+	_, err := os.Stat(path.Join(testPath(), TableFileName(0, 1)))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(walPath)
+	assert.Nil(t, err)
+}
@@ -0,0 +1,404 @@
+package spacedb
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/emin/spacedb/internal"
+)
+
+// IteratorOptions limits the keys returned by an Iterator
+type IteratorOptions struct {
+	// Inclusive lower bound, nil means no lower bound
+	LowerBound []byte
+	// Exclusive upper bound, nil means no upper bound
+	UpperBound []byte
+	// Reads the database as of the snapshot, nil means the current state
+	Snapshot *Snapshot
+}
+
+// Iterator walks over the keys of the database in key order.
+// Deleted keys and keys covered by range tombstones are never returned. Each moving method returns
+// true if the iterator is positioned on a key afterwards.
+// Iterators must be closed after use
+type Iterator interface {
+	Valid() bool
+	SeekToFirst() bool
+	SeekToLast() bool
+	// Positions at the first key which is >= key
+	Seek(key []byte) bool
+	Next() bool
+	Prev() bool
+	Key() []byte
+	Value() []byte
+	// Returns the first error encountered while iterating
+	Err() error
+	Close() error
+}
+
+// dbIterator merges internal keys of memtables and sstables and
+// returns the newest version of each user key visible at seq.
+// In forward direction the internal iterator is positioned at the
+// current entry, in reverse direction it is positioned before all
+// entries of the current user key
+type dbIterator struct {
+	iter internal.SeekIterator
+	// range tombstones of all memtables and sstables
+	tombstones *internal.RangeTombstones
+	opts       IteratorOptions
+	seq        uint64
+	// values which expire before the iterator is created are hidden
+	now time.Time
+	// combines merge operands, nil if merges aren't allowed
+	merger    MergeOperator
+	valid     bool
+	direction int
+	key       []byte
+	value     []byte
+	err       error
+}
+
+const (
+	dirForward = iota
+	dirReverse
+)
+
+// Returns an iterator over memtables and all sstable levels.
+// Newer versions of a key shadow older ones
+func (g *SpaceDBImpl) NewIterator(opts *IteratorOptions) (Iterator, error) {
+	g.rwLock.RLock()
+	defer g.rwLock.RUnlock()
+	if g.closed {
+		return nil, ErrClosed
+	}
+	return g.newIterator(opts)
+}
+
+// rwLock must be held
+func (g *SpaceDBImpl) newIterator(opts *IteratorOptions) (*dbIterator, error) {
+	if opts == nil {
+		opts = &IteratorOptions{}
+	}
+
+	children := []internal.SeekIterator{g.curMemTable.SeekIterator()}
+	tombstones := []*internal.RangeTombstones{g.curMemTable.RangeTombstones()}
+	for i := len(g.immMemTables) - 1; i >= 0; i-- {
+		children = append(children, g.immMemTables[i].MemTable.SeekIterator())
+		tombstones = append(tombstones, g.immMemTables[i].MemTable.RangeTombstones())
+	}
+
+	closeAll := func() {
+		for _, c := range children {
+			_ = c.Close()
+		}
+	}
+	for level, files := range g.sstableMetadata {
+		files = filesInRange(files, opts)
+		iters := make([]internal.SeekIterator, 0, len(files))
+		for _, f := range files {
+			var it internal.SeekIterator
+			var set *internal.RangeTombstones
+			table, err := g.openTable(f)
+			if err == nil {
+				set, err = table.RangeTombstones()
+				if err != nil {
+					table.CloseFile()
+				}
+			}
+			if err == nil {
+				tombstones = append(tombstones, set)
+				it, err = table.SeekIterator()
+			}
+			if err != nil {
+				closeAll()
+				for _, it := range iters {
+					_ = it.Close()
+				}
+				return nil, err
+			}
+			iters = append(iters, it)
+		}
+
+		if level == 0 {
+			// level 0 files overlap, newer files come first
+			for i := len(iters) - 1; i >= 0; i-- {
+				children = append(children, iters[i])
+			}
+		} else if len(iters) > 0 {
+			children = append(children, internal.NewLevelIterator(files, iters))
+		}
+	}
+
+	seq := g.versions.LastSequence
+	if opts.Snapshot != nil {
+		seq = opts.Snapshot.seq
+	}
+	return &dbIterator{
+		iter:       internal.NewMergingIterator(children),
+		tombstones: internal.MergeRangeTombstones(tombstones...),
+		opts:       *opts,
+		seq:        seq,
+		now:        time.Now(),
+		merger:     g.opts.MergeOperator,
+	}, nil
+}
+
+// Returns files which may have keys within bounds of the options
+func filesInRange(files []*internal.MetaBlock, opts *IteratorOptions) []*internal.MetaBlock {
+	res := make([]*internal.MetaBlock, 0, len(files))
+	for _, f := range files {
+		if opts.LowerBound != nil && internal.CompareUserKeys(*f.MaxKey, internal.SeekKey(opts.LowerBound, internal.MaxSequence)) < 0 {
+			continue
+		}
+		if opts.UpperBound != nil && internal.CompareUserKeys(*f.MinKey, internal.SeekKey(opts.UpperBound, internal.MaxSequence)) >= 0 {
+			continue
+		}
+		res = append(res, f)
+	}
+	return res
+}
+
+func (it *dbIterator) Valid() bool {
+	return it.valid
+}
+
+func (it *dbIterator) SeekToFirst() bool {
+	it.direction = dirForward
+	if it.opts.LowerBound != nil {
+		it.iter.Seek(internal.SeekKey(it.opts.LowerBound, it.seq))
+	} else {
+		it.iter.SeekToFirst()
+	}
+	return it.findNextUserEntry(nil)
+}
+
+func (it *dbIterator) SeekToLast() bool {
+	it.direction = dirReverse
+	if it.opts.UpperBound != nil {
+		it.iter.Seek(internal.SeekKey(it.opts.UpperBound, internal.MaxSequence))
+		if it.iter.Valid() {
+			it.iter.Prev()
+		} else if it.iter.Err() == nil {
+			it.iter.SeekToLast()
+		}
+	} else {
+		it.iter.SeekToLast()
+	}
+	return it.findPrevUserEntry()
+}
+
+func (it *dbIterator) Seek(key []byte) bool {
+	if it.opts.LowerBound != nil && bytes.Compare(key, it.opts.LowerBound) < 0 {
+		key = it.opts.LowerBound
+	}
+	it.direction = dirForward
+	it.iter.Seek(internal.SeekKey(key, it.seq))
+	return it.findNextUserEntry(nil)
+}
+
+func (it *dbIterator) Next() bool {
+	if !it.valid {
+		return false
+	}
+	if it.direction == dirReverse {
+		// move to the entries of the current key
+		it.iter.Seek(internal.SeekKey(it.key, internal.MaxSequence))
+		it.direction = dirForward
+	}
+	return it.findNextUserEntry(it.key)
+}
+
+func (it *dbIterator) Prev() bool {
+	if !it.valid {
+		return false
+	}
+	if it.direction == dirForward {
+		// move before all entries of the current key
+		it.iter.Seek(internal.SeekKey(it.key, internal.MaxSequence))
+		if it.iter.Valid() {
+			it.iter.Prev()
+		} else if it.iter.Err() == nil {
+			it.iter.SeekToLast()
+		}
+		it.direction = dirReverse
+	}
+	return it.findPrevUserEntry()
+}
+
+// Moves forward to the newest visible version of a user key which
+// is after skip and not deleted. Stops at the upper bound
+func (it *dbIterator) findNextUserEntry(skip []byte) bool {
+	it.valid = false
+	for ; it.iter.Valid(); it.iter.Next() {
+		ikey, err := internal.ParseInternalKey(it.iter.Key())
+		if err != nil {
+			it.err = err
+			return false
+		}
+		if it.opts.UpperBound != nil && bytes.Compare(ikey.UserKey, it.opts.UpperBound) >= 0 {
+			return false
+		}
+		if ikey.Seq > it.seq || (skip != nil && bytes.Compare(ikey.UserKey, skip) <= 0) {
+			continue
+		}
+		if ikey.Kind == internal.KindDelete || it.tombstones.Covers(ikey.UserKey, ikey.Seq, it.seq) {
+			// older versions of the key are hidden
+			skip = ikey.UserKey
+			continue
+		}
+		val := it.iter.Value()
+		if val == nil {
+			return false
+		}
+		if isExpired(val, it.now) {
+			// expired values hide older versions like tombstones
+			skip = ikey.UserKey
+			continue
+		}
+		if ikey.Kind == internal.KindMerge {
+			return it.mergeForward(ikey.UserKey)
+		}
+		it.key = ikey.UserKey
+		it.value = Deserialize(val).Value
+		it.valid = true
+		return true
+	}
+	return false
+}
+
+// Moves backward over all versions of the previous user key and keeps
+// the newest visible one. Deleted keys are skipped, stops at the lower bound
+func (it *dbIterator) findPrevUserEntry() bool {
+	it.valid = false
+	kind := internal.KindDelete
+	// value of the current key and its newer merge operands, oldest first
+	var existing []byte
+	var operands [][]byte
+	for ; it.iter.Valid(); it.iter.Prev() {
+		ikey, err := internal.ParseInternalKey(it.iter.Key())
+		if err != nil {
+			it.err = err
+			return false
+		}
+		if it.opts.LowerBound != nil && bytes.Compare(ikey.UserKey, it.opts.LowerBound) < 0 {
+			break
+		}
+		if ikey.Seq > it.seq {
+			continue
+		}
+		if kind != internal.KindDelete && bytes.Compare(ikey.UserKey, it.key) < 0 {
+			// a live version of a later key is found
+			break
+		}
+		kind = ikey.Kind
+		if it.tombstones.Covers(ikey.UserKey, ikey.Seq, it.seq) {
+			kind = internal.KindDelete
+		}
+		if kind == internal.KindDelete {
+			existing, operands = nil, nil
+			continue
+		}
+		val := it.iter.Value()
+		if val == nil {
+			return false
+		}
+		if isExpired(val, it.now) {
+			kind = internal.KindDelete
+			existing, operands = nil, nil
+			continue
+		}
+		it.key = ikey.UserKey
+		if kind == internal.KindMerge {
+			operands = append(operands, cloneBytes(val[1:]))
+		} else {
+			existing = cloneBytes(Deserialize(val).Value)
+			operands = nil
+		}
+	}
+	if kind == internal.KindMerge {
+		return it.merge(it.key, existing, operands)
+	}
+	it.value = existing
+	it.valid = kind != internal.KindDelete
+	return it.valid
+}
+
+// Merges the merge operand at the current entry with older versions of
+// userKey down to a value or a deletion. The iterator is left on the
+// first entry which isn't merged
+func (it *dbIterator) mergeForward(userKey []byte) bool {
+	// newest first
+	operands := make([][]byte, 0)
+	var existing []byte
+	for ; it.iter.Valid(); it.iter.Next() {
+		ikey, err := internal.ParseInternalKey(it.iter.Key())
+		if err != nil {
+			it.err = err
+			return false
+		}
+		if !bytes.Equal(ikey.UserKey, userKey) || ikey.Kind == internal.KindDelete ||
+			it.tombstones.Covers(ikey.UserKey, ikey.Seq, it.seq) {
+			break
+		}
+		val := it.iter.Value()
+		if val == nil {
+			return false
+		}
+		if isExpired(val, it.now) {
+			break
+		}
+		if ikey.Kind != internal.KindMerge {
+			existing = Deserialize(val).Value
+			break
+		}
+		operands = append(operands, cloneBytes(val[1:]))
+	}
+	for i, j := 0, len(operands)-1; i < j; i, j = i+1, j-1 {
+		operands[i], operands[j] = operands[j], operands[i]
+	}
+	return it.merge(userKey, existing, operands)
+}
+
+// Makes the current entry of key from operands, oldest first,
+// applied to existing
+func (it *dbIterator) merge(key, existing []byte, operands [][]byte) bool {
+	if it.merger == nil {
+		it.err = ErrNoMergeOperator
+		return false
+	}
+	value, err := it.merger.FullMerge(key, existing, operands)
+	if err != nil {
+		it.err = err
+		return false
+	}
+	it.key = key
+	it.value = value
+	it.valid = true
+	return true
+}
+
+func (it *dbIterator) Key() []byte {
+	if !it.valid {
+		return nil
+	}
+	return it.key
+}
+
+func (it *dbIterator) Value() []byte {
+	if !it.valid {
+		return nil
+	}
+	return it.value
+}
+
+func (it *dbIterator) Err() error {
+	if it.err != nil {
+		return it.err
+	}
+	return it.iter.Err()
+}
+
+func (it *dbIterator) Close() error {
+	it.valid = false
+	return it.iter.Close()
+}
@@ -0,0 +1,111 @@
+package spacedb
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func collectKeys(it Iterator) []string {
+	res := []string{}
+	for ok := it.SeekToFirst(); ok; ok = it.Next() {
+		res = append(res, string(it.Key())+"="+string(it.Value()))
+	}
+	return res
+}
+
+func TestSpaceDBImpl_NewIterator(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	db := New(testPath()).(*SpaceDBImpl)
+	defer db.Close()
+	for i := 0; i < 10; i++ {
+		db.Set([]byte(fmt.Sprintf("k%v", i)), &DBValue{Value: []byte("old")})
+	}
+	assert.Nil(t, db.Flush())
+
+	for i := 0; i < 10; i += 2 {
+		db.Set([]byte(fmt.Sprintf("k%v", i)), &DBValue{Value: []byte("new")})
+	}
+	db.Delete([]byte("k3"))
+	db.Delete([]byte("k4"))
+	db.Set([]byte("k91"), &DBValue{Value: []byte("mem")})
+
+	it, err := db.NewIterator(nil)
+	assert.Nil(t, err)
+	want := []string{"k0=new", "k1=old", "k2=new", "k5=old", "k6=new",
+		"k7=old", "k8=new", "k9=old", "k91=mem"}
+	assert.Equal(t, want, collectKeys(it))
+
+	reversed := []string{}
+	for ok := it.SeekToLast(); ok; ok = it.Prev() {
+		reversed = append(reversed, string(it.Key())+"="+string(it.Value()))
+	}
+	for i := range want {
+		assert.Equal(t, want[len(want)-1-i], reversed[i])
+	}
+
+	assert.True(t, it.Seek([]byte("k3")))
+	assert.Equal(t, []byte("k5"), it.Key())
+	assert.True(t, it.Prev())
+	assert.Equal(t, []byte("k2"), it.Key())
+	assert.True(t, it.Next())
+	assert.Equal(t, []byte("k5"), it.Key())
+	assert.Nil(t, it.Err())
+	assert.Nil(t, it.Close())
+}
+
+func TestSpaceDBImpl_NewIteratorBounds(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	db := New(testPath())
+	defer db.Close()
+	for i := 0; i < 10; i++ {
+		db.Set([]byte(fmt.Sprintf("k%v", i)), &DBValue{Value: []byte(fmt.Sprintf("v%v", i))})
+		if i == 4 {
+			assert.Nil(t, db.Flush())
+		}
+	}
+
+	it, err := db.NewIterator(&IteratorOptions{
+		LowerBound: []byte("k3"),
+		UpperBound: []byte("k7"),
+	})
+	assert.Nil(t, err)
+	defer it.Close()
+	assert.Equal(t, []string{"k3=v3", "k4=v4", "k5=v5", "k6=v6"}, collectKeys(it))
+
+	assert.True(t, it.SeekToLast())
+	assert.Equal(t, []byte("k6"), it.Key())
+	assert.True(t, it.Seek([]byte("k0")))
+	assert.Equal(t, []byte("k3"), it.Key())
+	assert.False(t, it.Prev())
+	assert.False(t, it.Valid())
+	assert.False(t, it.Seek([]byte("k8")))
+}
+
+func TestSpaceDBImpl_NewIteratorPrefix(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	db := New(testPath())
+	defer db.Close()
+	for _, k := range []string{"user/1", "user/2", "users", "tenant/1", "user/3"} {
+		db.Set([]byte(k), &DBValue{Value: []byte("v")})
+	}
+
+	it, err := db.NewIterator(&IteratorOptions{
+		LowerBound: []byte("user/"),
+		UpperBound: []byte("user0"),
+	})
+	assert.Nil(t, err)
+	defer it.Close()
+	assert.Equal(t, []string{"user/1=v", "user/2=v", "user/3=v"}, collectKeys(it))
+
+	db.Close()
+	_, err = db.NewIterator(nil)
+	assert.Equal(t, ErrClosed, err)
+}
@@ -0,0 +1,117 @@
+package spacedb
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// MergeOperator combines merge operands of a key with its value, so
+// updates like increments don't need a read before the write. Operands
+// are kept until a read or a compaction merges them. Operands are
+// ordered from oldest to newest
+type MergeOperator interface {
+	// Returns the value which results from applying operands
+	// to existing, existing is nil if the key doesn't exist
+	FullMerge(key, existing []byte, operands [][]byte) ([]byte, error)
+	// Combines two operands into one,
+	// false if they can't be combined without the value
+	PartialMerge(key, left, right []byte) ([]byte, bool)
+}
+
+var (
+	// Adds operands to the value, both are 8-byte little endian uint64s.
+	// A missing value is 0, sums wrap around
+	UInt64AddOperator MergeOperator = uint64AddOperator{}
+	// Appends operands to the value
+	AppendOperator = NewAppendOperator(nil)
+)
+
+// Returns a MergeOperator which appends operands to the value, sep is
+// put between the value and each operand
+func NewAppendOperator(sep []byte) MergeOperator {
+	return appendOperator{sep: cloneBytes(sep)}
+}
+
+type uint64AddOperator struct{}
+
+func (uint64AddOperator) FullMerge(key, existing []byte, operands [][]byte) ([]byte, error) {
+	var sum uint64
+	if existing != nil {
+		if len(existing) != 8 {
+			return nil, fmt.Errorf("%w: value of %q isn't a uint64", ErrInvalidMergeOperand, key)
+		}
+		sum = binary.LittleEndian.Uint64(existing)
+	}
+	for _, op := range operands {
+		if len(op) != 8 {
+			return nil, fmt.Errorf("%w: operand of %q isn't a uint64", ErrInvalidMergeOperand, key)
+		}
+		sum += binary.LittleEndian.Uint64(op)
+	}
+	return binary.LittleEndian.AppendUint64(nil, sum), nil
+}
+
+func (uint64AddOperator) PartialMerge(key, left, right []byte) ([]byte, bool) {
+	if len(left) != 8 || len(right) != 8 {
+		return nil, false
+	}
+	return binary.LittleEndian.AppendUint64(nil, binary.LittleEndian.Uint64(left)+binary.LittleEndian.Uint64(right)), true
+}
+
+type appendOperator struct {
+	sep []byte
+}
+
+func (a appendOperator) FullMerge(key, existing []byte, operands [][]byte) ([]byte, error) {
+	value := cloneBytes(existing)
+	for i, op := range operands {
+		if existing != nil || i > 0 {
+			value = append(value, a.sep...)
+		}
+		value = append(value, op...)
+	}
+	return value, nil
+}
+
+func (a appendOperator) PartialMerge(key, left, right []byte) ([]byte, bool) {
+	value := append(cloneBytes(left), a.sep...)
+	return append(value, right...), true
+}
+
+// storedMerger merges stored values in compaction with a MergeOperator
+type storedMerger struct {
+	op MergeOperator
+}
+
+func (m storedMerger) FullMerge(key, existing []byte, operands [][]byte) ([]byte, error) {
+	if existing != nil {
+		existing = Deserialize(existing).Value
+	}
+	value, err := m.op.FullMerge(key, existing, mergeOperands(operands))
+	if err != nil {
+		return nil, err
+	}
+	return (&DBValue{Value: value}).Serialize(), nil
+}
+
+func (m storedMerger) PartialMerge(key []byte, operands [][]byte) ([]byte, bool) {
+	ops := mergeOperands(operands)
+	operand := ops[0]
+	for _, op := range ops[1:] {
+		var ok bool
+		operand, ok = m.op.PartialMerge(key, operand, op)
+		if !ok {
+			return nil, false
+		}
+	}
+	return append([]byte{flagMergeOperand}, operand...), true
+}
+
+// Returns operands of stored merge operands
+func mergeOperands(stored [][]byte) [][]byte {
+	ops := make([][]byte, len(stored))
+	for i, s := range stored {
+		ops[i] = s[1:]
+	}
+	return ops
+}
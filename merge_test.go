@@ -0,0 +1,158 @@
+package spacedb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func uint64Bytes(n uint64) []byte {
+	return binary.LittleEndian.AppendUint64(nil, n)
+}
+
+func TestUInt64AddOperator(t *testing.T) {
+	op := UInt64AddOperator
+	v, err := op.FullMerge([]byte("k"), nil, [][]byte{uint64Bytes(1), uint64Bytes(2)})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64Bytes(3), v)
+	v, err = op.FullMerge([]byte("k"), uint64Bytes(10), [][]byte{uint64Bytes(5)})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64Bytes(15), v)
+	_, err = op.FullMerge([]byte("k"), []byte("x"), [][]byte{uint64Bytes(5)})
+	assert.True(t, errors.Is(err, ErrInvalidMergeOperand))
+
+	v, ok := op.PartialMerge([]byte("k"), uint64Bytes(1), uint64Bytes(2))
+	assert.True(t, ok)
+	assert.Equal(t, uint64Bytes(3), v)
+	_, ok = op.PartialMerge([]byte("k"), uint64Bytes(1), []byte("x"))
+	assert.False(t, ok)
+}
+
+func TestAppendOperator(t *testing.T) {
+	op := NewAppendOperator([]byte(","))
+	v, err := op.FullMerge([]byte("k"), nil, [][]byte{[]byte("a"), []byte("b")})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("a,b"), v)
+	v, err = op.FullMerge([]byte("k"), []byte("x"), [][]byte{[]byte("a")})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("x,a"), v)
+	v, ok := op.PartialMerge([]byte("k"), []byte("a"), []byte("b"))
+	assert.True(t, ok)
+	assert.Equal(t, []byte("a,b"), v)
+
+	// stored values have flags
+	m := storedMerger{op: AppendOperator}
+	v, ok = m.PartialMerge([]byte("k"), [][]byte{{flagMergeOperand, 'a'}, {flagMergeOperand, 'b'}})
+	assert.True(t, ok)
+	assert.Equal(t, []byte{flagMergeOperand, 'a', 'b'}, v)
+	v, err = m.FullMerge([]byte("k"), (&DBValue{Value: []byte("x")}).Serialize(), [][]byte{{flagMergeOperand, 'a'}})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("xa"), Deserialize(v).Value)
+}
+
+func TestSpaceDBImpl_Merge(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+	a := assert.New(t)
+
+	db, err := Open(testPath(), nil)
+	a.Nil(err)
+	a.Equal(ErrNoMergeOperator, db.Merge([]byte("k"), []byte("a")))
+	a.Nil(db.Close())
+
+	opts := &Options{MergeOperator: NewAppendOperator([]byte(","))}
+	db, err = Open(testPath(), opts)
+	a.Nil(err)
+	impl := db.(*SpaceDBImpl)
+	a.Nil(db.Merge([]byte("a"), []byte("1")))
+	a.Nil(db.Set([]byte("b"), &DBValue{Value: []byte("x")}))
+	a.Nil(db.Flush())
+	a.Nil(db.Merge([]byte("a"), []byte("2")))
+	a.Nil(db.Merge([]byte("b"), []byte("y")))
+	snap := db.GetSnapshot()
+	a.Nil(db.Delete([]byte("b")))
+	a.Nil(db.Merge([]byte("b"), []byte("z")))
+	a.Nil(db.Merge([]byte("c"), []byte("1")))
+	a.Nil(db.DeleteRange([]byte("c"), []byte("d")))
+
+	check := func() {
+		a.Equal([]byte("1,2"), getValue(t, db, []byte("a")))
+		a.Equal([]byte("z"), getValue(t, db, []byte("b")))
+		_, err := db.Get([]byte("c"))
+		a.Equal(ErrNotFound, err)
+		a.Equal([]byte("x,y"), getValueAt(t, db, []byte("b"), snap))
+
+		it, err := db.NewIterator(nil)
+		a.Nil(err)
+		a.Equal([]string{"a=1,2", "b=z"}, collectKeys(it))
+		a.Equal([]string{"b=z", "a=1,2"}, collectKeysBackward(it))
+		a.True(it.Seek([]byte("a")))
+		a.True(it.Next())
+		a.Equal([]byte("b"), it.Key())
+		a.True(it.Prev())
+		a.Equal([]byte("1,2"), it.Value())
+		a.Nil(it.Close())
+	}
+	check()
+
+	// operands are merged by compaction
+	for i := 0; i < 3; i++ {
+		a.Nil(db.Merge([]byte("a"), []byte(fmt.Sprint(i+3))))
+		a.Nil(db.Flush())
+	}
+	impl.rwLock.Lock()
+	for impl.compacting {
+		impl.bgCond.Wait()
+	}
+	a.Equal(0, len(impl.sstableMetadata[0]))
+	impl.rwLock.Unlock()
+	a.Equal([]byte("1,2,3,4,5"), getValue(t, db, []byte("a")))
+	db.ReleaseSnapshot(snap)
+	snap = nil
+
+	// operands are replayed from WAL
+	a.Nil(db.Merge([]byte("a"), []byte("6")))
+	a.Nil(db.CloseWithOptions(&CloseOptions{SkipFlush: true}))
+	db, err = Open(testPath(), opts)
+	a.Nil(err)
+	a.Equal([]byte("1,2,3,4,5,6"), getValue(t, db, []byte("a")))
+
+	// a database with operands can't be read without the operator
+	a.Nil(db.Close())
+	db, err = Open(testPath(), nil)
+	a.Nil(err)
+	_, err = db.Get([]byte("a"))
+	a.Equal(ErrNoMergeOperator, err)
+	a.Nil(db.Close())
+}
+
+func TestSpaceDBImpl_MergeCounter(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+	db, err := Open(testPath(), &Options{MergeOperator: UInt64AddOperator, CreateIfMissing: true})
+	assert.Nil(t, err)
+	defer db.Close()
+	impl := db.(*SpaceDBImpl)
+
+	for i := 0; i < 4; i++ {
+		for j := 0; j < 10; j++ {
+			assert.Nil(t, db.Merge([]byte("counter"), uint64Bytes(1)))
+		}
+		assert.Nil(t, db.Flush())
+	}
+	impl.rwLock.Lock()
+	for impl.compacting {
+		impl.bgCond.Wait()
+	}
+	// operands are collapsed into one value
+	var keys int64
+	for _, m := range impl.sstableMetadata[1] {
+		keys += m.KeyCount
+	}
+	impl.rwLock.Unlock()
+	assert.Equal(t, int64(1), keys)
+	assert.Equal(t, uint64Bytes(40), getValue(t, db, []byte("counter")))
+}
@@ -0,0 +1,204 @@
+package spacedb
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/emin/spacedb/internal"
+	"github.com/emin/spacedb/internal/wal"
+)
+
+// Default size of the memtable, it is flushed into level 0 once it is larger
+const DefaultMemTableSize int64 = 4 * 1024 * 1024 // 4MB
+
+// Default number of sstables which are kept open
+const DefaultMaxOpenFiles = 500
+
+// Default capacity of the block cache
+const DefaultCacheSize int64 = 8 * 1024 * 1024 // 8MB
+
+// Default bits of the bloom filter for each key, about 1% of
+// lookups of absent keys read a data block
+const DefaultFilterBitsPerKey = internal.DefaultBitsPerKey
+
+// Logger receives errors which can't be returned to callers, such as
+// failures of background flushes and compactions. *log.Logger implements it
+type Logger = internal.Logger
+
+// WALSyncMode tells when WAL files are synced to disk
+type WALSyncMode = wal.SyncMode
+
+const (
+	// WAL records are handed to the OS on each write. They survive a crash
+	// of the process but may be lost if the machine crashes
+	WALSyncNone = wal.SyncNone
+	// WAL file is synced to disk after each write
+	WALSyncAlways = wal.SyncAlways
+	// WAL file is synced in the background every WALSyncInterval, writes
+	// since the last sync may be lost if the machine crashes
+	WALSyncInterval = wal.SyncInterval
+	// Concurrent writes are written to WAL together and synced once,
+	// every write is durable when it returns
+	WALSyncGroupCommit = wal.SyncGroupCommit
+)
+
+// WALRecoveryMode tells how Open handles damaged records of WAL files
+type WALRecoveryMode = wal.RecoveryMode
+
+const (
+	// Damaged records at the end of a WAL file are dropped, they are left
+	// by a write which was torn by a crash. Damage followed by valid
+	// records fails Open
+	WALRecoverTolerateCorruptedTail = wal.RecoverTolerateCorruptedTail
+	// Any damaged record fails Open, including a torn tail
+	WALRecoverAbsoluteConsistency = wal.RecoverAbsoluteConsistency
+	// Recovery stops at the first damaged record, records after it are
+	// dropped, so the database is recovered to a point in time
+	WALRecoverPointInTime = wal.RecoverPointInTime
+	// Damaged records are dropped and records after them are recovered
+	WALRecoverSkipAnyCorruptedRecord = wal.RecoverSkipAnyCorruptedRecord
+)
+
+// WALRecoveryReport describes what Open replayed from WAL files
+// and what it dropped
+type WALRecoveryReport = wal.RecoveryReport
+
+// SkippedWALRecords describes a part of a WAL file which Open dropped
+type SkippedWALRecords = wal.SkippedRecords
+
+// Default period of WAL syncs in WALSyncInterval mode
+const DefaultWALSyncInterval = 100 * time.Millisecond
+
+var ErrInvalidOptions = errors.New("invalid options")
+
+// Options configures a database opened by Open.
+// Zero numeric fields and nil fields take their default values
+type Options struct {
+	// Memtable is flushed into level 0 once it is larger than this size
+	MemTableSize int64
+	// Number of levels, a database can't be opened with fewer levels than it has
+	NumLevels   int
+	WALSyncMode WALSyncMode
+	// Period of WAL syncs in WALSyncInterval mode
+	WALSyncInterval time.Duration
+	// A new WAL file is started once the current one is larger than this size
+	MaxWALFileSize int64
+	// Memtable is flushed early once the WAL files which are not deleted yet
+	// are larger than this size in total, 4 * MemTableSize by default
+	MaxTotalWALSize int64
+	// Handling of damaged WAL records on Open
+	WALRecoveryMode WALRecoveryMode
+	// Compressors of sstables of each level, the last one is used for deeper
+	// levels. By default level 0 is uncompressed, so flushes are fast, and
+	// other levels are compressed with zlib
+	Compressors []Compressor
+	// Capacity of the block cache in bytes, it is shared by all sstables
+	CacheSize int64
+	// Index and filter blocks are kept in the block cache, so they count
+	// against CacheSize and may be evicted. By default they are kept with
+	// open tables
+	CacheIndexAndFilterBlocks bool
+	// Index and filter blocks are kept in the block cache and aren't
+	// evicted while their table is open
+	PinIndexAndFilterBlocks bool
+	// Number of sstables which are kept open with their index and filter
+	MaxOpenFiles int
+	// Bits of the bloom filter of sstables for each key, more bits make
+	// fewer false positives. A negative value writes tables without filters
+	FilterBitsPerKey int
+	// Combines operands which are written by Merge, merges fail if it isn't set.
+	// A database which has operands must be opened with the same operator
+	MergeOperator MergeOperator
+	// Logger of background errors, log.Default() if nil
+	Logger Logger
+	// Database is created if it doesn't exist
+	CreateIfMissing bool
+	// Open fails if the database already exists
+	ErrorIfExists bool
+	// Reads don't verify checksums of sstable blocks.
+	// Compactions always verify them
+	SkipChecksumVerification bool
+}
+
+// Returns options which Open uses when it is given nil options
+func DefaultOptions() *Options {
+	return &Options{
+		MemTableSize:     DefaultMemTableSize,
+		NumLevels:        internal.NumLevels,
+		WALSyncMode:      WALSyncNone,
+		WALSyncInterval:  DefaultWALSyncInterval,
+		MaxWALFileSize:   wal.MaxWalFileSize,
+		MaxTotalWALSize:  4 * DefaultMemTableSize,
+		Compressors:      []Compressor{NoCompressor, ZlibCompressor},
+		CacheSize:        DefaultCacheSize,
+		MaxOpenFiles:     DefaultMaxOpenFiles,
+		FilterBitsPerKey: DefaultFilterBitsPerKey,
+		Logger:           log.Default(),
+		CreateIfMissing:  true,
+	}
+}
+
+// Returns a copy of opts whose unset fields have default values
+func (opts *Options) withDefaults() (*Options, error) {
+	if opts == nil {
+		return DefaultOptions(), nil
+	}
+	defaults := DefaultOptions()
+	o := *opts
+	if o.MemTableSize == 0 {
+		o.MemTableSize = defaults.MemTableSize
+	}
+	if o.NumLevels == 0 {
+		o.NumLevels = defaults.NumLevels
+	}
+	if o.Compressors == nil {
+		o.Compressors = defaults.Compressors
+	}
+	if o.WALSyncInterval == 0 {
+		o.WALSyncInterval = defaults.WALSyncInterval
+	}
+	if o.MaxWALFileSize == 0 {
+		o.MaxWALFileSize = defaults.MaxWALFileSize
+	}
+	if o.MaxTotalWALSize == 0 {
+		o.MaxTotalWALSize = 4 * o.MemTableSize
+	}
+	if o.CacheSize == 0 {
+		o.CacheSize = defaults.CacheSize
+	}
+	if o.MaxOpenFiles == 0 {
+		o.MaxOpenFiles = defaults.MaxOpenFiles
+	}
+	if o.FilterBitsPerKey == 0 {
+		o.FilterBitsPerKey = defaults.FilterBitsPerKey
+	}
+	if o.Logger == nil {
+		o.Logger = defaults.Logger
+	}
+	if o.MemTableSize < 0 || o.NumLevels < 2 || o.CacheSize < 0 || o.WALSyncInterval < 0 {
+		return nil, ErrInvalidOptions
+	}
+	if o.MaxWALFileSize < 0 || o.MaxTotalWALSize < 0 || o.MaxOpenFiles < 0 {
+		return nil, ErrInvalidOptions
+	}
+	if o.WALSyncMode < WALSyncNone || o.WALSyncMode > WALSyncGroupCommit {
+		return nil, ErrInvalidOptions
+	}
+	if o.WALRecoveryMode < WALRecoverTolerateCorruptedTail || o.WALRecoveryMode > WALRecoverSkipAnyCorruptedRecord {
+		return nil, ErrInvalidOptions
+	}
+	return &o, nil
+}
+
+// CloseOptions configures Close
+type CloseOptions struct {
+	// Memtable isn't flushed, its records are replayed from WAL on the next Open
+	SkipFlush bool
+}
+
+// WriteOptions configures a single write
+type WriteOptions struct {
+	// WAL is synced before the write returns, whatever the WALSyncMode is
+	Sync bool
+}
@@ -0,0 +1,137 @@
+package spacedb
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/emin/spacedb/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpen_CreateIfMissing(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+	dbPath := path.Join(testPath(), "db")
+
+	_, err := Open(dbPath, &Options{})
+	assert.Equal(t, ErrDBNotExist, err)
+
+	db, err := Open(dbPath, &Options{CreateIfMissing: true})
+	assert.Nil(t, err)
+	assert.Nil(t, db.Set([]byte("k1"), &DBValue{Value: []byte("v1")}))
+	assert.Nil(t, db.Close())
+
+	_, err = Open(dbPath, &Options{ErrorIfExists: true})
+	assert.Equal(t, ErrDBExists, err)
+
+	db, err = Open(dbPath, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1"), getValue(t, db, []byte("k1")))
+	assert.Nil(t, db.Close())
+}
+
+func TestOpen_InvalidOptions(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+	_, err := Open(testPath(), &Options{NumLevels: 1, CreateIfMissing: true})
+	assert.Equal(t, ErrInvalidOptions, err)
+	_, err = Open(testPath(), &Options{MemTableSize: -1, CreateIfMissing: true})
+	assert.Equal(t, ErrInvalidOptions, err)
+	_, err = Open(testPath(), &Options{MaxTotalWALSize: -1, CreateIfMissing: true})
+	assert.Equal(t, ErrInvalidOptions, err)
+	_, err = Open(testPath(), &Options{WALRecoveryMode: 10, CreateIfMissing: true})
+	assert.Equal(t, ErrInvalidOptions, err)
+}
+
+func TestOpen_Options(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+	var logs bytes.Buffer
+	opts := &Options{
+		MemTableSize:    16 * 1024,
+		NumLevels:       3,
+		WALSyncMode:     WALSyncAlways,
+		Compressors:     []Compressor{ZlibCompressor},
+		Logger:          log.New(&logs, "", 0),
+		CreateIfMissing: true,
+	}
+	db, err := Open(testPath(), opts)
+	assert.Nil(t, err)
+	impl := db.(*SpaceDBImpl)
+	assert.Equal(t, 3, len(impl.sstableMetadata))
+
+	// small memtables are flushed into level 0 while writing
+	value := bytes.Repeat([]byte("v"), 100)
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Set([]byte(fmt.Sprintf("k%04d", i)), &DBValue{Value: value}))
+	}
+	impl.rwLock.Lock()
+	assert.Nil(t, impl.waitForFlushes())
+	tables := 0
+	for _, files := range impl.sstableMetadata {
+		tables += len(files)
+	}
+	impl.rwLock.Unlock()
+	assert.True(t, tables > 1)
+	assert.Nil(t, db.Close())
+
+	db, err = Open(testPath(), opts)
+	assert.Nil(t, err)
+	assert.Equal(t, value, getValue(t, db, []byte("k0999")))
+	assert.Nil(t, db.Close())
+	assert.Equal(t, "", logs.String())
+}
+
+func TestOpen_FewerLevels(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+	m := internal.NewMemTable()
+	m.Set([]byte("k1"), (&DBValue{Value: []byte("v1")}).Serialize())
+	assert.Nil(t, internal.NewSSTable(testPath(), "5_1.db").Save(m))
+
+	// a database can't be opened with fewer levels than it has
+	_, err := Open(testPath(), &Options{NumLevels: 3})
+	assert.ErrorIs(t, err, ErrInvalidOptions)
+
+	db, err := Open(testPath(), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1"), getValue(t, db, []byte("k1")))
+	assert.Nil(t, db.Close())
+}
+
+func TestOpen_DoesNotExitOnError(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+	// wal is a file, so the WAL directory can't be used
+	assert.Nil(t, os.WriteFile(path.Join(testPath(), "wal"), []byte("x"), 0644))
+	_, err := Open(testPath(), nil)
+	assert.NotNil(t, err)
+}
+
+func TestOpen_FilterBitsPerKey(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+	for _, bits := range []int{-1, 0, 4} {
+		dbPath := path.Join(testPath(), fmt.Sprint(bits))
+		db, err := Open(dbPath, &Options{FilterBitsPerKey: bits, CreateIfMissing: true})
+		assert.Nil(t, err)
+		for i := 0; i < 100; i += 2 {
+			assert.Nil(t, db.Set([]byte(fmt.Sprintf("k%03d", i)), &DBValue{Value: []byte("v")}))
+		}
+		assert.Nil(t, db.Flush())
+		for i := 0; i < 99; i++ {
+			_, err := db.Get([]byte(fmt.Sprintf("k%03d", i)))
+			assert.Equal(t, i%2 == 0, err == nil)
+		}
+
+		// tables without filters are read for every key
+		stats := db.Stats()
+		assert.Equal(t, int64(99), stats.FilterHits+stats.FilterMisses)
+		assert.Equal(t, bits >= 0, stats.FilterMisses > 0)
+		assert.Nil(t, db.Close())
+	}
+}
@@ -0,0 +1,17 @@
+package spacedb
+
+import "strconv"
+
+// Names of properties which GetProperty returns
+const (
+	// Estimated number of live keys, see ApproximateKeyCount
+	PropertyEstimateNumKeys = "spacedb.estimate-num-keys"
+)
+
+func (g *SpaceDBImpl) GetProperty(name string) (string, bool) {
+	switch name {
+	case PropertyEstimateNumKeys:
+		return strconv.FormatInt(g.ApproximateKeyCount(), 10), true
+	}
+	return "", false
+}
@@ -0,0 +1,49 @@
+package spacedb
+
+import "container/list"
+
+// Snapshot is a consistent read-only view of the database as of the time
+// it is taken. Versions which a snapshot can see are kept by compaction
+// until the snapshot is released
+type Snapshot struct {
+	seq uint64
+	// element in the live snapshot list, nil after release
+	elem *list.Element
+}
+
+// Returns a snapshot of the current state of the database.
+// Returns nil if the database is closed
+func (g *SpaceDBImpl) GetSnapshot() *Snapshot {
+	g.rwLock.Lock()
+	defer g.rwLock.Unlock()
+	if g.closed {
+		return nil
+	}
+	s := &Snapshot{seq: g.versions.LastSequence}
+	s.elem = g.snapshots.PushBack(s)
+	return s
+}
+
+// Releases the snapshot, so compaction can drop versions only it can see.
+// Releasing a snapshot more than once has no effect
+func (g *SpaceDBImpl) ReleaseSnapshot(snapshot *Snapshot) {
+	if snapshot == nil {
+		return
+	}
+	g.rwLock.Lock()
+	defer g.rwLock.Unlock()
+	if snapshot.elem != nil {
+		g.snapshots.Remove(snapshot.elem)
+		snapshot.elem = nil
+	}
+}
+
+// Returns sequence number of the oldest live snapshot, last sequence
+// if there is none. Snapshots are listed from oldest to newest since
+// sequence numbers only grow. rwLock must be held
+func (g *SpaceDBImpl) smallestSnapshot() uint64 {
+	if front := g.snapshots.Front(); front != nil {
+		return front.Value.(*Snapshot).seq
+	}
+	return g.versions.LastSequence
+}
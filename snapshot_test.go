@@ -0,0 +1,87 @@
+package spacedb
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func collectKeysBackward(it Iterator) []string {
+	res := []string{}
+	for ok := it.SeekToLast(); ok; ok = it.Prev() {
+		res = append(res, string(it.Key())+"="+string(it.Value()))
+	}
+	return res
+}
+
+func TestSpaceDBImpl_Snapshot(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+	db := New(testPath()).(*SpaceDBImpl)
+	a := assert.New(t)
+
+	a.Nil(db.Set([]byte("a"), &DBValue{Value: []byte("1")}))
+	a.Nil(db.Set([]byte("b"), &DBValue{Value: []byte("1")}))
+	snap := db.GetSnapshot()
+	a.Nil(db.Set([]byte("a"), &DBValue{Value: []byte("2")}))
+	a.Nil(db.Delete([]byte("b")))
+	a.Nil(db.Set([]byte("c"), &DBValue{Value: []byte("3")}))
+
+	check := func() {
+		a.Equal([]byte("1"), getValueAt(t, db, []byte("a"), snap))
+		a.Equal([]byte("1"), getValueAt(t, db, []byte("b"), snap))
+		_, err := db.GetAt([]byte("c"), snap)
+		a.Equal(ErrNotFound, err)
+		a.Equal([]byte("2"), getValue(t, db, []byte("a")))
+		_, err = db.Get([]byte("b"))
+		a.Equal(ErrNotFound, err)
+
+		it, err := db.NewIterator(&IteratorOptions{Snapshot: snap})
+		a.Nil(err)
+		a.Equal([]string{"a=1", "b=1"}, collectKeys(it))
+		a.Equal([]string{"b=1", "a=1"}, collectKeysBackward(it))
+		a.Nil(it.Close())
+
+		it, err = db.NewIterator(&IteratorOptions{UpperBound: []byte("d")})
+		a.Nil(err)
+		a.Equal([]string{"a=2", "c=3"}, collectKeys(it))
+		a.Equal([]string{"c=3", "a=2"}, collectKeysBackward(it))
+		a.Nil(it.Close())
+	}
+	check()
+
+	// versions seen by the snapshot survive compaction
+	for i := 0; i < 4; i++ {
+		a.Nil(db.Set([]byte(fmt.Sprintf("k%v", i)), &DBValue{Value: []byte("v")}))
+		a.Nil(db.Flush())
+	}
+	db.rwLock.Lock()
+	for db.compacting {
+		db.bgCond.Wait()
+	}
+	db.rwLock.Unlock()
+	a.Equal(0, len(db.sstableMetadata[0]))
+	check()
+
+	db.ReleaseSnapshot(snap)
+	db.ReleaseSnapshot(snap)
+	a.Equal(db.versions.LastSequence, db.smallestSnapshot())
+	a.Nil(db.Close())
+}
+
+func TestSpaceDBImpl_SequenceSurvivesRestart(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+	a := assert.New(t)
+
+	db := New(testPath())
+	a.Nil(db.Set([]byte("k"), &DBValue{Value: []byte("v1")}))
+	a.Nil(db.Close())
+
+	db = New(testPath())
+	a.Nil(db.Set([]byte("k"), &DBValue{Value: []byte("v2")}))
+	a.Nil(db.Flush())
+	a.Equal([]byte("v2"), getValue(t, db, []byte("k")))
+	a.Nil(db.Close())
+}
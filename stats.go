@@ -0,0 +1,42 @@
+package spacedb
+
+// Stats holds counters of the database since it is opened
+type Stats struct {
+	// Table lookups which are skipped since the bloom filter rules the key out
+	FilterMisses int64
+	// Table lookups which pass the bloom filter
+	FilterHits int64
+	// Table lookups which pass the bloom filter but don't find the key
+	FilterFalsePositives int64
+	// Table lookups which find the table open in the table cache
+	TableCacheHits int64
+	// Table lookups which open the table
+	TableCacheMisses int64
+	// Block reads which find the block in the block cache
+	BlockCacheHits int64
+	// Block reads which read the block from the file
+	BlockCacheMisses int64
+	// Blocks which are dropped from the block cache to make room
+	BlockCacheEvictions int64
+	// Bytes of blocks in the block cache
+	BlockCacheUsage int64
+	// Bytes of pinned index and filter blocks
+	BlockCachePinnedUsage int64
+}
+
+func (g *SpaceDBImpl) Stats() *Stats {
+	hits, misses := g.tableCache.Stats()
+	blocks := g.tableCache.BlockCache.Stats()
+	return &Stats{
+		FilterMisses:          g.filterStats.Misses.Load(),
+		FilterHits:            g.filterStats.Hits.Load(),
+		FilterFalsePositives:  g.filterStats.FalsePositives.Load(),
+		TableCacheHits:        hits,
+		TableCacheMisses:      misses,
+		BlockCacheHits:        blocks.Hits,
+		BlockCacheMisses:      blocks.Misses,
+		BlockCacheEvictions:   blocks.Evictions,
+		BlockCacheUsage:       blocks.Usage,
+		BlockCachePinnedUsage: blocks.PinnedUsage,
+	}
+}
@@ -0,0 +1,127 @@
+package spacedb
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpaceDBImpl_WALSyncModes(t *testing.T) {
+	modes := []WALSyncMode{WALSyncNone, WALSyncAlways, WALSyncInterval, WALSyncGroupCommit}
+	for _, mode := range modes {
+		t.Run(fmt.Sprintf("mode %v", mode), func(t *testing.T) {
+			beforeTest()
+			defer afterTest()
+			opts := &Options{WALSyncMode: mode, WALSyncInterval: time.Millisecond, CreateIfMissing: true}
+			db, err := Open(testPath(), opts)
+			assert.Nil(t, err)
+
+			var wg sync.WaitGroup
+			for w := 0; w < 8; w++ {
+				wg.Add(1)
+				go func(w int) {
+					defer wg.Done()
+					for i := 0; i < 50; i++ {
+						key := []byte(fmt.Sprintf("w%d-k%02d", w, i))
+						assert.Nil(t, db.Set(key, &DBValue{Value: key}))
+					}
+				}(w)
+			}
+			wg.Wait()
+			assert.Nil(t, db.WriteWithOptions(singlePut("last", "v"), &WriteOptions{Sync: true}))
+			if mode == WALSyncInterval {
+				time.Sleep(10 * time.Millisecond)
+			}
+			assert.Nil(t, db.CloseWithOptions(&CloseOptions{SkipFlush: true}))
+
+			// records are replayed from WAL
+			db, err = Open(testPath(), opts)
+			assert.Nil(t, err)
+			for w := 0; w < 8; w++ {
+				for i := 0; i < 50; i++ {
+					key := []byte(fmt.Sprintf("w%d-k%02d", w, i))
+					assert.Equal(t, key, getValue(t, db, key))
+				}
+			}
+			assert.Equal(t, []byte("v"), getValue(t, db, []byte("last")))
+			assert.Equal(t, int64(401), db.ApproximateKeyCount())
+			assert.Nil(t, db.Close())
+		})
+	}
+}
+
+func TestSpaceDBImpl_GroupCommitSequences(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+	db, err := Open(testPath(), &Options{WALSyncMode: WALSyncGroupCommit, CreateIfMissing: true})
+	assert.Nil(t, err)
+	defer db.Close()
+
+	var wg sync.WaitGroup
+	for w := 0; w < 16; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				batch := NewWriteBatch()
+				batch.Put([]byte(fmt.Sprintf("w%02d-a%02d", w, i)), []byte("a"))
+				batch.Put([]byte(fmt.Sprintf("w%02d-b%02d", w, i)), []byte("b"))
+				assert.Nil(t, db.Write(batch))
+			}
+		}(w)
+	}
+	wg.Wait()
+	// every update got its own sequence number
+	assert.Equal(t, uint64(16*20*2), db.(*SpaceDBImpl).versions.LastSequence)
+	assert.Equal(t, 0, len(db.(*SpaceDBImpl).writers))
+}
+
+func singlePut(key, value string) *WriteBatch {
+	batch := NewWriteBatch()
+	batch.Put([]byte(key), []byte(value))
+	return batch
+}
+
+func benchmarkWALSyncMode(b *testing.B, mode WALSyncMode) {
+	beforeTest()
+	defer afterTest()
+	db, err := Open(testPath(), &Options{WALSyncMode: mode, CreateIfMissing: true})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+
+	value := &DBValue{Value: []byte("value")}
+	var counter atomic.Int64
+	b.SetParallelism(8)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			k := fmt.Sprintf("k%v", counter.Add(1))
+			err := db.Set([]byte(k), value)
+			if err != nil {
+				b.Error(err)
+			}
+		}
+	})
+}
+
+func BenchmarkSet_WALSyncNone(b *testing.B) {
+	benchmarkWALSyncMode(b, WALSyncNone)
+}
+
+func BenchmarkSet_WALSyncAlways(b *testing.B) {
+	benchmarkWALSyncMode(b, WALSyncAlways)
+}
+
+func BenchmarkSet_WALSyncInterval(b *testing.B) {
+	benchmarkWALSyncMode(b, WALSyncInterval)
+}
+
+func BenchmarkSet_WALSyncGroupCommit(b *testing.B) {
+	benchmarkWALSyncMode(b, WALSyncGroupCommit)
+}